@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"kraken/internal/orderbook"
+)
+
+// replay replays a captured instruction log through the order book and compares the outputs
+// with a recorded output log (same format as 'internal/orderbook/testdata').
+// It reports the first divergence of each scenario and exits with status 1 if there is any.
+// With '-scenarios', it runs a file in scenario format v2 instead and reports the first failure of each scenario.
+func main() {
+	input := flag.String("input", "internal/orderbook/testdata/input.txt", "captured instructions")
+	output := flag.String("output", "internal/orderbook/testdata/output.txt", "recorded outputs")
+	scenarioFile := flag.String("scenarios", "", "scenarios in format v2 (instead of -input and -output)")
+	contextLines := flag.Int("context", 5, "number of matching outputs printed before a divergence")
+	flag.Parse()
+
+	if *scenarioFile != "" {
+		runScenarios(*scenarioFile)
+		return
+	}
+
+	scenarios, err := orderbook.ReadScenarios(*input, *output)
+	if err != nil {
+		log.Fatalf("Error when reading scenarios: %s", err.Error())
+	}
+
+	divergences := 0
+	for i, scenario := range scenarios {
+		divergence, err := orderbook.DiffScenario(scenario, *contextLines)
+		if err != nil {
+			log.Fatalf("Error when replaying scenario %d: %s", i+1, err.Error())
+		}
+
+		if divergence != nil {
+			divergences++
+			fmt.Println(divergence)
+		}
+	}
+
+	fmt.Printf("%d scenarios replayed, %d divergent\n", len(scenarios), divergences)
+	if divergences > 0 {
+		os.Exit(1)
+	}
+}
+
+// runScenarios runs the scenarios of a file in format v2 and exits with status 1 if any fails.
+func runScenarios(path string) {
+	scenarios, err := orderbook.ReadScenarioFile(path)
+	if err != nil {
+		log.Fatalf("Error when reading scenarios: %s", err.Error())
+	}
+
+	failures := 0
+	for _, scenario := range scenarios {
+		if err := orderbook.RunScenario(scenario); err != nil {
+			failures++
+			fmt.Printf("%s: %s\n", scenario.Description, err)
+		}
+	}
+
+	fmt.Printf("%d scenarios run, %d failed\n", len(scenarios), failures)
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"kraken/internal/simulation"
+)
+
+// simulate runs market makers, noise traders, momentum traders and informed traders against an order book
+// per symbol and prints the summary of the run (and the event stream with '-events').
+// Runs are reproducible: the same flags give the same events and the same summary.
+func main() {
+	seed := flag.Int64("seed", 1, "seed of the random sources")
+	duration := flag.Duration("duration", time.Hour, "simulated duration")
+	symbols := flag.String("symbols", "IBM:100", "simulated symbols with their initial price (SYMBOL:PRICE,...)")
+	volatility := flag.Float64("volatility", 0.05, "standard deviation of the fundamental values per second")
+	makers := flag.Int("makers", 2, "number of market makers per symbol")
+	noise := flag.Int("noise", 20, "number of noise traders per symbol")
+	momentum := flag.Int("momentum", 2, "number of momentum traders per symbol")
+	informed := flag.Int("informed", 1, "number of informed traders per symbol")
+	events := flag.Bool("events", false, "print the event stream")
+	flag.Parse()
+
+	start := time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC)
+	sim := simulation.New(*seed, start)
+	if *events {
+		sim.OnEvent = printEvent
+	}
+
+	for _, spec := range strings.Split(*symbols, ",") {
+		symbol, price, err := parseSymbol(spec)
+		if err != nil {
+			log.Fatalf("Error when parsing symbols: %s", err.Error())
+		}
+		sim.AddSymbol(symbol, price, *volatility)
+
+		for i := 0; i < *makers; i++ {
+			sim.AddAgent(&simulation.MarketMaker{Symbol: symbol, HalfSpread: 1 + i, Quantity: 100, MaxInventory: 300},
+				simulation.FixedArrivals{Interval: time.Second})
+		}
+		for i := 0; i < *noise; i++ {
+			sim.AddAgent(&simulation.NoiseTrader{
+				Symbol: symbol, MaxQuantity: 50, PriceRange: 5, AggressiveRatio: 0.3, MaxOrders: 5,
+			}, simulation.PoissonArrivals{Rate: 0.1})
+		}
+		for i := 0; i < *momentum; i++ {
+			sim.AddAgent(&simulation.MomentumTrader{Symbol: symbol, Lookback: 10, Threshold: 2, Quantity: 20, MaxPosition: 500},
+				simulation.PoissonArrivals{Rate: 0.2})
+		}
+		for i := 0; i < *informed; i++ {
+			sim.AddAgent(&simulation.InformedTrader{Symbol: symbol, Edge: 1, Quantity: 20, MaxPosition: 500},
+				simulation.PoissonArrivals{Rate: 0.5})
+		}
+	}
+
+	report, err := sim.Run(*duration)
+	if err != nil {
+		log.Fatalf("Error when running the simulation: %s", err.Error())
+	}
+
+	fmt.Print(report)
+}
+
+// parseSymbol parses a symbol with its initial price: 'SYMBOL:PRICE'.
+func parseSymbol(spec string) (string, int, error) {
+	symbol, price, ok := strings.Cut(strings.TrimSpace(spec), ":")
+	if !ok || symbol == "" {
+		return "", 0, fmt.Errorf("Symbol should be 'SYMBOL:PRICE': %q", spec)
+	}
+
+	initialPrice, err := strconv.Atoi(price)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return symbol, initialPrice, nil
+}
+
+// printEvent prints an instruction of an agent followed by its outputs.
+func printEvent(event simulation.Event) {
+	fmt.Printf("%s %s/%d %s\n", event.Time.Format(time.RFC3339Nano), event.Agent, event.User, event.Instruction)
+	for _, output := range event.Outputs {
+		fmt.Printf("\t%s\n", output.Output)
+	}
+}
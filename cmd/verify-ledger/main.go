@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"kraken/internal/orderbook"
+)
+
+// verify-ledger audits a ledger file (written by orderbook.Ledger) against the segments of a trade tape
+// (written by orderbook.TradeTape, which must be closed to write its last trades) and reports every discrepancy.
+// It exits with status 1 if there is any.
+func main() {
+	ledgerPath := flag.String("ledger", "ledger.jsonl", "ledger entries")
+	tapeDir := flag.String("tape", "tape", "directory of the trade tape segments")
+	flag.Parse()
+
+	file, err := os.Open(*ledgerPath)
+	if err != nil {
+		log.Fatalf("Error when opening ledger: %s", err.Error())
+	}
+	defer file.Close()
+
+	entries, err := orderbook.ReadLedger(file)
+	if err != nil {
+		log.Fatalf("Error when reading ledger: %s", err.Error())
+	}
+
+	segments, err := orderbook.TapeSegments(*tapeDir)
+	if err != nil {
+		log.Fatalf("Error when listing tape segments: %s", err.Error())
+	}
+
+	var tape []orderbook.TapeEntry
+	for _, segment := range segments {
+		trades, err := orderbook.ReadTapeSegment(segment)
+		if err != nil {
+			log.Fatalf("Error when reading tape: %s", err.Error())
+		}
+		tape = append(tape, trades...)
+	}
+
+	discrepancies := orderbook.VerifyLedger(entries, tape)
+	for _, discrepancy := range discrepancies {
+		fmt.Println(discrepancy)
+	}
+
+	fmt.Printf("%d entries and %d trades verified, %d discrepancies\n", len(entries), len(tape), len(discrepancies))
+	if len(discrepancies) > 0 {
+		os.Exit(1)
+	}
+}
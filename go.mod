@@ -1,6 +1,6 @@
 module kraken
 
-go 1.18
+go 1.21
 
 require github.com/maxatome/go-testdeep v1.11.0
 
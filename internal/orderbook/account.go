@@ -0,0 +1,292 @@
+package orderbook
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DefaultQuoteAsset is the quote asset of the symbols which have no instrument.
+const DefaultQuoteAsset = "USD"
+
+// Instrument gives the assets exchanged when a symbol is traded: the base asset is bought or sold,
+// and it is paid with the quote asset (price * quantity).
+type Instrument struct {
+	Base  string
+	Quote string
+}
+
+// Balance is what a user holds of an asset. The reserved amount is held by the live orders of the user,
+// so only the available amount (total - reserved) can be used by a new order or withdrawn.
+type Balance struct {
+	User     int
+	Asset    string
+	Total    int
+	Reserved int
+}
+
+// Available returns the amount which is not reserved.
+func (b Balance) Available() int {
+	return b.Total - b.Reserved
+}
+
+// AccountService keeps the balances of the users by asset (see OrderBook.Accounts).
+// When an order is accepted, the quote amount (price * quantity) of a buy order or the base quantity of a sell order
+// is reserved, and the order is rejected if the available balance is insufficient. Cancels, expirations and fills
+// release the reservation, and a fill transfers the funds between the buyer and the seller.
+// It is goroutine-safe, so it can be shared by the order books of an engine. Deposits and withdrawals made with
+// OrderBook.Deposit and OrderBook.Withdraw are journaled instructions, and the balances are part of the snapshot
+// of an order book: restoring it replaces the totals of its balances, and the restored orders reserve their funds. The fees of a trade (see FeeEngine) are charged in the quote asset and credited to the
+// FeeAccount as in the Ledger. They are not reserved, so a fee may exceed the available balance of the user.
+type AccountService struct {
+	mu          sync.Mutex
+	instruments map[string]Instrument
+	balances    map[int]map[string]*Balance
+}
+
+// NewAccountService creates an account service without balances.
+func NewAccountService() *AccountService {
+	return &AccountService{
+		instruments: map[string]Instrument{},
+		balances:    map[int]map[string]*Balance{},
+	}
+}
+
+// SetInstrument sets the assets of a symbol. By default, a symbol is its own base asset quoted in DefaultQuoteAsset.
+func (as *AccountService) SetInstrument(symbol string, instrument Instrument) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.instruments[symbol] = instrument
+}
+
+// GetInstrument returns the assets of a symbol.
+func (as *AccountService) GetInstrument(symbol string) Instrument {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.instrument(symbol)
+}
+
+// Deposit adds funds to the balance of a user.
+func (as *AccountService) Deposit(user int, asset string, amount int) error {
+	if amount <= 0 {
+		return fmt.Errorf("Deposit amount should be positive: %d", amount)
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.getOrCreate(user, asset).Total += amount
+	return nil
+}
+
+// Withdraw removes funds from the available balance of a user.
+func (as *AccountService) Withdraw(user int, asset string, amount int) error {
+	if amount <= 0 {
+		return fmt.Errorf("Withdrawal amount should be positive: %d", amount)
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	b := as.getOrCreate(user, asset)
+	if b.Available() < amount {
+		return fmt.Errorf("Insufficient available balance of %s for user %d: %d < %d", asset, user, b.Available(), amount)
+	}
+
+	b.Total -= amount
+	return nil
+}
+
+// transfer adds a signed amount to the balance of a user whatever the available balance
+// (used to revert a transfer which was applied).
+func (as *AccountService) transfer(user int, asset string, amount int) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.getOrCreate(user, asset).Total += amount
+}
+
+// GetBalance returns a copy of the balance of a user for an asset (empty if the user never held it).
+func (as *AccountService) GetBalance(user int, asset string) Balance {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if b, ok := as.balances[user][asset]; ok {
+		return *b
+	}
+
+	return Balance{User: user, Asset: asset}
+}
+
+// GetBalances returns a copy of all the balances of a user sorted by asset.
+func (as *AccountService) GetBalances(user int) []Balance {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	balances := make([]Balance, 0, len(as.balances[user]))
+	for _, b := range as.balances[user] {
+		balances = append(balances, *b)
+	}
+
+	sort.Slice(balances, func(i, j int) bool { return balances[i].Asset < balances[j].Asset })
+	return balances
+}
+
+// snapshot returns a copy of all the balances sorted by user and asset.
+func (as *AccountService) snapshot() []Balance {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	var balances []Balance
+	for _, assets := range as.balances {
+		for _, b := range assets {
+			balances = append(balances, *b)
+		}
+	}
+
+	sort.Slice(balances, func(i, j int) bool {
+		if balances[i].User != balances[j].User {
+			return balances[i].User < balances[j].User
+		}
+		return balances[i].Asset < balances[j].Asset
+	})
+	return balances
+}
+
+// restore replaces the totals of the given balances and reserves the funds of the given live orders.
+// The other balances and reservations are kept, as the account service may be shared with other order books
+// (the reservations of the restored order book were released when it was flushed).
+func (as *AccountService) restore(balances []Balance, orders []*Order) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	for _, b := range balances {
+		as.getOrCreate(b.User, b.Asset).Total = b.Total
+	}
+
+	for _, order := range orders {
+		asset, amount := as.reservation(order, order.Quantity)
+		as.getOrCreate(order.User, asset).Reserved += amount
+	}
+}
+
+// tryReserve reserves the funds of a new order if the available balance is sufficient.
+func (as *AccountService) tryReserve(order *Order) bool {
+	if as == nil {
+		return true
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	asset, amount := as.reservation(order, order.Quantity)
+	b := as.getOrCreate(order.User, asset)
+	if b.Available() < amount {
+		return false
+	}
+
+	b.Reserved += amount
+	return true
+}
+
+// tryReplace replaces the reservation of a live order by the one of its modification
+// if the available balance is sufficient, else the reservation is kept.
+func (as *AccountService) tryReplace(existing, order *Order) bool {
+	if as == nil {
+		return true
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	asset, released := as.reservation(existing, existing.Quantity)
+	_, amount := as.reservation(order, order.Quantity)
+	b := as.getOrCreate(order.User, asset)
+	if b.Available()+released < amount {
+		return false
+	}
+
+	b.Reserved += amount - released
+	return true
+}
+
+// release releases the reservation of the given quantity of an order (cancel or expiration).
+func (as *AccountService) release(order *Order, quantity int) {
+	if as == nil {
+		return
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.releaseLocked(order, quantity)
+}
+
+// applyTrade releases the reservations of both orders of a trade and transfers the funds with the postings
+// of the Ledger: the buyer pays the quote amount at the trade price to the seller, who delivers the base quantity,
+// then each party pays its fee in the quote asset to the FeeAccount.
+func (as *AccountService) applyTrade(trade *Trade) {
+	if as == nil {
+		return
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	as.releaseLocked(trade.BuyOrder, trade.Quantity)
+	as.releaseLocked(trade.SellOrder, trade.Quantity)
+
+	instrument := as.instrument(trade.Symbol())
+	buyer, seller := trade.BuyOrder.User, trade.SellOrder.User
+	postings := settlementPostings(buyer, seller, instrument, trade.Price, trade.Quantity)
+	if trade.BuyFee != 0 {
+		postings = append(postings, feePostings(buyer, instrument.Quote, trade.BuyFee)...)
+	}
+	if trade.SellFee != 0 {
+		postings = append(postings, feePostings(seller, instrument.Quote, trade.SellFee)...)
+	}
+
+	for _, p := range postings {
+		as.getOrCreate(p.User, p.Asset).Total += p.Amount
+	}
+}
+
+// releaseLocked releases the reservation of the given quantity of an order, the lock must be held.
+func (as *AccountService) releaseLocked(order *Order, quantity int) {
+	asset, amount := as.reservation(order, quantity)
+	as.getOrCreate(order.User, asset).Reserved -= amount
+}
+
+// reservation returns the asset and the amount reserved for the given quantity of an order:
+// the quote amount at the limit price for a buy order and the base quantity for a sell order.
+func (as *AccountService) reservation(order *Order, quantity int) (string, int) {
+	instrument := as.instrument(order.Symbol)
+	if order.OrderSide == "B" {
+		return instrument.Quote, order.Price * quantity
+	}
+
+	return instrument.Base, quantity
+}
+
+// instrument returns the assets of a symbol, the lock must be held.
+func (as *AccountService) instrument(symbol string) Instrument {
+	if instrument, ok := as.instruments[symbol]; ok {
+		return instrument
+	}
+
+	return Instrument{Base: symbol, Quote: DefaultQuoteAsset}
+}
+
+// getOrCreate returns the balance of a user for an asset and creates it if needed, the lock must be held.
+func (as *AccountService) getOrCreate(user int, asset string) *Balance {
+	balances, ok := as.balances[user]
+	if !ok {
+		balances = map[string]*Balance{}
+		as.balances[user] = balances
+	}
+
+	b, ok := balances[asset]
+	if !ok {
+		b = &Balance{User: user, Asset: asset}
+		balances[asset] = b
+	}
+
+	return b
+}
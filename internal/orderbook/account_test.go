@@ -0,0 +1,278 @@
+package orderbook_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestOrderBook_Accounts(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	accounts := orderbook.NewAccountService()
+	accounts.SetInstrument("BTC/USD", orderbook.Instrument{Base: "BTC", Quote: "USD"})
+	require.CmpNoError(accounts.Deposit(1, "USD", 1000))
+	require.CmpNoError(accounts.Deposit(2, "BTC", 10))
+	assert.CmpError(accounts.Deposit(1, "USD", 0))
+	assert.Cmp(accounts.GetInstrument("IBM"), orderbook.Instrument{Base: "IBM", Quote: orderbook.DefaultQuoteAsset})
+
+	ob := orderbook.NewOrderBook(true)
+	ob.Accounts = accounts
+	process := func(instruction string) []string {
+		output, err := ob.ProcessInstruction(instruction)
+		require.CmpNoError(err)
+		return output
+	}
+	balance := func(user int, asset string) orderbook.Balance {
+		return accounts.GetBalance(user, asset)
+	}
+
+	// The quote amount of a buy order is reserved
+	process("N, 1, BTC/USD, 100, 5, B, 1")
+	assert.Cmp(balance(1, "USD"), orderbook.Balance{User: 1, Asset: "USD", Total: 1000, Reserved: 500})
+
+	assert.Cmp(process("N, 1, BTC/USD, 100, 6, B, 2"), []string{"R, 1, 2"})
+	status, _ := ob.Orders.GetOrderStatus(1, 2)
+	assert.Cmp(status.RejectReason, orderbook.InsufficientFundsRejectReason)
+
+	// A fill releases the reservations and transfers the funds
+	process("N, 2, BTC/USD, 90, 3, S, 1")
+	assert.Cmp(accounts.GetBalances(1), []orderbook.Balance{
+		{User: 1, Asset: "BTC", Total: 3},
+		{User: 1, Asset: "USD", Total: 700, Reserved: 200},
+	})
+	assert.Cmp(accounts.GetBalances(2), []orderbook.Balance{
+		{User: 2, Asset: "BTC", Total: 7},
+		{User: 2, Asset: "USD", Total: 300},
+	})
+
+	// A cancel releases the reservation
+	process("C, 1, 1")
+	assert.Cmp(balance(1, "USD").Reserved, 0)
+
+	// The buyer pays the trade price, the rest of the reservation at its limit price is released
+	process("N, 2, BTC/USD, 95, 2, S, 2")
+	assert.Cmp(balance(2, "BTC").Reserved, 2)
+	process("N, 1, BTC/USD, 100, 2, B, 3")
+	assert.Cmp(balance(1, "USD"), orderbook.Balance{User: 1, Asset: "USD", Total: 510})
+	assert.Cmp(balance(2, "BTC"), orderbook.Balance{User: 2, Asset: "BTC", Total: 5})
+
+	// A modify replaces the reservation only if the balance is sufficient
+	process("N, 1, BTC/USD, 10, 10, B, 4")
+	assert.Cmp(process("N, 1, BTC/USD, 60, 10, B, 4"), []string{"R, 1, 4"})
+	assert.Cmp(balance(1, "USD").Reserved, 100)
+	process("N, 1, BTC/USD, 40, 10, B, 4")
+	assert.Cmp(balance(1, "USD").Reserved, 400)
+	process("N, 1, BTC/USD, 40, 5, B, 4")
+	assert.Cmp(balance(1, "USD").Reserved, 200)
+
+	// Only the available balance can be withdrawn
+	assert.CmpError(accounts.Withdraw(1, "USD", 400))
+	require.CmpNoError(accounts.Withdraw(1, "USD", 300))
+	assert.Cmp(balance(1, "USD"), orderbook.Balance{User: 1, Asset: "USD", Total: 210, Reserved: 200})
+	assert.Cmp(balance(1, "USD").Available(), 10)
+
+	// The balances are restored with the reservations of the restored orders,
+	// the other balances of the account service are kept (it may be shared with other books)
+	var buf bytes.Buffer
+	require.CmpNoError(ob.WriteSnapshot(&buf))
+	restored := orderbook.NewOrderBook(true)
+	restored.Accounts = orderbook.NewAccountService()
+	restored.Accounts.SetInstrument("BTC/USD", orderbook.Instrument{Base: "BTC", Quote: "USD"})
+	require.CmpNoError(restored.Accounts.Deposit(3, "USD", 50))
+	_, err := restored.ReadSnapshot(&buf)
+	require.CmpNoError(err)
+	assert.Cmp(restored.Accounts.GetBalances(1), accounts.GetBalances(1))
+	assert.Cmp(restored.Accounts.GetBalances(2), accounts.GetBalances(2))
+	assert.Cmp(restored.Accounts.GetBalances(3), []orderbook.Balance{{User: 3, Asset: "USD", Total: 50}})
+
+	// Restoring the snapshot in the same book doesn't reserve the funds twice
+	buf.Reset()
+	require.CmpNoError(ob.WriteSnapshot(&buf))
+	_, err = ob.ReadSnapshot(&buf)
+	require.CmpNoError(err)
+	assert.Cmp(balance(1, "USD"), orderbook.Balance{User: 1, Asset: "USD", Total: 210, Reserved: 200})
+
+	process("F")
+	assert.Cmp(balance(1, "USD").Reserved, 0)
+}
+
+func TestOrderBook_Transfers(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ob := orderbook.NewOrderBook(true)
+	assert.String(ob.Deposit(1, "USD", 100), "Can't transfer funds as the order book has no account service")
+
+	ob.Accounts = orderbook.NewAccountService()
+	require.CmpNoError(ob.Deposit(1, "USD", 1000))
+	_, err := ob.ProcessInstruction("N, 1, IBM, 100, 5, B, 1")
+	require.CmpNoError(err)
+
+	// Only the available balance can be withdrawn
+	assert.String(ob.Withdraw(1, "USD", 600), "Insufficient available balance of USD for user 1: 500 < 600")
+	require.CmpNoError(ob.Withdraw(1, "USD", 400))
+	assert.Cmp(ob.Accounts.GetBalance(1, "USD"), orderbook.Balance{User: 1, Asset: "USD", Total: 600, Reserved: 500})
+
+	output, err := ob.ProcessInstruction("D, 1, USD, 50")
+	require.CmpNoError(err)
+	assert.Len(output, 0)
+	assert.Cmp(ob.Accounts.GetBalance(1, "USD").Total, 650)
+
+	for _, instruction := range []string{"D, 1, USD, 0", "W, 1, USD, -5", "D, x, USD, 5", "D, 1, USD"} {
+		_, err := ob.ProcessInstruction(instruction)
+		assert.CmpError(err, instruction)
+	}
+	assert.Cmp(ob.Accounts.GetBalance(1, "USD").Total, 650)
+}
+
+func TestOrderBook_ConcurrentWithdrawals(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	accounts := orderbook.NewAccountService()
+	require.CmpNoError(accounts.Deposit(1, "USD", 1000))
+
+	// The order books sharing the account service withdraw at the same time, the balance can't be overdrawn
+	var withdrawn int64
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		ob := orderbook.NewOrderBook(true)
+		ob.Accounts = accounts
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if ob.Withdraw(1, "USD", 100) == nil {
+					atomic.AddInt64(&withdrawn, 100)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Cmp(withdrawn, int64(1000))
+	assert.Cmp(accounts.GetBalance(1, "USD").Total, 0)
+}
+
+func TestOrderBook_SnapshotSharedAccounts(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	accounts := orderbook.NewAccountService()
+	books := map[string]*orderbook.OrderBook{}
+	for _, symbol := range []string{"IBM", "AAPL"} {
+		books[symbol] = orderbook.NewOrderBook(true)
+		books[symbol].Accounts = accounts
+	}
+
+	require.CmpNoError(books["IBM"].Deposit(1, "USD", 1000))
+	require.CmpNoError(books["IBM"].Deposit(2, "USD", 1000))
+	_, err := books["IBM"].ProcessInstruction("N, 1, IBM, 10, 20, B, 1")
+	require.CmpNoError(err)
+	_, err = books["AAPL"].ProcessInstruction("N, 1, AAPL, 10, 30, B, 1")
+	require.CmpNoError(err)
+
+	var buf bytes.Buffer
+	require.CmpNoError(books["IBM"].WriteSnapshot(&buf))
+	_, err = books["AAPL"].ProcessInstruction("N, 2, AAPL, 10, 10, B, 2")
+	require.CmpNoError(err)
+
+	// Restoring a book keeps the reservations of the other book and the balances it doesn't hold
+	_, err = books["IBM"].ReadSnapshot(&buf)
+	require.CmpNoError(err)
+	assert.Cmp(accounts.GetBalance(1, "USD"), orderbook.Balance{User: 1, Asset: "USD", Total: 1000, Reserved: 500})
+	assert.Cmp(accounts.GetBalance(2, "USD"), orderbook.Balance{User: 2, Asset: "USD", Total: 1000, Reserved: 100})
+}
+
+func TestOrderBook_RecoverAccounts(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "journal")
+	snapshotPath := filepath.Join(dir, "snapshot")
+
+	newBook := func() *orderbook.OrderBook {
+		ob := newJournaledOrderBook(orderbook.NewFakeClock(time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC)))
+		ob.Accounts = orderbook.NewAccountService()
+		return ob
+	}
+
+	ob := newBook()
+	_, err := ob.Recover(journalPath)
+	require.CmpNoError(err)
+
+	require.CmpNoError(ob.Deposit(1, "USD", 1000))
+	require.CmpNoError(ob.Deposit(2, "IBM", 20))
+	_, err = ob.ProcessFromStringInstructions(`
+N, 1, IBM, 100, 5, B, 1
+N, 2, IBM, 100, 3, S, 2
+`)
+	require.CmpNoError(err)
+	require.CmpNoError(ob.Withdraw(1, "USD", 200))
+	require.CmpNoError(ob.SaveSnapshot(snapshotPath))
+
+	// Deposits after the snapshot are replayed
+	require.CmpNoError(ob.Deposit(1, "USD", 500))
+	_, err = ob.ProcessFromStringInstructions(`
+N, 1, IBM, 100, 8, B, 3
+N, 2, IBM, 100, 4, S, 4
+`)
+	require.CmpNoError(err)
+	require.CmpNoError(ob.Journal.Close())
+
+	expected := append(ob.Accounts.GetBalances(1), ob.Accounts.GetBalances(2)...)
+	assert.Cmp(expected, []orderbook.Balance{
+		{User: 1, Asset: "IBM", Total: 7},
+		{User: 1, Asset: "USD", Total: 600, Reserved: 600},
+		{User: 2, Asset: "IBM", Total: 13},
+		{User: 2, Asset: "USD", Total: 700},
+	})
+
+	// A transfer which can't be journaled is reverted
+	assert.CmpError(ob.Deposit(2, "USD", 100))
+	assert.Cmp(ob.Accounts.GetBalances(2), expected[2:])
+
+	// From the whole journal
+	recovered := newBook()
+	_, err = recovered.Recover(journalPath)
+	require.CmpNoError(err)
+	assert.Cmp(append(recovered.Accounts.GetBalances(1), recovered.Accounts.GetBalances(2)...), expected)
+	require.CmpNoError(recovered.Journal.Close())
+
+	// From the snapshot and the end of the journal
+	recovered = newBook()
+	_, err = recovered.RecoverFromSnapshot(snapshotPath, journalPath)
+	require.CmpNoError(err)
+	assert.Cmp(append(recovered.Accounts.GetBalances(1), recovered.Accounts.GetBalances(2)...), expected)
+	require.CmpNoError(recovered.Journal.Close())
+}
+
+func TestOrderBook_AccountsDuringHalt(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	accounts := orderbook.NewAccountService()
+	require.CmpNoError(accounts.Deposit(1, "USD", 1000))
+
+	ob := orderbook.NewOrderBook(true)
+	ob.Accounts = accounts
+	ob.HaltPolicy = orderbook.QueueHaltPolicy
+	_, err := ob.ProcessFromStringInstructions(`
+S, IBM, HALTED
+N, 1, IBM, 100, 5, B, 1
+N, 1, IBM, 100, 6, B, 2
+`)
+	require.CmpNoError(err)
+	assert.Cmp(accounts.GetBalance(1, "USD").Reserved, 500)
+
+	// Queued orders are rejected at close, which releases their reservation
+	output, err := ob.ProcessInstruction("S, IBM, CLOSED")
+	require.CmpNoError(err)
+	assert.Cmp(output, []string{"S, IBM, CLOSED", "R, 1, 1"})
+	assert.Cmp(accounts.GetBalance(1, "USD").Reserved, 0)
+}
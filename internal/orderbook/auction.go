@@ -0,0 +1,175 @@
+package orderbook
+
+import "sort"
+
+// Equilibrium is the result of the uncrossing algorithm of a call auction.
+type Equilibrium struct {
+	Price     int
+	Volume    int // Quantity executable at the price
+	Imbalance int // Bid volume minus ask volume at the price
+}
+
+// GetEquilibrium computes the price at which the orders of the symbol would uncross.
+// The equilibrium price is, among the prices of the orders:
+//   - the one which maximizes the executable volume,
+//   - then the one which minimizes the imbalance,
+//   - then the closest to the reference price (the last traded price),
+//   - then the lowest one.
+//
+// If no order can be executed, the volume is 0. Orders of the same user are counted, even though they
+// don't match each other at the uncross.
+func (ob *OrderBook) GetEquilibrium(symbol string) Equilibrium {
+	if equilibria := ob.equilibria(symbol); len(equilibria) > 0 {
+		return equilibria[0]
+	}
+
+	return Equilibrium{}
+}
+
+// equilibria returns the prices of the orders of the symbol at which orders can be executed,
+// from the best equilibrium to the worst one (see GetEquilibrium).
+func (ob *OrderBook) equilibria(symbol string) []Equilibrium {
+	bids := filterBySymbol(ob.BidQueue.Orders(), symbol)
+	asks := filterBySymbol(ob.AskQueue.Orders(), symbol)
+	reference := ob.getSymbolStatus(symbol).lastPrice
+
+	var equilibria []Equilibrium
+	for _, price := range candidatePrices(bids, asks) {
+		bidVolume := 0
+		for _, o := range bids {
+			if o.Price >= price {
+				bidVolume += o.Quantity
+			}
+		}
+
+		askVolume := 0
+		for _, o := range asks {
+			if o.Price <= price {
+				askVolume += o.Quantity
+			}
+		}
+
+		candidate := Equilibrium{Price: price, Volume: bidVolume, Imbalance: bidVolume - askVolume}
+		if askVolume < bidVolume {
+			candidate.Volume = askVolume
+		}
+
+		if candidate.Volume > 0 {
+			equilibria = append(equilibria, candidate)
+		}
+	}
+
+	sort.Slice(equilibria, func(i, j int) bool {
+		return isBetterEquilibrium(equilibria[i], equilibria[j], reference)
+	})
+
+	return equilibria
+}
+
+// isBetterEquilibrium indicates if the candidate is a better equilibrium than the best one found so far.
+func isBetterEquilibrium(candidate, best Equilibrium, reference int) bool {
+	switch {
+	case candidate.Volume != best.Volume:
+		return candidate.Volume > best.Volume
+	case abs(candidate.Imbalance) != abs(best.Imbalance):
+		return abs(candidate.Imbalance) < abs(best.Imbalance)
+	case abs(candidate.Price-reference) != abs(best.Price-reference):
+		return abs(candidate.Price-reference) < abs(best.Price-reference)
+	default:
+		return candidate.Price < best.Price
+	}
+}
+
+// uncross matches all the executable orders of the symbol at the equilibrium price.
+// Orders are matched by priority (price then time) on both sides, but orders of the same user never match
+// each other: a bid is matched with the next asks of other users. As the equilibrium counts the orders of the
+// same user, orders of different users can be left crossed: the remaining orders are uncrossed again at their
+// best equilibrium price where orders match (see equilibria), until no order of a user crosses an order of
+// another user.
+func (ob *OrderBook) uncross(symbol string) []SequencedOutput {
+	var result []SequencedOutput
+	oldBidTOB, oldAskTOB := ob.BidQueue.GetTOBInfo(), ob.AskQueue.GetTOBInfo()
+
+	for matched := true; matched; {
+		matched = false
+		for _, equilibrium := range ob.equilibria(symbol) {
+			if trades := ob.matchAtPrice(symbol, equilibrium.Price); len(trades) > 0 {
+				result = append(result, trades...)
+				matched = true
+				break
+			}
+		}
+	}
+
+	// If TOB changes, generate a TOB change output
+	if oldBidTOB != ob.BidQueue.GetTOBInfo() {
+		result = append(result, outputsOf(ob.generateTopOfBookChangeOutput(ob.BidQueue))...)
+	}
+	if oldAskTOB != ob.AskQueue.GetTOBInfo() {
+		result = append(result, outputsOf(ob.generateTopOfBookChangeOutput(ob.AskQueue))...)
+	}
+
+	return result
+}
+
+// matchAtPrice matches the executable orders of the symbol at the given price and returns the outputs of the trades.
+func (ob *OrderBook) matchAtPrice(symbol string, price int) []SequencedOutput {
+	var result []SequencedOutput
+	bids := filterBySymbol(ob.BidQueue.Orders(), symbol)
+	asks := filterBySymbol(ob.AskQueue.Orders(), symbol)
+	for _, bid := range bids {
+		if bid.Price < price {
+			break
+		}
+
+		for _, ask := range asks {
+			if bid.Quantity == 0 || ask.Price > price {
+				break
+			}
+			if ask.Quantity == 0 || ask.User == bid.User {
+				continue
+			}
+
+			quantity := bid.Quantity
+			if ask.Quantity < quantity {
+				quantity = ask.Quantity
+			}
+
+			trade := &Trade{BuyOrder: bid, SellOrder: ask, Price: price, Quantity: quantity}
+			result = append(result, ob.processTrade(trade, bid, ask)...)
+
+			ob.BidQueue.fill(bid, quantity)
+			ob.AskQueue.fill(ask, quantity)
+		}
+	}
+
+	return result
+}
+
+// filterBySymbol returns the orders of the given symbol.
+func filterBySymbol(orders []*Order, symbol string) []*Order {
+	var filtered []*Order
+	for _, o := range orders {
+		if o.Symbol == symbol {
+			filtered = append(filtered, o)
+		}
+	}
+
+	return filtered
+}
+
+// candidatePrices returns the distinct prices of the given orders.
+func candidatePrices(bids, asks []*Order) []int {
+	var prices []int
+	seen := map[int]struct{}{}
+	for _, orders := range [][]*Order{bids, asks} {
+		for _, o := range orders {
+			if _, ok := seen[o.Price]; !ok {
+				seen[o.Price] = struct{}{}
+				prices = append(prices, o.Price)
+			}
+		}
+	}
+
+	return prices
+}
@@ -0,0 +1,141 @@
+package orderbook_test
+
+import (
+	"testing"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestOrderBook_CallAuction(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	// Even if the order book can't trade, crossing orders are accepted during the auction
+	ob := orderbook.NewOrderBook(false)
+
+	output, err := ob.ProcessFromStringInstructions(`
+S, IBM, AUCTION
+N, 1, IBM, 10, 100, B, 1
+N, 2, IBM, 11, 50, B, 2
+N, 3, IBM, 9, 120, S, 3
+N, 4, IBM, 10, 60, S, 4
+`)
+	require.CmpNoError(err)
+	assert.Cmp(output, `S, IBM, AUCTION
+A, 1, 1
+B, B, 10, 100
+A, 2, 2
+B, B, 11, 50
+A, 3, 3
+B, S, 9, 120
+A, 4, 4`)
+
+	// At 10, 150 can be executed (120 at 9, 150 at 10 and 50 at 11)
+	assert.Cmp(ob.GetEquilibrium("IBM"), orderbook.Equilibrium{Price: 10, Volume: 150, Imbalance: -30})
+
+	// Everything matches at 10 by priority then the book switches to continuous trading
+	output, err = ob.ProcessFromStringInstructions("S, IBM, CONTINUOUS")
+	require.CmpNoError(err)
+	assert.Cmp(output, `T, 2, 2, 3, 3, 10, 50
+T, 1, 1, 3, 3, 10, 70
+T, 1, 1, 4, 4, 10, 30
+B, B, -, -
+B, S, 10, 30
+S, IBM, CONTINUOUS`)
+	assert.Cmp(ob.GetTradingState("IBM"), orderbook.ContinuousTradingState)
+}
+
+func TestOrderBook_CallAuctionHalted(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ob := orderbook.NewOrderBook(true)
+	_, err := ob.ProcessFromStringInstructions(`
+S, IBM, AUCTION
+N, 1, IBM, 10, 100, B, 1
+N, 2, IBM, 10, 60, S, 2
+S, IBM, HALTED
+`)
+	require.CmpNoError(err)
+
+	// The book collected during the auction is uncrossed when trading resumes after the halt
+	output, err := ob.ProcessFromStringInstructions("S, IBM, CONTINUOUS")
+	require.CmpNoError(err)
+	assert.Cmp(output, `T, 1, 1, 2, 2, 10, 60
+B, B, 10, 40
+B, S, -, -
+S, IBM, CONTINUOUS`)
+}
+
+func TestOrderBook_CallAuctionReferencePrice(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	auction := `
+S, IBM, AUCTION
+N, 1, IBM, 10, 100, B, 1
+N, 2, IBM, 8, 100, S, 2
+`
+
+	// Without reference price, the lowest price is chosen
+	ob := orderbook.NewOrderBook(true)
+	_, err := ob.ProcessFromStringInstructions(auction)
+	require.CmpNoError(err)
+	assert.Cmp(ob.GetEquilibrium("IBM"), orderbook.Equilibrium{Price: 8, Volume: 100})
+
+	// Else the closest price to the last traded price
+	ob = orderbook.NewOrderBook(true)
+	_, err = ob.ProcessFromStringInstructions(`
+N, 5, IBM, 10, 1, S, 5
+N, 6, IBM, 10, 1, B, 6
+` + auction)
+	require.CmpNoError(err)
+	assert.Cmp(ob.GetEquilibrium("IBM"), orderbook.Equilibrium{Price: 10, Volume: 100})
+
+	// Nothing to execute
+	assert.Cmp(ob.GetEquilibrium("AAPL"), orderbook.Equilibrium{})
+}
+
+func TestOrderBook_CallAuctionAfterHalt(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ob := orderbook.NewOrderBook(true)
+	_, err := ob.ProcessFromStringInstructions(`
+S, IBM, AUCTION
+N, 1, IBM, 10, 100, B, 1
+N, 1, IBM, 9, 50, S, 2
+N, 2, IBM, 10, 60, S, 3
+S, IBM, HALTED
+`)
+	require.CmpNoError(err)
+
+	// The auction is uncrossed when trading resumes, a user never matches his own orders
+	output, err := ob.ProcessFromStringInstructions("S, IBM, CONTINUOUS")
+	require.CmpNoError(err)
+	assert.Cmp(output, `T, 1, 1, 2, 3, 10, 60
+B, B, 10, 40
+S, IBM, CONTINUOUS`)
+	assert.Cmp(ob.Positions.GetPosition(1, "IBM").NetPosition, 60)
+	assert.CmpNoError(ob.CheckInvariants())
+}
+
+func TestOrderBook_CallAuctionSameUser(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ob := orderbook.NewOrderBook(true)
+	_, err := ob.ProcessFromStringInstructions(`
+S, IBM, AUCTION
+N, 1, IBM, 12, 10, B, 1
+N, 1, IBM, 8, 10, S, 2
+N, 2, IBM, 10, 10, S, 1
+`)
+	require.CmpNoError(err)
+	assert.Cmp(ob.GetEquilibrium("IBM"), orderbook.Equilibrium{Price: 8, Volume: 10})
+
+	// Nothing matches at the equilibrium price, the bid is matched at the next one
+	output, err := ob.ProcessFromStringInstructions("S, IBM, CONTINUOUS")
+	require.CmpNoError(err)
+	assert.Cmp(output, `T, 1, 1, 2, 1, 10, 10
+B, B, -, -
+S, IBM, CONTINUOUS`)
+	assert.CmpNoError(ob.CheckInvariants())
+}
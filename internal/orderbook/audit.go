@@ -0,0 +1,275 @@
+package orderbook
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditLog records every instruction received by an order book (see OrderBook.Audit): the raw instruction,
+// its parsed fields, the decisions made while processing it, its outputs and the state of the book before
+// and after it. Invalid instructions are recorded with their error.
+// Records are written to a slog handler with the time of the instruction, so a JSON handler writes one
+// JSON line per instruction. Errors of the handler are ignored, as with a slog.Logger.
+// The record of the instruction being processed is kept by the order book, so an audit log can be shared
+// by the order books of an engine if its handler is goroutine-safe (as the handlers of slog).
+// A nil AuditLog records nothing.
+type AuditLog struct {
+	handler slog.Handler
+}
+
+// auditRecord is the record of the instruction being processed by an order book.
+// A nil record (without audit log) records nothing.
+type auditRecord struct {
+	before    AuditBookState
+	decisions []AuditDecision
+}
+
+// AuditDecision is a decision made by the order book while processing an instruction.
+type AuditDecision struct {
+	Type   string       // ACK, REJECT, QUEUE (during a halt), REST, TRADE, CANCEL, EXPIRE, STATE or INCONSISTENCY
+	Order  *Order       `json:",omitempty"` // The order as it was when the decision was made
+	Reason RejectReason `json:",omitempty"`
+	Trade  *TapeEntry   `json:",omitempty"`
+	Symbol string       `json:",omitempty"` // For a change of trading state
+	State  string       `json:",omitempty"`
+	Error  string       `json:",omitempty"` // For an inconsistency of the order book
+}
+
+// AuditBookState is the state of the book recorded before and after an instruction.
+type AuditBookState struct {
+	BestBid   string // Top of book, as in a 'B' output
+	BestAsk   string
+	BidOrders int
+	AskOrders int
+}
+
+// NewAuditLog creates an audit log which writes its records to the given handler.
+func NewAuditLog(handler slog.Handler) *AuditLog {
+	return &AuditLog{handler: handler}
+}
+
+// NewJSONAuditLog creates an audit log which writes its records as JSON lines to all the given sinks
+// (e.g. os.Stdout and a RotatingFile).
+func NewJSONAuditLog(sinks ...io.Writer) *AuditLog {
+	return NewAuditLog(slog.NewJSONHandler(io.MultiWriter(sinks...), nil))
+}
+
+// begin starts the record of an instruction with the state of the book before it.
+func (al *AuditLog) begin(ob *OrderBook) *auditRecord {
+	if al == nil {
+		return nil
+	}
+
+	return &auditRecord{before: newAuditBookState(ob)}
+}
+
+// order records a decision about an order.
+func (ar *auditRecord) order(decisionType string, order *Order) {
+	if ar == nil {
+		return
+	}
+
+	o := *order
+	ar.decisions = append(ar.decisions, AuditDecision{Type: decisionType, Order: &o})
+}
+
+// reject records the reject of an order.
+func (ar *auditRecord) reject(order *Order, reason RejectReason) {
+	if ar == nil {
+		return
+	}
+
+	o := *order
+	ar.decisions = append(ar.decisions, AuditDecision{Type: "REJECT", Order: &o, Reason: reason})
+}
+
+// trade records a trade.
+func (ar *auditRecord) trade(trade *Trade) {
+	if ar == nil {
+		return
+	}
+
+	entry := newTapeEntry(trade)
+	ar.decisions = append(ar.decisions, AuditDecision{Type: "TRADE", Trade: &entry})
+}
+
+// state records a change of the trading state of a symbol.
+func (ar *auditRecord) state(symbol string, state TradingState) {
+	if ar == nil {
+		return
+	}
+
+	ar.decisions = append(ar.decisions, AuditDecision{Type: "STATE", Symbol: symbol, State: state.String()})
+}
+
+// inconsistency records an inconsistency of the order book found while processing the instruction.
+func (ar *auditRecord) inconsistency(err error) {
+	if ar == nil {
+		return
+	}
+
+	ar.decisions = append(ar.decisions, AuditDecision{Type: "INCONSISTENCY", Error: err.Error()})
+}
+
+// end writes the record of an instruction processed at the given time.
+func (al *AuditLog) end(ob *OrderBook, record *auditRecord, msg, instruction string, parsed slog.Attr, outputs []string) {
+	if al == nil || record == nil {
+		return
+	}
+
+	al.write(ob.now, slog.LevelInfo, msg,
+		slog.String("Instruction", instruction),
+		parsed,
+		slog.Any("Decisions", record.decisions),
+		slog.Any("Outputs", outputs),
+		slog.Any("Before", record.before),
+		slog.Any("After", newAuditBookState(ob)),
+	)
+}
+
+// invalid writes the record of an instruction which was not processed because of an error.
+func (al *AuditLog) invalid(t time.Time, instruction string, err error) {
+	if al == nil {
+		return
+	}
+
+	al.write(t, slog.LevelError, "Instruction not processed",
+		slog.String("Instruction", instruction),
+		slog.String("Error", err.Error()),
+	)
+}
+
+// write writes a record to the handler if it is enabled for the level.
+func (al *AuditLog) write(t time.Time, level slog.Level, msg string, attrs ...slog.Attr) {
+	ctx := context.Background()
+	if !al.handler.Enabled(ctx, level) {
+		return
+	}
+
+	record := slog.NewRecord(t, level, msg, 0)
+	record.AddAttrs(attrs...)
+	al.handler.Handle(ctx, record)
+}
+
+// newAuditBookState returns the current state of the book.
+func newAuditBookState(ob *OrderBook) AuditBookState {
+	return AuditBookState{
+		BestBid:   ob.BidQueue.GetTOBInfo(),
+		BestAsk:   ob.AskQueue.GetTOBInfo(),
+		BidOrders: ob.BidQueue.Len(),
+		AskOrders: ob.AskQueue.Len(),
+	}
+}
+
+// RotatingFile is a goroutine-safe writer to a file which is rotated when it would exceed 'maxSize' bytes:
+// the file is renamed 'path.1' (the previous backups are shifted, 'path.1' becomes 'path.2'...) and only
+// 'maxBackups' backups are kept. A write is never split between two files, so a record of an audit log
+// is always in one file.
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens (or creates) the file at the given path for appending.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("Max size should be positive: %d", maxSize)
+	}
+
+	rf := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+// Write appends the bytes to the file, rotating it first if it would exceed its maximum size.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+// open opens the file at its path.
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rf.file, rf.size = file, info.Size()
+	return nil
+}
+
+// rotate closes the current file, shifts the backups and opens a new file.
+func (rf *RotatingFile) rotate() error {
+	err := rf.file.Close()
+	rf.file = nil
+	if err != nil {
+		return err
+	}
+
+	if rf.maxBackups <= 0 {
+		if err := os.Remove(rf.path); err != nil {
+			return err
+		}
+		return rf.open()
+	}
+
+	// The oldest backup is replaced by the next one
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		return err
+	}
+
+	return rf.open()
+}
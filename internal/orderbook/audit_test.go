@@ -0,0 +1,211 @@
+package orderbook_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestAuditLog(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	var buf bytes.Buffer
+	clock := orderbook.NewFakeClock(time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC))
+	ob := orderbook.NewOrderBook(false)
+	ob.Clock = clock
+	ob.Audit = orderbook.NewJSONAuditLog(&buf)
+
+	for _, instruction := range []string{
+		"N, 1, IBM, 10, 100, B, 1",
+		"N, 2, IBM, 9, 50, S, 2",
+		"N, 1, IBM, 10, 100, S, 1",
+		"X, 1, 2",
+		"C, 1, 1",
+	} {
+		_, _ = ob.ProcessInstruction(instruction) // The unknown instruction fails
+		clock.Advance(time.Second)
+	}
+
+	var records []map[string]interface{}
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var record map[string]interface{}
+		require.CmpNoError(decoder.Decode(&record))
+		records = append(records, record)
+	}
+	require.Len(records, 5)
+
+	assert.Cmp(records[0], td.SuperMapOf(map[string]interface{}{
+		"time":        "2022-01-01T09:00:00Z",
+		"level":       "INFO",
+		"msg":         "Instruction processed",
+		"Instruction": "N,1,IBM,10,100,B,1",
+		"Order":       td.SuperMapOf(map[string]interface{}{"User": 1.0, "Price": 10.0, "Quantity": 100.0}, nil),
+		"Decisions": []interface{}{
+			td.SuperMapOf(map[string]interface{}{"Type": "ACK"}, nil),
+			td.SuperMapOf(map[string]interface{}{"Type": "REST"}, nil),
+		},
+		"Outputs": []interface{}{"A, 1, 1", "B, B, 10, 100"},
+		"Before":  map[string]interface{}{"BestBid": "B, -, -", "BestAsk": "S, -, -", "BidOrders": 0.0, "AskOrders": 0.0},
+		"After":   map[string]interface{}{"BestBid": "B, 10, 100", "BestAsk": "S, -, -", "BidOrders": 1.0, "AskOrders": 0.0},
+	}, nil))
+
+	// The order crosses the book which can't trade
+	assert.Cmp(records[1], td.SuperMapOf(map[string]interface{}{
+		"Decisions": []interface{}{
+			td.SuperMapOf(map[string]interface{}{"Type": "REJECT", "Reason": "CROSSES_BOOK"}, nil),
+		},
+		"Outputs": []interface{}{"R, 2, 2"},
+	}, nil))
+
+	// A modify can't change the side of an order
+	assert.Cmp(records[2], td.SuperMapOf(map[string]interface{}{
+		"Decisions": []interface{}{
+			td.SuperMapOf(map[string]interface{}{"Type": "REJECT", "Reason": "MODIFY_MISMATCH"}, nil),
+		},
+	}, nil))
+
+	assert.Cmp(records[3], map[string]interface{}{
+		"time":        "2022-01-01T09:00:03Z",
+		"level":       "ERROR",
+		"msg":         "Instruction not processed",
+		"Instruction": "X,1,2",
+		"Error":       `Unknown transaction type: "X"`,
+	})
+
+	assert.Cmp(records[4], td.SuperMapOf(map[string]interface{}{
+		"Cancel": map[string]interface{}{"User": 1.0, "UserOrderId": 1.0},
+		"Decisions": []interface{}{
+			td.SuperMapOf(map[string]interface{}{"Type": "CANCEL"}, nil),
+		},
+		"After": td.SuperMapOf(map[string]interface{}{"BidOrders": 0.0}, nil),
+	}, nil))
+
+	status, ok := ob.Orders.GetOrderStatus(2, 2)
+	require.True(ok)
+	assert.Cmp(status.RejectReason, orderbook.CrossesBookRejectReason)
+}
+
+func TestAuditLog_SharedByBooks(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	var buf bytes.Buffer
+	audit := orderbook.NewJSONAuditLog(&buf)
+
+	// The order books record their instructions at the same time
+	var wg sync.WaitGroup
+	for _, symbol := range []string{"IBM", "AAPL", "MSFT"} {
+		ob := orderbook.NewOrderBook(true)
+		ob.Audit = audit
+
+		wg.Add(1)
+		go func(symbol string) {
+			defer wg.Done()
+			for i := 1; i <= 50; i++ {
+				_, err := ob.ProcessInstruction(fmt.Sprintf("N, 1, %s, 10, 1, B, %d", symbol, i))
+				assert.CmpNoError(err)
+			}
+		}(symbol)
+	}
+	wg.Wait()
+
+	// Each record has the decisions of its instruction only
+	decoder := json.NewDecoder(&buf)
+	count := 0
+	for ; decoder.More(); count++ {
+		var record struct {
+			Order     orderbook.Order
+			Decisions []orderbook.AuditDecision
+		}
+		require.CmpNoError(decoder.Decode(&record))
+
+		var decisions []string
+		for _, decision := range record.Decisions {
+			decisions = append(decisions, fmt.Sprintf("%s %s %d", decision.Type, decision.Order.Symbol, decision.Order.UserOrderId))
+		}
+		order := fmt.Sprintf("%s %d", record.Order.Symbol, record.Order.UserOrderId)
+		assert.Cmp(decisions, []string{"ACK " + order, "REST " + order})
+	}
+	assert.Cmp(count, 150)
+}
+
+func TestOrderBook_RejectReasons(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ob := orderbook.NewOrderBook(true)
+	ob.MaxPosition = 100
+	_, err := ob.ProcessFromStringInstructions(`
+N, 1, IBM, 10, 200, B, 1
+S, AAPL, CLOSED
+N, 1, AAPL, 10, 10, B, 2
+S, MSFT, HALTED
+N, 1, MSFT, 10, 10, B, 3
+`)
+	require.CmpNoError(err)
+
+	for id, reason := range map[int]orderbook.RejectReason{
+		1: orderbook.PositionLimitRejectReason,
+		2: orderbook.SymbolClosedRejectReason,
+		3: orderbook.SymbolHaltedRejectReason,
+	} {
+		status, ok := ob.Orders.GetOrderStatus(1, id)
+		require.True(ok)
+		assert.Cmp(status.State, orderbook.RejectedOrderState)
+		assert.Cmp(status.RejectReason, reason, "order %d", id)
+	}
+
+	reason, err := orderbook.ParseRejectReason("volatility_halt")
+	require.CmpNoError(err)
+	assert.Cmp(reason, orderbook.VolatilityHaltRejectReason)
+
+	_, err = orderbook.ParseRejectReason("UNKNOWN")
+	assert.CmpError(err)
+}
+
+func TestRotatingFile(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	rf, err := orderbook.OpenRotatingFile(path, 10, 2)
+	require.CmpNoError(err)
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := rf.Write([]byte(line))
+		require.CmpNoError(err)
+	}
+	require.CmpNoError(rf.Close())
+
+	read := func(path string) string {
+		content, err := os.ReadFile(path)
+		require.CmpNoError(err)
+		return string(content)
+	}
+
+	// The first line was in the oldest backup, which was dropped
+	assert.Cmp(read(path), "fourth\n")
+	assert.Cmp(read(path+".1"), "third\n")
+	assert.Cmp(read(path+".2"), "second\n")
+	_, err = os.Stat(path + ".3")
+	assert.True(os.IsNotExist(err))
+
+	// Reopening appends to the current file
+	rf, err = orderbook.OpenRotatingFile(path, 100, 2)
+	require.CmpNoError(err)
+	_, err = rf.Write([]byte("fifth\n"))
+	require.CmpNoError(err)
+	require.CmpNoError(rf.Close())
+	assert.Cmp(strings.Split(read(path), "\n"), []string{"fourth", "fifth", ""})
+
+	_, err = orderbook.OpenRotatingFile(path, 0, 2)
+	assert.CmpError(err)
+}
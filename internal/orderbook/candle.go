@@ -0,0 +1,143 @@
+package orderbook
+
+import (
+	"sort"
+	"time"
+)
+
+// TradeListener is notified of each trade processed by an order book (see OrderBook.TradeListeners).
+// The orders of the trade are still used by the order book, so a listener must not keep them.
+// Trades are notified again when a journal is replayed, so listeners can rebuild their state.
+type TradeListener interface {
+	OnTrade(trade *Trade)
+}
+
+// OHLCV is the summary of a series of trades: open, high, low and close prices, volume and VWAP.
+type OHLCV struct {
+	Open       int
+	High       int
+	Low        int
+	Close      int
+	Volume     int
+	Turnover   int     // Sum of price * quantity
+	VWAP       float64 // Volume weighted average price
+	TradeCount int
+}
+
+// add adds a trade to the summary.
+func (o *OHLCV) add(trade *Trade) {
+	if o.TradeCount == 0 {
+		o.Open, o.High, o.Low = trade.Price, trade.Price, trade.Price
+	}
+	if trade.Price > o.High {
+		o.High = trade.Price
+	}
+	if trade.Price < o.Low {
+		o.Low = trade.Price
+	}
+
+	o.Close = trade.Price
+	o.Volume += trade.Quantity
+	o.Turnover += trade.Price * trade.Quantity
+	o.VWAP = float64(o.Turnover) / float64(o.Volume)
+	o.TradeCount++
+}
+
+// Candle is an OHLCV bar: the trades of a symbol during an interval [Start, Start+Interval).
+type Candle struct {
+	Symbol   string
+	Start    time.Time
+	Interval time.Duration
+	OHLCV
+}
+
+// CandleAggregator builds the candles of each symbol from trades, for a given interval (1s, 1m, 1h...).
+// Intervals are aligned on the zero time (so on the minute, the hour...) and an interval without
+// trades has no candle.
+// A candle is closed when a trade of the symbol falls in a later interval or when Tick is called after
+// its end. Closed candles are passed to 'OnClose' (if any) and kept in the history of the symbol
+// (at most 'MaxHistory' per symbol, 0 means no limit).
+type CandleAggregator struct {
+	Interval   time.Duration
+	MaxHistory int
+	OnClose    func(candle Candle)
+
+	current map[string]*Candle
+	history map[string][]Candle
+}
+
+// NewCandleAggregator creates an aggregator of candles of the given interval.
+func NewCandleAggregator(interval time.Duration, maxHistory int) *CandleAggregator {
+	return &CandleAggregator{
+		Interval:   interval,
+		MaxHistory: maxHistory,
+		current:    map[string]*Candle{},
+		history:    map[string][]Candle{},
+	}
+}
+
+// OnTrade adds a trade to the candle of its symbol, closing the previous candle if the trade
+// is in a later interval. It implements the TradeListener interface.
+func (ca *CandleAggregator) OnTrade(trade *Trade) {
+	symbol := trade.Symbol()
+	start := trade.Time.Truncate(ca.Interval)
+
+	candle, ok := ca.current[symbol]
+	if ok && candle.Start.Before(start) {
+		ca.close(candle)
+		ok = false
+	}
+
+	if !ok {
+		candle = &Candle{Symbol: symbol, Start: start, Interval: ca.Interval}
+		ca.current[symbol] = candle
+	}
+
+	candle.add(trade)
+}
+
+// Tick closes the candles whose interval ended at the given time (sorted by symbol).
+func (ca *CandleAggregator) Tick(now time.Time) {
+	var symbols []string
+	for symbol, candle := range ca.current {
+		if !now.Before(candle.Start.Add(ca.Interval)) {
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	// Sort symbols to close candles in a deterministic order
+	sort.Strings(symbols)
+
+	for _, symbol := range symbols {
+		ca.close(ca.current[symbol])
+	}
+}
+
+// Current returns the candle of the symbol which is not closed yet (false if there is none).
+func (ca *CandleAggregator) Current(symbol string) (Candle, bool) {
+	if candle, ok := ca.current[symbol]; ok {
+		return *candle, true
+	}
+
+	return Candle{}, false
+}
+
+// History returns a copy of the closed candles of the symbol, the oldest first.
+func (ca *CandleAggregator) History(symbol string) []Candle {
+	return append([]Candle(nil), ca.history[symbol]...)
+}
+
+// close closes the current candle of its symbol.
+func (ca *CandleAggregator) close(candle *Candle) {
+	delete(ca.current, candle.Symbol)
+
+	history := append(ca.history[candle.Symbol], *candle)
+	if ca.MaxHistory > 0 && len(history) > ca.MaxHistory {
+		history = history[len(history)-ca.MaxHistory:]
+	}
+	ca.history[candle.Symbol] = history
+
+	if ca.OnClose != nil {
+		ca.OnClose(*candle)
+	}
+}
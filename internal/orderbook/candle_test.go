@@ -0,0 +1,95 @@
+package orderbook_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestCandleAggregator(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	start := time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock := orderbook.NewFakeClock(start)
+
+	var closed []orderbook.Candle
+	candles := orderbook.NewCandleAggregator(time.Minute, 2)
+	candles.OnClose = func(c orderbook.Candle) { closed = append(closed, c) }
+
+	ob := orderbook.NewOrderBook(true)
+	ob.Clock = clock
+	ob.TradeListeners = append(ob.TradeListeners, candles)
+
+	// Each step sells to a resting buy order at the given price
+	trade := func(after time.Duration, price, quantity int) {
+		clock.Set(start.Add(after))
+		_, err := ob.ProcessInstruction(fmt.Sprintf("N, 1, IBM, %d, %d, B, %d", price, quantity, price))
+		require.CmpNoError(err)
+		_, err = ob.ProcessInstruction(fmt.Sprintf("N, 2, IBM, %d, %d, S, %d", price, quantity, price))
+		require.CmpNoError(err)
+	}
+
+	trade(10*time.Second, 100, 10)
+	trade(20*time.Second, 104, 5)
+	trade(30*time.Second, 98, 20)
+	trade(59*time.Second, 101, 15)
+
+	// The first minute is still open
+	assert.Len(closed, 0)
+	current, ok := candles.Current("IBM")
+	require.True(ok)
+	assert.Cmp(current.Close, 101)
+
+	// A trade in the next minute closes it
+	trade(65*time.Second, 102, 10)
+	first := orderbook.Candle{
+		Symbol:   "IBM",
+		Start:    start,
+		Interval: time.Minute,
+		OHLCV: orderbook.OHLCV{
+			Open:       100,
+			High:       104,
+			Low:        98,
+			Close:      101,
+			Volume:     50,
+			Turnover:   100*10 + 104*5 + 98*20 + 101*15,
+			VWAP:       4995.0 / 50,
+			TradeCount: 4,
+		},
+	}
+	assert.Cmp(closed, []orderbook.Candle{first})
+
+	// The clock closes the second minute, even without trades. The third minute has no candle.
+	candles.Tick(start.Add(119 * time.Second))
+	assert.Len(closed, 1)
+	candles.Tick(start.Add(3 * time.Minute))
+	second := orderbook.Candle{
+		Symbol:   "IBM",
+		Start:    start.Add(time.Minute),
+		Interval: time.Minute,
+		OHLCV: orderbook.OHLCV{
+			Open:       102,
+			High:       102,
+			Low:        102,
+			Close:      102,
+			Volume:     10,
+			Turnover:   1020,
+			VWAP:       102,
+			TradeCount: 1,
+		},
+	}
+	assert.Cmp(closed, []orderbook.Candle{first, second})
+	_, ok = candles.Current("IBM")
+	assert.False(ok)
+
+	// Only the 2 last candles are kept
+	trade(4*time.Minute, 99, 1)
+	candles.Tick(start.Add(5 * time.Minute))
+	assert.Cmp(candles.History("IBM"), []orderbook.Candle{second, closed[2]})
+	assert.Cmp(closed[2].Start, start.Add(4*time.Minute))
+	assert.Len(candles.History("AAPL"), 0)
+}
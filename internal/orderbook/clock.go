@@ -0,0 +1,34 @@
+package orderbook
+
+import "time"
+
+// Clock gives the current time to the order book.
+// It is injectable so that time-dependent features can be tested without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the clock used in production, it returns the wall-clock time.
+type SystemClock struct{}
+
+// Now returns the current local time.
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// FakeClock is a controllable clock for tests.
+type FakeClock struct {
+	now time.Time
+}
+
+// NewFakeClock creates a fake clock starting at the given time.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now returns the current time of the fake clock.
+func (fc *FakeClock) Now() time.Time { return fc.now }
+
+// Advance moves the fake clock forward.
+func (fc *FakeClock) Advance(d time.Duration) { fc.now = fc.now.Add(d) }
+
+// Set sets the current time of the fake clock.
+func (fc *FakeClock) Set(t time.Time) { fc.now = t }
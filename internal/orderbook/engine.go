@@ -0,0 +1,316 @@
+package orderbook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrEngineStopped is returned when an instruction is submitted to a stopped engine.
+var ErrEngineStopped = errors.New("Engine is stopped")
+
+// EngineOutput is an output of the engine with its position in the merged stream.
+// The book sequence, the time and the trade ID are the ones of the order book of the symbol (see SequencedOutput),
+// they are persisted with the journal of the order book while the position in the merged stream
+// starts again at 1 when the engine is restarted.
+type EngineOutput struct {
+	Sequence     uint64
+	BookSequence uint64
+	Time         time.Time
+	TradeID      int
+	Symbol       string
+	Output       string
+	Err          error // Error of the order book when processing an instruction (Output is empty)
+}
+
+// Engine processes instructions for many symbols, with one order book per symbol.
+// Symbols are sharded across goroutines, each shard owning its order books exclusively,
+// and instructions are fed to shards through bounded channels.
+// Outputs of all shards are merged into a single sequenced stream (see Outputs).
+// As a symbol is always processed by the same shard, outputs are deterministic per symbol.
+type Engine struct {
+	shards  []*shard
+	merged  chan shardOutput
+	outputs chan EngineOutput
+
+	mu       sync.RWMutex // Held for reading while sending to the shards, for writing to close their inputs
+	stopping chan struct{}
+	closed   bool
+}
+
+// shard owns the order books of some symbols.
+type shard struct {
+	input   chan routedInstruction
+	books   map[string]*OrderBook
+	newBook func(symbol string) *OrderBook
+}
+
+// routedInstruction is an instruction with the symbol of the order book which processes it.
+// The symbol is empty for instructions processed by every order book (Flush, Mass cancel without symbol)
+// and for cancels, which are processed by the order books where the order is live.
+type routedInstruction struct {
+	symbol      string
+	instruction string
+	identifier  string // Order to cancel
+}
+
+// shardOutput is the outputs of an instruction processed by a shard.
+type shardOutput struct {
+	symbol string
+	output []SequencedOutput
+	err    error
+}
+
+// NewEngine creates an engine with the given number of shards.
+// 'bufferSize' is the capacity of the instruction channel of each shard and of the output channel.
+// 'newBook' creates the order book of a symbol the first time it is used.
+func NewEngine(shardCount, bufferSize int, newBook func(symbol string) *OrderBook) *Engine {
+	e := &Engine{
+		merged:   make(chan shardOutput, bufferSize),
+		outputs:  make(chan EngineOutput, bufferSize),
+		stopping: make(chan struct{}),
+	}
+
+	for i := 0; i < shardCount; i++ {
+		e.shards = append(e.shards, &shard{
+			input:   make(chan routedInstruction, bufferSize),
+			books:   map[string]*OrderBook{},
+			newBook: newBook,
+		})
+	}
+
+	return e
+}
+
+// Outputs returns the merged stream of outputs. It must be consumed until it is closed
+// (after the engine is stopped and all the submitted instructions are processed).
+func (e *Engine) Outputs() <-chan EngineOutput {
+	return e.outputs
+}
+
+// Run runs the shards until the context is cancelled.
+// Then it stops accepting instructions, processes the instructions already submitted,
+// and closes the output stream before returning.
+func (e *Engine) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, s := range e.shards {
+		wg.Add(1)
+		go func(s *shard) {
+			defer wg.Done()
+			s.run(e.merged)
+		}(s)
+	}
+
+	mergeDone := make(chan struct{})
+	go func() {
+		defer close(mergeDone)
+		e.merge()
+	}()
+
+	<-ctx.Done()
+
+	// Unblock the submitters, then close the inputs once nobody can send anymore
+	close(e.stopping)
+	e.mu.Lock()
+	e.closed = true
+	for _, s := range e.shards {
+		close(s.input)
+	}
+	e.mu.Unlock()
+
+	wg.Wait()
+	close(e.merged)
+	<-mergeDone
+}
+
+// Submit routes an instruction to the shard of its symbol.
+// It blocks while the shard channel is full, until the context is done or the engine is stopped
+// (an instruction sent to all the shards is delivered to all of them once sent to the first one, see broadcast).
+// Producers don't wait for each other, only for their shard.
+// A cancel has no symbol, so it is sent to all the shards and processed by the order books where the order
+// is live (resting or queued): the engine keeps no state per order. A cancel of an unknown order does nothing
+// (as for an order book). As identifiers are only unique within an order book, an identifier used for several
+// symbols is cancelled in all of them.
+// A mass cancel is processed by the order book of its symbol, or by all the order books if it has no symbol,
+// as a flush.
+// A deposit or a withdrawal has no symbol either: it is processed (and journaled) once, by the order book named
+// after its asset, so the order books should share their account service (see OrderBook.Accounts). As any instruction,
+// it is only ordered with the instructions of the same shard.
+func (e *Engine) Submit(ctx context.Context, instruction string) error {
+	instruction = strings.Replace(instruction, " ", "", -1)
+	if instruction == "" {
+		return nil
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return ErrEngineStopped
+	}
+
+	switch instruction[0] {
+	case 'N':
+		order, err := NewOrderFromInstruction(instruction)
+		if err != nil {
+			return err
+		}
+
+		return e.send(ctx, e.shardOf(order.Symbol), routedInstruction{symbol: order.Symbol, instruction: instruction})
+
+	case 'C':
+		cancelOrder, err := NewCancelOrderFromInstruction(instruction)
+		if err != nil {
+			return err
+		}
+
+		return e.broadcast(ctx, routedInstruction{instruction: instruction, identifier: cancelOrder.GetIdentifier()})
+
+	case 'M':
+		massCancel, err := NewMassCancelFromInstruction(instruction)
+		if err != nil {
+			return err
+		}
+
+		if massCancel.Symbol != "" {
+			return e.send(ctx, e.shardOf(massCancel.Symbol), routedInstruction{symbol: massCancel.Symbol, instruction: instruction})
+		}
+		return e.broadcast(ctx, routedInstruction{instruction: instruction})
+
+	case 'S':
+		stateChange, err := NewStateChangeFromInstruction(instruction)
+		if err != nil {
+			return err
+		}
+
+		return e.send(ctx, e.shardOf(stateChange.Symbol), routedInstruction{symbol: stateChange.Symbol, instruction: instruction})
+
+	case 'D', 'W':
+		transfer, err := NewTransferFromInstruction(instruction)
+		if err != nil {
+			return err
+		}
+
+		return e.send(ctx, e.shardOf(transfer.Asset), routedInstruction{symbol: transfer.Asset, instruction: instruction})
+
+	case 'F':
+		return e.broadcast(ctx, routedInstruction{instruction: instruction})
+
+	default:
+		return fmt.Errorf("Unknown transaction type: %q", string(instruction[0]))
+	}
+}
+
+// send sends the instruction to the shard, unless the context is done or the engine is stopping.
+func (e *Engine) send(ctx context.Context, s *shard, ri routedInstruction) error {
+	select {
+	case s.input <- ri:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-e.stopping:
+		return ErrEngineStopped
+	}
+}
+
+// broadcast sends the instruction to all the shards, to be processed by all their order books.
+// The context and the engine are only checked before sending to the first shard: then the instruction is sent to
+// every shard, so that a cancel or a flush is never processed by only some of the order books. It may block until
+// the engine runs, and the shards of a stopping engine process their inputs until they are closed.
+func (e *Engine) broadcast(ctx context.Context, ri routedInstruction) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	select {
+	case <-e.stopping:
+		return ErrEngineStopped
+	default:
+	}
+
+	for _, s := range e.shards {
+		s.input <- ri
+	}
+
+	return nil
+}
+
+// shardOf returns the shard of the symbol.
+func (e *Engine) shardOf(symbol string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(symbol))
+	return e.shards[h.Sum32()%uint32(len(e.shards))]
+}
+
+// merge sequences the outputs of the shards into the output stream.
+func (e *Engine) merge() {
+	defer close(e.outputs)
+
+	var sequence uint64
+	for so := range e.merged {
+		if so.err != nil {
+			sequence++
+			e.outputs <- EngineOutput{Sequence: sequence, Symbol: so.symbol, Err: so.err}
+			continue
+		}
+
+		for _, output := range so.output {
+			sequence++
+			e.outputs <- EngineOutput{
+				Sequence:     sequence,
+				BookSequence: output.Sequence,
+				Time:         output.Time,
+				TradeID:      output.TradeID,
+				Symbol:       so.symbol,
+				Output:       output.Output,
+			}
+		}
+	}
+}
+
+// run processes the instructions of the shard until its input is closed.
+func (s *shard) run(merged chan<- shardOutput) {
+	for ri := range s.input {
+		if ri.symbol == "" {
+			s.processAll(ri, merged)
+			continue
+		}
+
+		book, ok := s.books[ri.symbol]
+		if !ok {
+			book = s.newBook(ri.symbol)
+			s.books[ri.symbol] = book
+		}
+
+		output, err := book.ProcessSequencedInstruction(ri.instruction)
+		if err != nil || len(output) > 0 {
+			merged <- shardOutput{symbol: ri.symbol, output: output, err: err}
+		}
+	}
+}
+
+// processAll processes the instruction by all the order books of the shard (by symbol order).
+// A cancel is processed only by the order books where the order is live.
+func (s *shard) processAll(ri routedInstruction, merged chan<- shardOutput) {
+	symbols := make([]string, 0, len(s.books))
+	for symbol := range s.books {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	for _, symbol := range symbols {
+		if ri.identifier != "" && !s.books[symbol].isLive(ri.identifier) {
+			continue
+		}
+
+		output, err := s.books[symbol].ProcessSequencedInstruction(ri.instruction)
+		if err != nil || len(output) > 0 {
+			merged <- shardOutput{symbol: symbol, output: output, err: err}
+		}
+	}
+}
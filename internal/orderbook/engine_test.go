@@ -0,0 +1,246 @@
+package orderbook_test
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"testing"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestEngine(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	engine := orderbook.NewEngine(4, 2, func(string) *orderbook.OrderBook {
+		return orderbook.NewOrderBook(true)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		engine.Run(ctx)
+	}()
+
+	// Interleave the instructions of several symbols
+	symbols := []string{"IBM", "AAPL", "VAL", "MSFT", "TSLA"}
+	perSymbol := map[string][]string{}
+	go func() {
+		for i := 0; i < 20; i++ {
+			for j, symbol := range symbols {
+				instructions := []string{
+					fmt.Sprintf("N, %d, %s, %d, 10, B, %d", j, symbol, 10+i%3, i),
+					fmt.Sprintf("N, %d, %s, %d, 5, S, %d", j+10, symbol, 11-i%2, i),
+				}
+				if i%4 == 3 {
+					instructions = append(instructions, fmt.Sprintf("C, %d, %d", j, i-1))
+				}
+
+				for _, instruction := range instructions {
+					perSymbol[symbol] = append(perSymbol[symbol], instruction)
+					assert.CmpNoError(engine.Submit(ctx, instruction))
+				}
+			}
+		}
+		cancel()
+	}()
+
+	var outputs []orderbook.EngineOutput
+	for output := range engine.Outputs() {
+		outputs = append(outputs, output)
+	}
+	<-runDone
+
+	// Sequence numbers are contiguous, in the merged stream and per order book
+	bookSequences := map[string]uint64{}
+	for i, output := range outputs {
+		require.CmpNoError(output.Err)
+		require.Cmp(output.Sequence, uint64(i+1))
+
+		bookSequences[output.Symbol]++
+		require.Cmp(output.BookSequence, bookSequences[output.Symbol])
+		require.Cmp(output.TradeID != 0, strings.HasPrefix(output.Output, "T"))
+	}
+
+	// For each symbol, the outputs are the same than with a single order book
+	for _, symbol := range symbols {
+		var got []string
+		for _, output := range outputs {
+			if output.Symbol == symbol {
+				got = append(got, output.Output)
+			}
+		}
+
+		expected, err := orderbook.NewOrderBook(true).ProcessFromStringInstructions(strings.Join(perSymbol[symbol], "\n"))
+		require.CmpNoError(err)
+		assert.Cmp(strings.Join(got, "\n"), expected, symbol)
+	}
+
+	// The engine is stopped
+	assert.Cmp(engine.Submit(context.Background(), "N, 1, IBM, 10, 10, B, 1"), orderbook.ErrEngineStopped)
+}
+
+func TestEngine_Submit(t *testing.T) {
+	assert := td.Assert(t)
+
+	engine := orderbook.NewEngine(1, 1, func(string) *orderbook.OrderBook {
+		return orderbook.NewOrderBook(true)
+	})
+
+	assert.CmpError(engine.Submit(context.Background(), "N, 1"))
+	assert.CmpError(engine.Submit(context.Background(), "X, 1"))
+
+	// The shard channel is full and the engine is not running
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.CmpNoError(engine.Submit(ctx, "N, 1, IBM, 10, 10, B, 1"))
+	cancel()
+	assert.Cmp(engine.Submit(ctx, "N, 1, IBM, 10, 10, B, 2"), context.Canceled)
+}
+
+func TestEngine_Cancel(t *testing.T) {
+	assert := td.Assert(t)
+
+	engine := orderbook.NewEngine(2, 2, func(string) *orderbook.OrderBook {
+		return orderbook.NewOrderBook(true)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		engine.Run(ctx)
+	}()
+
+	for _, instruction := range []string{
+		"N, 1, IBM, 10, 100, B, 1",
+		"N, 1, AAPL, 10, 100, B, 1", // Same identifier on another symbol
+		"N, 1, VAL, 10, 100, B, 2",
+		"N, 2, VAL, 10, 100, S, 3",
+		"C, 1, 1", // Cancelled in both order books
+		"C, 1, 2", // Filled: nothing to cancel
+		"C, 1, 4", // Unknown order
+	} {
+		assert.CmpNoError(engine.Submit(ctx, instruction))
+	}
+	cancel()
+
+	got := map[string][]string{}
+	for output := range engine.Outputs() {
+		assert.CmpNoError(output.Err)
+		got[output.Symbol] = append(got[output.Symbol], output.Output)
+	}
+	<-runDone
+
+	assert.Cmp(got, map[string][]string{
+		"IBM":  {"A, 1, 1", "B, B, 10, 100", "A, 1, 1", "B, B, -, -"},
+		"AAPL": {"A, 1, 1", "B, B, 10, 100", "A, 1, 1", "B, B, -, -"},
+		"VAL":  {"A, 1, 2", "B, B, 10, 100", "A, 2, 3", "T, 1, 2, 2, 3, 10, 100", "B, B, -, -"},
+	})
+}
+
+// doneContext is a context which is done, but only after its error was checked.
+type doneContext struct {
+	context.Context
+}
+
+func (doneContext) Err() error {
+	return nil
+}
+
+func TestEngine_Broadcast(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	engine := orderbook.NewEngine(2, 1, func(string) *orderbook.OrderBook {
+		return orderbook.NewOrderBook(true)
+	})
+
+	// A symbol of the second shard, whose channel is full
+	symbol := ""
+	for i := 0; symbol == ""; i++ {
+		h := fnv.New32a()
+		h.Write([]byte(fmt.Sprint("S", i)))
+		if h.Sum32()%2 == 1 {
+			symbol = fmt.Sprint("S", i)
+		}
+	}
+	require.CmpNoError(engine.Submit(context.Background(), fmt.Sprintf("N, 1, %s, 10, 100, B, 1", symbol)))
+
+	// A cancel already sent to the first shard is sent to the second one, even if the context is done meanwhile
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Cmp(engine.Submit(cancelled, "C, 1, 1"), context.Canceled)
+	submitted := make(chan error, 1)
+	go func() {
+		submitted <- engine.Submit(doneContext{cancelled}, "C, 1, 1")
+	}()
+
+	ctx, stop := context.WithCancel(context.Background())
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		engine.Run(ctx)
+	}()
+	assert.CmpNoError(<-submitted)
+	stop()
+
+	var got []string
+	for output := range engine.Outputs() {
+		assert.CmpNoError(output.Err)
+		got = append(got, output.Output)
+	}
+	<-runDone
+
+	assert.Cmp(got, []string{"A, 1, 1", "B, B, 10, 100", "A, 1, 1", "B, B, -, -"})
+}
+
+func TestEngine_Transfer(t *testing.T) {
+	assert := td.Assert(t)
+
+	accounts := orderbook.NewAccountService()
+	engine := orderbook.NewEngine(1, 2, func(string) *orderbook.OrderBook {
+		ob := orderbook.NewOrderBook(true)
+		ob.Accounts = accounts
+		return ob
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		engine.Run(ctx)
+	}()
+
+	for _, instruction := range []string{
+		"D, 1, USD, 1000",
+		"N, 1, IBM, 10, 100, B, 1",
+		"W, 1, USD, 1", // Reserved by the order
+		"C, 1, 1",
+		"W, 1, USD, 400",
+	} {
+		assert.CmpNoError(engine.Submit(ctx, instruction))
+	}
+	assert.CmpError(engine.Submit(ctx, "W, 1, USD, 0"))
+	cancel()
+
+	got := map[string][]string{}
+	var errs []string
+	for output := range engine.Outputs() {
+		if output.Err != nil {
+			errs = append(errs, output.Symbol)
+			continue
+		}
+		got[output.Symbol] = append(got[output.Symbol], output.Output)
+	}
+	<-runDone
+
+	// Transfers are processed by the order book of their asset, they have no output
+	assert.Cmp(got, map[string][]string{
+		"IBM": {"A, 1, 1", "B, B, 10, 100", "A, 1, 1", "B, B, -, -"},
+	})
+	assert.Cmp(errs, []string{"USD"})
+	assert.Cmp(accounts.GetBalance(1, "USD"), orderbook.Balance{User: 1, Asset: "USD", Total: 600})
+}
@@ -0,0 +1,283 @@
+package orderbook
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultFeeWindow is the default rolling window of the volume which gives the fee tier of a user.
+const DefaultFeeWindow = 30 * 24 * time.Hour
+
+// FeeTier is a tier of a fee schedule: the rates applied to a user whose rolling volume
+// (notional traded during the window of the fee engine) is at least 'MinVolume'.
+// Rates are in basis points of the notional of a trade, a negative rate is a rebate.
+// The fee of a fill is rounded once to the nearest minor unit of the quote asset (half away from zero).
+type FeeTier struct {
+	MinVolume int
+	MakerBps  float64
+	TakerBps  float64
+}
+
+// FeeSchedule is a list of fee tiers.
+type FeeSchedule []FeeTier
+
+// Tier returns the tier with the highest minimum volume reached by the given volume
+// (a tier without fees if the volume is below all the tiers).
+func (fs FeeSchedule) Tier(volume int) FeeTier {
+	var tier FeeTier
+	found := false
+	for _, t := range fs {
+		if volume >= t.MinVolume && (!found || t.MinVolume > tier.MinVolume) {
+			tier, found = t, true
+		}
+	}
+
+	return tier
+}
+
+// UserFees is the fees of a user accumulated since the last reset of the report, in minor units of the quote asset.
+type UserFees struct {
+	User      int
+	MakerFees int // Negative if the user received more rebates than it paid fees
+	TakerFees int
+	Notional  int // Notional traded
+}
+
+// Total returns the sum of the maker and taker fees.
+func (uf UserFees) Total() int {
+	return uf.MakerFees + uf.TakerFees
+}
+
+// FeeEngine computes the fees of each side of the trades of an order book (see OrderBook.Fees).
+// The schedule of a trade is the most specific one set for the user and the symbol (see SetSchedule)
+// and its tier is given by the rolling volume of the user during the 'Window' before the trade
+// (by day, today included).
+// Fees are accumulated by user for the end of day report (see Report and ResetReport).
+// The rolling volumes and the fees of the report are part of the snapshot of the order book, and the trades
+// of a replayed journal add to them again, so the tiers are the same after a recovery.
+// It is goroutine-safe, so it can be shared by the order books of an engine.
+type FeeEngine struct {
+	Window time.Duration
+
+	mu        sync.Mutex
+	schedules map[feeKey]FeeSchedule
+	volumes   map[int][]dailyVolume // The oldest first
+	fees      map[int]*UserFees
+}
+
+// feeKey identifies a schedule, the user can be AllUsers and the symbol can be empty.
+type feeKey struct {
+	user   int
+	symbol string
+}
+
+// dailyVolume is the notional traded by a user during a day.
+type dailyVolume struct {
+	day      time.Time
+	notional int
+}
+
+// NewFeeEngine creates a fee engine without schedules (so without fees) and with the default window.
+func NewFeeEngine() *FeeEngine {
+	return &FeeEngine{
+		Window:    DefaultFeeWindow,
+		schedules: map[feeKey]FeeSchedule{},
+		volumes:   map[int][]dailyVolume{},
+		fees:      map[int]*UserFees{},
+	}
+}
+
+// SetSchedule sets the schedule of a user for a symbol. The user can be AllUsers and the symbol can be empty
+// to set the schedule of every user or every symbol: for a trade, the schedule of the user and the symbol is
+// used first, then the one of the user, then the one of the symbol and finally the one for all.
+func (fe *FeeEngine) SetSchedule(user int, symbol string, schedule FeeSchedule) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	fe.schedules[feeKey{user: user, symbol: symbol}] = append(FeeSchedule(nil), schedule...)
+}
+
+// Schedule returns the schedule applied to the trades of a user on a symbol (nil if none).
+func (fe *FeeEngine) Schedule(user int, symbol string) FeeSchedule {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	return fe.schedule(user, symbol)
+}
+
+// schedule returns the schedule applied to the trades of a user on a symbol, the lock must be held.
+func (fe *FeeEngine) schedule(user int, symbol string) FeeSchedule {
+	for _, key := range []feeKey{{user, symbol}, {user, ""}, {AllUsers, symbol}, {AllUsers, ""}} {
+		if schedule, ok := fe.schedules[key]; ok {
+			return schedule
+		}
+	}
+
+	return nil
+}
+
+// RollingVolume returns the notional traded by a user during the window before the given time.
+func (fe *FeeEngine) RollingVolume(user int, now time.Time) int {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	return fe.rollingVolume(user, now)
+}
+
+// rollingVolume returns the rolling volume of a user, the lock must be held.
+func (fe *FeeEngine) rollingVolume(user int, now time.Time) int {
+	volume := 0
+	for _, v := range fe.volumes[user] {
+		if now.Sub(v.day) < fe.Window {
+			volume += v.notional
+		}
+	}
+
+	return volume
+}
+
+// Fees returns the fees of a user since the last reset of the report.
+func (fe *FeeEngine) Fees(user int) UserFees {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	if fees, ok := fe.fees[user]; ok {
+		return *fees
+	}
+
+	return UserFees{User: user}
+}
+
+// Report returns the fees of all the users who traded since the last reset, sorted by user.
+func (fe *FeeEngine) Report() []UserFees {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	report := make([]UserFees, 0, len(fe.fees))
+	for _, fees := range fe.fees {
+		report = append(report, *fees)
+	}
+
+	sort.Slice(report, func(i, j int) bool { return report[i].User < report[j].User })
+	return report
+}
+
+// ResetReport forgets the accumulated fees, at the end of the day. The rolling volumes are kept.
+func (fe *FeeEngine) ResetReport() {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	fe.fees = map[int]*UserFees{}
+}
+
+// apply computes the fees of both sides of a trade, given if their orders were resting (maker),
+// then adds the trade to the rolling volumes and to the fees of the users.
+func (fe *FeeEngine) apply(trade *Trade, buyIsMaker, sellIsMaker bool) {
+	if fe == nil {
+		return
+	}
+
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	notional := trade.Price * trade.Quantity
+	trade.BuyFee = fe.fee(trade.BuyOrder, notional, buyIsMaker, trade.Time)
+	trade.SellFee = fe.fee(trade.SellOrder, notional, sellIsMaker, trade.Time)
+
+	fe.add(trade.BuyOrder.User, notional, trade.BuyFee, buyIsMaker, trade.Time)
+	fe.add(trade.SellOrder.User, notional, trade.SellFee, sellIsMaker, trade.Time)
+}
+
+// fee computes the fee of an order for the given notional, with the tier of the volume of its user before the trade.
+// It is rounded to the nearest minor unit, so the fees of the report, the execution reports and the ledger are the same.
+// The lock must be held.
+func (fe *FeeEngine) fee(order *Order, notional int, isMaker bool, now time.Time) int {
+	tier := fe.schedule(order.User, order.Symbol).Tier(fe.rollingVolume(order.User, now))
+	bps := tier.TakerBps
+	if isMaker {
+		bps = tier.MakerBps
+	}
+
+	return int(math.Round(float64(notional) * bps / 10000))
+}
+
+// add adds a fill to the rolling volume and the fees of a user, and forgets the volume out of the window.
+// The lock must be held.
+func (fe *FeeEngine) add(user, notional, fee int, isMaker bool, now time.Time) {
+	fees, ok := fe.fees[user]
+	if !ok {
+		fees = &UserFees{User: user}
+		fe.fees[user] = fees
+	}
+	if isMaker {
+		fees.MakerFees += fee
+	} else {
+		fees.TakerFees += fee
+	}
+	fees.Notional += notional
+
+	volumes := fe.volumes[user]
+	day := now.Truncate(24 * time.Hour)
+	if n := len(volumes); n > 0 && volumes[n-1].day.Equal(day) {
+		volumes[n-1].notional += notional
+	} else {
+		volumes = append(volumes, dailyVolume{day: day, notional: notional})
+	}
+
+	for len(volumes) > 0 && now.Sub(volumes[0].day) >= fe.Window {
+		volumes = volumes[1:]
+	}
+	fe.volumes[user] = volumes
+}
+
+// feeVolumeSnapshot is the serialized form of the notional traded by a user during a day.
+type feeVolumeSnapshot struct {
+	User     int
+	Day      time.Time
+	Notional int
+}
+
+// snapshot returns the rolling volumes sorted by user (the oldest first) and the fees of the report sorted by user.
+func (fe *FeeEngine) snapshot() ([]feeVolumeSnapshot, []UserFees) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	var volumes []feeVolumeSnapshot
+	for user, days := range fe.volumes {
+		for _, v := range days {
+			volumes = append(volumes, feeVolumeSnapshot{User: user, Day: v.day, Notional: v.notional})
+		}
+	}
+	sort.SliceStable(volumes, func(i, j int) bool {
+		if volumes[i].User != volumes[j].User {
+			return volumes[i].User < volumes[j].User
+		}
+		return volumes[i].Day.Before(volumes[j].Day)
+	})
+
+	report := make([]UserFees, 0, len(fe.fees))
+	for _, fees := range fe.fees {
+		report = append(report, *fees)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].User < report[j].User })
+
+	return volumes, report
+}
+
+// restore replaces the rolling volumes and the fees of the users of the snapshot.
+// The other users are kept, as the fee engine may be shared with other order books.
+func (fe *FeeEngine) restore(volumes []feeVolumeSnapshot, report []UserFees) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	restored := map[int][]dailyVolume{}
+	for _, v := range volumes {
+		restored[v.User] = append(restored[v.User], dailyVolume{day: v.Day, notional: v.Notional})
+	}
+	for user, days := range restored {
+		fe.volumes[user] = days
+	}
+
+	for _, fees := range report {
+		f := fees
+		fe.fees[fees.User] = &f
+	}
+}
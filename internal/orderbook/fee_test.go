@@ -0,0 +1,142 @@
+package orderbook_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestFeeSchedule(t *testing.T) {
+	assert := td.Assert(t)
+
+	schedule := orderbook.FeeSchedule{
+		{MinVolume: 10000, MakerBps: -2, TakerBps: 3},
+		{MinVolume: 0, MakerBps: -1, TakerBps: 5},
+		{MinVolume: 100000, MakerBps: -3, TakerBps: 2},
+	}
+	assert.Cmp(schedule.Tier(0), schedule[1])
+	assert.Cmp(schedule.Tier(9999), schedule[1])
+	assert.Cmp(schedule.Tier(10000), schedule[0])
+	assert.Cmp(schedule.Tier(1000000), schedule[2])
+	assert.Cmp(orderbook.FeeSchedule{{MinVolume: 10, TakerBps: 1}}.Tier(0), orderbook.FeeTier{})
+
+	fe := orderbook.NewFeeEngine()
+	all := orderbook.FeeSchedule{{TakerBps: 5}}
+	aapl := orderbook.FeeSchedule{{TakerBps: 10}}
+	user3 := orderbook.FeeSchedule{{TakerBps: 1}}
+	fe.SetSchedule(orderbook.AllUsers, "", all)
+	fe.SetSchedule(orderbook.AllUsers, "AAPL", aapl)
+	fe.SetSchedule(3, "", user3)
+	assert.Cmp(fe.Schedule(2, "IBM"), all)
+	assert.Cmp(fe.Schedule(2, "AAPL"), aapl)
+	assert.Cmp(fe.Schedule(3, "AAPL"), user3)
+}
+
+func TestOrderBook_Fees(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	clock := orderbook.NewFakeClock(time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC))
+	ob := orderbook.NewOrderBook(true)
+	ob.Clock = clock
+	ob.ExecutionReports = true
+	ob.Fees = orderbook.NewFeeEngine()
+	ob.Fees.SetSchedule(orderbook.AllUsers, "", orderbook.FeeSchedule{
+		{MinVolume: 0, MakerBps: -1, TakerBps: 5},
+		{MinVolume: 1000000, MakerBps: -2, TakerBps: 3},
+	})
+	process := func(instruction string) []string {
+		output, err := ob.ProcessInstruction(instruction)
+		require.CmpNoError(err)
+		return output
+	}
+
+	// The maker receives a rebate
+	process("N, 1, IBM, 1000, 1000, S, 1")
+	assert.Cmp(process("N, 2, IBM, 1000, 600, B, 1"), []string{
+		"A, 2, 1",
+		"T, 2, 1, 1, 1, 1000, 600",
+		"E, 2, 1, 1, B, 1000, 600, 0, 600, 1000, T, 300",
+		"E, 1, 1, 1, S, 1000, 600, 400, 600, 1000, M, -60",
+		"B, S, 1000, 400",
+	})
+
+	// The tier is given by the volume before the trade
+	assert.Cmp(process("N, 2, IBM, 1000, 400, B, 2"), td.SuperBagOf(
+		"E, 2, 2, 2, B, 1000, 400, 0, 400, 1000, T, 200",
+		"E, 1, 1, 2, S, 1000, 400, 0, 1000, 1000, M, -40",
+	))
+	assert.Cmp(ob.Fees.RollingVolume(2, clock.Now()), 1000000)
+
+	process("N, 1, IBM, 1000, 100, S, 2")
+	assert.Cmp(process("N, 2, IBM, 1000, 100, B, 3"), td.SuperBagOf(
+		"E, 2, 3, 3, B, 1000, 100, 0, 100, 1000, T, 30",
+		"E, 1, 2, 3, S, 1000, 100, 0, 100, 1000, M, -20",
+	))
+
+	assert.Cmp(ob.Fees.Report(), []orderbook.UserFees{
+		{User: 1, MakerFees: -60 + -40 + -20, Notional: 1100000},
+		{User: 2, TakerFees: 300 + 200 + 30, Notional: 1100000},
+	})
+	assert.Cmp(ob.Fees.Fees(3), orderbook.UserFees{User: 3})
+
+	// The volume is out of the rolling window
+	clock.Advance(30 * 24 * time.Hour)
+	assert.Cmp(ob.Fees.RollingVolume(2, clock.Now()), 0)
+
+	ob.Fees.ResetReport()
+	assert.Len(ob.Fees.Report(), 0)
+
+	// Fees are rounded once per fill to the nearest minor unit (1.5075 and -0.3015)
+	process("N, 1, IBM, 1005, 3, S, 4")
+	assert.Cmp(process("N, 2, IBM, 1005, 3, B, 4"), td.SuperBagOf(
+		"E, 2, 4, 4, B, 1005, 3, 0, 3, 1005, T, 2",
+		"E, 1, 4, 4, S, 1005, 3, 0, 3, 1005, M, 0",
+	))
+	assert.Cmp(ob.Fees.Fees(2).Total(), 2)
+	assert.Cmp(ob.Fees.Fees(1).Total(), 0)
+}
+
+func TestOrderBook_FeesSnapshot(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	clock := orderbook.NewFakeClock(time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC))
+	schedule := orderbook.FeeSchedule{
+		{MinVolume: 0, MakerBps: -1, TakerBps: 5},
+		{MinVolume: 1000000, MakerBps: -2, TakerBps: 3},
+	}
+	newOrderBook := func() *orderbook.OrderBook {
+		ob := orderbook.NewOrderBook(true)
+		ob.Clock = clock
+		ob.ExecutionReports = true
+		ob.Fees = orderbook.NewFeeEngine()
+		ob.Fees.SetSchedule(orderbook.AllUsers, "", schedule)
+		return ob
+	}
+
+	ob := newOrderBook()
+	_, err := ob.ProcessFromStringInstructions(`
+N, 1, IBM, 1000, 1100, S, 1
+N, 2, IBM, 1000, 1000, B, 1
+`)
+	require.CmpNoError(err)
+
+	var buf bytes.Buffer
+	require.CmpNoError(ob.WriteSnapshot(&buf))
+	restored := newOrderBook()
+	_, err = restored.ReadSnapshot(&buf)
+	require.CmpNoError(err)
+
+	// The rolling volumes and the report are restored, so the next trade has the same tier
+	assert.Cmp(restored.Fees.RollingVolume(2, clock.Now()), 1000000)
+	assert.Cmp(restored.Fees.Report(), ob.Fees.Report())
+	output, err := restored.ProcessInstruction("N, 2, IBM, 1000, 100, B, 2")
+	require.CmpNoError(err)
+	assert.Cmp(output, td.SuperBagOf(
+		"E, 2, 2, 2, B, 1000, 100, 0, 100, 1000, T, 30",
+		"E, 1, 1, 2, S, 1000, 100, 0, 1100, 1000, M, -20",
+	))
+}
@@ -0,0 +1,110 @@
+package orderbook
+
+import (
+	"fmt"
+)
+
+// CheckInvariants checks the consistency of the order book and returns the first violation found:
+//   - each queue is a heap sorted by price then by time (FIFO at the same price);
+//   - the maps of each queue index exactly the orders of its heap, and the quantity of each price
+//     is the sum of the quantities of the resting orders at this price;
+//   - resting orders have a positive quantity, which is the leaves quantity of their status;
+//   - only live orders of the order store were filled;
+//   - the book is not crossed, unless its symbol is not in continuous trading (e.g. orders are collected
+//     for an auction) or the best bid and ask belong to the same user (NoSelfTradePrevention).
+//     A book trades a single symbol (see Engine), the top orders of different symbols are ignored.
+//
+// It is meant for tests and debugging: it walks all the resting orders.
+func (ob *OrderBook) CheckInvariants() error {
+	if ob.Orders.err != nil {
+		return ob.Orders.err
+	}
+
+	for _, queue := range []*OrderQueue{ob.BidQueue, ob.AskQueue} {
+		if err := queue.checkInvariants(); err != nil {
+			return err
+		}
+
+		for _, order := range queue.orders {
+			if order.OrderSide != queue.OrderSide {
+				return fmt.Errorf("Order %s is in the %s queue", order.GetIdentifier(), queue.OrderSide)
+			}
+
+			status, ok := ob.Orders.GetOrderStatus(order.User, order.UserOrderId)
+			if !ok || status.State.IsTerminal() {
+				return fmt.Errorf("Resting order %s is not live in the order store", order.GetIdentifier())
+			}
+			if status.LeavesQuantity != order.Quantity ||
+				status.OriginalQuantity != status.LeavesQuantity+status.CumulativeQuantity {
+				return fmt.Errorf("Quantities of the status of order %s (%d + %d = %d) don't match its resting quantity %d",
+					order.GetIdentifier(), status.LeavesQuantity, status.CumulativeQuantity, status.OriginalQuantity, order.Quantity)
+			}
+		}
+	}
+
+	bid, ask := ob.BidQueue.Peak(), ob.AskQueue.Peak()
+	if bid != nil && ask != nil && bid.Price >= ask.Price && bid.Symbol == ask.Symbol &&
+		ob.GetTradingState(bid.Symbol) == ContinuousTradingState && bid.User != ask.User {
+		return fmt.Errorf("Book is crossed: bid %s at %d >= ask %s at %d", bid.GetIdentifier(), bid.Price, ask.GetIdentifier(), ask.Price)
+	}
+
+	return nil
+}
+
+// checkInvariants checks the heap and the maps of the queue.
+func (oq *OrderQueue) checkInvariants() error {
+	quantities := map[int]int{}
+	users, symbols := 0, 0
+	for i, order := range oq.orders {
+		identifier := order.GetIdentifier()
+		switch {
+		case order.index != i:
+			return fmt.Errorf("Order %s of the %s queue is at %d instead of %d", identifier, oq.OrderSide, i, order.index)
+		case i > 0 && oq.Less(i, (i-1)/2):
+			return fmt.Errorf("Order %s of the %s queue has priority over its parent %s",
+				identifier, oq.OrderSide, oq.orders[(i-1)/2].GetIdentifier())
+		case order.Quantity <= 0:
+			return fmt.Errorf("Order %s of the %s queue has no quantity: %d", identifier, oq.OrderSide, order.Quantity)
+		case oq.mapSearchByIdentifier[identifier] != order:
+			return fmt.Errorf("Order %s of the %s queue is not indexed by identifier", identifier, oq.OrderSide)
+		case oq.mapUserToOrders[order.User][identifier] != order:
+			return fmt.Errorf("Order %s of the %s queue is not indexed by user", identifier, oq.OrderSide)
+		case oq.mapSymbolToOrders[order.Symbol][identifier] != order:
+			return fmt.Errorf("Order %s of the %s queue is not indexed by symbol", identifier, oq.OrderSide)
+		}
+
+		quantities[order.Price] += order.Quantity
+	}
+
+	for _, orders := range oq.mapUserToOrders {
+		users += len(orders)
+	}
+	for _, orders := range oq.mapSymbolToOrders {
+		symbols += len(orders)
+	}
+	if len(oq.mapSearchByIdentifier) != len(oq.orders) || users != len(oq.orders) || symbols != len(oq.orders) {
+		return fmt.Errorf("Maps of the %s queue index %d, %d and %d orders instead of %d",
+			oq.OrderSide, len(oq.mapSearchByIdentifier), users, symbols, len(oq.orders))
+	}
+
+	// Prices without orders may be kept with a zero quantity
+	for price, quantity := range oq.mapPriceToQuantity {
+		if quantity != quantities[price] {
+			return fmt.Errorf("Quantity at %d of the %s queue is %d instead of %d", price, oq.OrderSide, quantity, quantities[price])
+		}
+	}
+	depth := 0
+	for price, quantity := range quantities {
+		if oq.mapPriceToQuantity[price] != quantity {
+			return fmt.Errorf("Quantity at %d of the %s queue is %d instead of %d",
+				price, oq.OrderSide, oq.mapPriceToQuantity[price], quantity)
+		}
+		depth += quantity
+	}
+	if oq.quantity != depth || oq.levels != len(quantities) {
+		return fmt.Errorf("Depth of the %s queue is %d in %d levels instead of %d in %d levels",
+			oq.OrderSide, oq.quantity, oq.levels, depth, len(quantities))
+	}
+
+	return nil
+}
@@ -0,0 +1,272 @@
+package orderbook_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+var fuzzStates = []string{"CONTINUOUS", "HALTED", "AUCTION", "PRE_OPEN", "CLOSED"}
+
+// fuzzInstruction decodes an instruction from 6 bytes. Users, ids and prices are taken in small ranges
+// so that orders collide: they cross, are modified, cancelled and reuse identifiers.
+// The book has one symbol, as each symbol has its own book in an engine.
+func fuzzInstruction(b []byte) string {
+	user, id := 1+int(b[1]%3), 1+int(b[2]%8)
+	price, quantity := 8+int(b[3]%5), int(b[4]%20)
+	side, tif := "B", "D"
+	if b[5]&1 == 1 {
+		side = "S"
+	}
+	if b[5]&2 == 2 {
+		tif = "G"
+	}
+
+	switch b[0] % 20 {
+	case 0, 1, 2:
+		return fmt.Sprintf("C, %d, %d", user, id)
+	case 3:
+		return fmt.Sprintf("M, %d, *, %s", user, side)
+	case 4, 5:
+		return fmt.Sprintf("S, IBM, %s", fuzzStates[int(b[1])%len(fuzzStates)])
+	case 6:
+		return "F"
+	}
+
+	return fmt.Sprintf("N, %d, IBM, %d, %d, %s, %d, %s", user, price, quantity, side, id, tif)
+}
+
+// priorities returns the rank of the resting orders of a queue by identifier.
+func priorities(queue *orderbook.OrderQueue) map[string]int {
+	ranks := map[string]int{}
+	for i, order := range queue.Orders() {
+		ranks[order.GetIdentifier()] = i
+	}
+
+	return ranks
+}
+
+// checkStep processes an instruction and checks the invariants of the book:
+// the ones of CheckInvariants, the conservation of the traded quantity (the positions sum to zero)
+// and the FIFO priority (resting orders not targeted by the instruction keep their relative priority).
+func checkStep(ob *orderbook.OrderBook, instruction string) error {
+	before := map[*orderbook.OrderQueue]map[string]int{
+		ob.BidQueue: priorities(ob.BidQueue),
+		ob.AskQueue: priorities(ob.AskQueue),
+	}
+
+	if _, err := ob.ProcessInstruction(instruction); err != nil {
+		return err
+	}
+
+	if err := ob.CheckInvariants(); err != nil {
+		return err
+	}
+
+	net := 0
+	for user := 1; user <= 3; user++ {
+		net += ob.Positions.GetPosition(user, "IBM").NetPosition
+	}
+	if net != 0 {
+		return fmt.Errorf("Positions sum to %d", net)
+	}
+
+	// The targeted order may lose its priority (modify)
+	target := ""
+	if fields := strings.Split(strings.ReplaceAll(instruction, " ", ""), ","); fields[0] == "N" {
+		target = fields[1] + "-" + fields[6]
+	}
+
+	for queue, ranks := range before {
+		previous, previousRank := (*orderbook.Order)(nil), -1
+		for _, order := range queue.Orders() {
+			rank, ok := ranks[order.GetIdentifier()]
+			if !ok || order.GetIdentifier() == target {
+				continue
+			}
+
+			if previous != nil && previous.Price == order.Price && previousRank > rank {
+				return fmt.Errorf("Order %s lost its priority over order %s at %d",
+					previous.GetIdentifier(), order.GetIdentifier(), order.Price)
+			}
+			previous, previousRank = order, rank
+		}
+	}
+
+	return nil
+}
+
+// newFuzzBook creates the order book of the harness, the bits of the flags select its options:
+// no trading, pro-rata matching and no self-trade prevention (the book can be crossed by a user).
+func newFuzzBook(flags uint8) *orderbook.OrderBook {
+	ob := orderbook.NewOrderBook(flags&1 == 0)
+	ob.HaltPolicy = orderbook.QueueHaltPolicy
+	ob.ExecutionReports = true
+	if flags&2 == 2 {
+		ob.MatchingPolicy = orderbook.ProRataMatchingPolicy
+	}
+	if flags&4 == 0 {
+		ob.SelfTradePrevention = orderbook.CancelNewestSelfTradePrevention
+	}
+
+	return ob
+}
+
+// checkInstructions processes the instructions decoded from the data and checks the invariants after each of them.
+func checkInstructions(flags uint8, data []byte) error {
+	ob := newFuzzBook(flags)
+
+	for i := 0; i+6 <= len(data); i += 6 {
+		instruction := fuzzInstruction(data[i : i+6])
+		if err := checkStep(ob, instruction); err != nil {
+			return fmt.Errorf("Instruction %d %q: %w\n%s", i/6+1, instruction, err, ob)
+		}
+	}
+
+	return nil
+}
+
+func TestOrderBook_Invariants(t *testing.T) {
+	assert := td.Assert(t)
+
+	for seed := int64(1); seed <= 200; seed++ {
+		data := make([]byte, 6*500)
+		rand.New(rand.NewSource(seed)).Read(data)
+
+		assert.CmpNoError(checkInstructions(uint8(seed%8), data), "seed %d", seed)
+	}
+}
+
+func TestOrderBook_InvariantsOrderStore(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	var audit bytes.Buffer
+	ob := orderbook.NewOrderBook(true)
+	ob.ExecutionReports = true
+	ob.Audit = orderbook.NewJSONAuditLog(&audit)
+	_, err := ob.ProcessInstruction("N, 1, IBM, 10, 100, S, 1")
+	require.CmpNoError(err)
+
+	// The order store forgets the resting order: its fill is still reported, but the inconsistency is kept
+	ob.Orders = orderbook.NewOrderStore(orderbook.DefaultTerminalOrders)
+	output, err := ob.ProcessInstruction("N, 2, IBM, 10, 100, B, 1")
+	require.CmpNoError(err)
+	assert.Contains(output, "E, 1, 1, 1, S, 10, 100, 0, 100, 10, M, 0")
+	assert.Contains(audit.String(), `{"Type":"INCONSISTENCY","Error":"Fill of order 1-1 which is not live in the order store"}`)
+	assert.String(ob.CheckInvariants(), "Fill of order 1-1 which is not live in the order store")
+}
+
+func FuzzOrderBook(f *testing.F) {
+	f.Add(uint8(0), []byte{7, 0, 0, 2, 10, 0, 7, 1, 1, 2, 4, 1, 7, 2, 2, 1, 9, 1})
+	f.Add(uint8(1), []byte{7, 0, 0, 2, 10, 0, 7, 1, 1, 1, 4, 1, 0, 0, 0, 0, 0, 0})
+	f.Add(uint8(2), []byte{4, 1, 0, 0, 0, 0, 7, 0, 0, 2, 10, 0, 7, 1, 1, 2, 4, 1, 4, 0, 0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, flags uint8, data []byte) {
+		if err := checkInstructions(flags, data); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func FuzzProcessInstruction(f *testing.F) {
+	for _, instruction := range []string{
+		"N, 1, IBM, 10, 100, B, 1",
+		"N, 2, IBM, 9, 50, S, 2, G",
+		"C, 1, 1",
+		"M, 1, IBM, *",
+		"M, *, *, B",
+		"S, IBM, HALTED",
+		"F",
+	} {
+		f.Add(instruction)
+	}
+
+	f.Fuzz(func(t *testing.T, instruction string) {
+		ob := orderbook.NewOrderBook(true)
+		if _, err := ob.ProcessFromStringInstructions("N, 1, IBM, 10, 100, B, 1\nN, 2, IBM, 12, 100, S, 2"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Any instruction is either processed or refused with an error, but the book stays consistent
+		_, _ = ob.ProcessInstruction(instruction)
+		if err := ob.CheckInvariants(); err != nil {
+			t.Fatalf("%q: %s\n%s", instruction, err, ob)
+		}
+	})
+}
+
+func FuzzParseScenarios(f *testing.F) {
+	f.Add("=== S\n@trade off\nN, 1, IBM, 10, 100, B, 1\n> A, 1, 1\n? best-bid = 10, 100\n")
+	f.Add("=== S\n@deposit 1 USD 10\n@instrument BTC/USD BTC USD\nF\n? balance 1 USD = 10\n")
+
+	f.Fuzz(func(t *testing.T, content string) {
+		scenarios, err := orderbook.ParseScenarios(strings.NewReader(content), "fuzz.txt")
+		if err != nil {
+			return
+		}
+
+		// Parsed options are valid, the scenario may fail but must not panic
+		for _, s := range scenarios {
+			if _, err := s.NewOrderBook(); err != nil {
+				t.Fatal(err)
+			}
+			_ = orderbook.RunScenario(s)
+		}
+	})
+}
+
+func FuzzReadSnapshot(f *testing.F) {
+	ob := orderbook.NewOrderBook(true)
+	if _, err := ob.ProcessFromStringInstructions("N, 1, IBM, 10, 100, B, 1\nN, 2, IBM, 12, 100, S, 2\nN, 1, IBM, 11, 5, B, 3"); err != nil {
+		f.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := ob.WriteSnapshot(&buf); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	f.Add([]byte("{}"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// A corrupted snapshot is refused, it must not panic
+		_, _ = orderbook.NewOrderBook(true).ReadSnapshot(bytes.NewReader(data))
+	})
+}
+
+func FuzzReadJournal(f *testing.F) {
+	path := filepath.Join(f.TempDir(), "journal")
+	ob := orderbook.NewOrderBook(true)
+	if _, err := ob.Recover(path); err != nil {
+		f.Fatal(err)
+	}
+	if _, err := ob.ProcessFromStringInstructions("N, 1, IBM, 10, 100, B, 1\nC, 1, 1"); err != nil {
+		f.Fatal(err)
+	}
+	if err := ob.Journal.Close(); err != nil {
+		f.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		entries, err := orderbook.ReadJournal(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		_, _ = orderbook.NewOrderBook(true).Replay(entries)
+	})
+}
@@ -0,0 +1,237 @@
+package orderbook
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// A journal record is: length(uint32) | checksum(uint32) | payload(length bytes)
+// and the payload is: time(int64 Unix nanoseconds) | instruction.
+const (
+	journalHeaderSize   = 8
+	journalTimeSize     = 8
+	maxJournalRecordLen = 1 << 20
+)
+
+var (
+	ErrTruncatedRecord = errors.New("Truncated journal record")
+	ErrCorruptRecord   = errors.New("Corrupt journal record")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// JournalEntry is an instruction accepted by the order book and the time it was processed.
+type JournalEntry struct {
+	Time        time.Time
+	Instruction string
+}
+
+// JournalError indicates the offset of the first invalid record of a journal.
+// Records before this offset are valid.
+type JournalError struct {
+	Offset int64
+	Err    error
+}
+
+// Error implements the error interface.
+func (je *JournalError) Error() string {
+	return fmt.Sprintf("%s at offset %d", je.Err, je.Offset)
+}
+
+// Unwrap returns ErrTruncatedRecord or ErrCorruptRecord.
+func (je *JournalError) Unwrap() error {
+	return je.Err
+}
+
+// Journal is a write-ahead log of the instructions processed by an order book.
+// Each record is length-prefixed and checksummed, and it is synced to disk when appended.
+type Journal struct {
+	file   *os.File
+	offset int64
+}
+
+// OpenJournal opens (or creates) the journal file at the given path for appending.
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Journal{file: file, offset: info.Size()}, nil
+}
+
+// Append writes an entry at the end of the journal and syncs it to disk.
+func (j *Journal) Append(entry JournalEntry) error {
+	payload := make([]byte, journalTimeSize+len(entry.Instruction))
+	binary.BigEndian.PutUint64(payload, uint64(entry.Time.UnixNano()))
+	copy(payload[journalTimeSize:], entry.Instruction)
+
+	record := make([]byte, journalHeaderSize, journalHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(payload, crcTable))
+	record = append(record, payload...)
+
+	if _, err := j.file.Write(record); err != nil {
+		return err
+	}
+	j.offset += int64(len(record))
+
+	return j.file.Sync()
+}
+
+// Offset returns the size of the journal, it is the offset of the next record.
+func (j *Journal) Offset() int64 {
+	return j.offset
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// ReadJournal reads all the entries of a journal (with UTC times).
+// If a record is truncated or corrupt, it returns the valid entries before it
+// and a *JournalError (see ErrTruncatedRecord and ErrCorruptRecord).
+func ReadJournal(r io.Reader) ([]JournalEntry, error) {
+	var entries []JournalEntry
+	var offset int64
+
+	reader := bufio.NewReader(r)
+	header := make([]byte, journalHeaderSize)
+	for {
+		if n, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return entries, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return entries, &JournalError{Offset: offset, Err: ErrTruncatedRecord}
+			}
+			return entries, fmt.Errorf("Can't read journal at offset %d: %w", offset+int64(n), err)
+		}
+
+		length := binary.BigEndian.Uint32(header)
+		if length < journalTimeSize || length > maxJournalRecordLen {
+			return entries, &JournalError{Offset: offset, Err: ErrCorruptRecord}
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return entries, &JournalError{Offset: offset, Err: ErrTruncatedRecord}
+			}
+			return entries, fmt.Errorf("Can't read journal at offset %d: %w", offset, err)
+		}
+
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+			return entries, &JournalError{Offset: offset, Err: ErrCorruptRecord}
+		}
+
+		entries = append(entries, JournalEntry{
+			Time:        time.Unix(0, int64(binary.BigEndian.Uint64(payload))).UTC(),
+			Instruction: string(payload[journalTimeSize:]),
+		})
+		offset += int64(journalHeaderSize + length)
+	}
+}
+
+// RepairJournal cuts the invalid tail of the journal file at the given path (if any).
+// It returns the number of bytes removed.
+func RepairJournal(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	_, err = ReadJournal(file)
+	var journalErr *JournalError
+	if !errors.As(err, &journalErr) {
+		return 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size() - journalErr.Offset, os.Truncate(path, journalErr.Offset)
+}
+
+// Replay processes the journal entries with a clock set to the time of each entry,
+// so that it produces the same outputs than when the entries were journaled.
+// The entries are not journaled again.
+func (ob *OrderBook) Replay(entries []JournalEntry) ([]string, error) {
+	clock, journal := ob.Clock, ob.Journal
+	defer func() {
+		ob.Clock, ob.Journal = clock, journal
+	}()
+
+	replayClock := NewFakeClock(time.Time{})
+	ob.Clock, ob.Journal = replayClock, nil
+
+	var result []string
+	for _, entry := range entries {
+		replayClock.Set(entry.Time)
+		output, err := ob.ProcessInstruction(entry.Instruction)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, output...)
+	}
+
+	return result, nil
+}
+
+// Recover rebuilds the order book by replaying the journal file at the given path
+// (a missing file is an empty journal), then it appends the next instructions to this journal.
+// The order book must be new and configured as when the journal was written.
+// If the tail of the journal is invalid, nothing is replayed and a *JournalError is returned:
+// the journal can be fixed with RepairJournal, losing the invalid records.
+func (ob *OrderBook) Recover(path string) ([]string, error) {
+	return ob.recover(path, 0)
+}
+
+// recover replays the records of the journal file from the given offset (see Recover).
+func (ob *OrderBook) recover(path string, offset int64) ([]string, error) {
+	var entries []JournalEntry
+
+	file, err := os.Open(path)
+	switch {
+	case err == nil:
+		defer file.Close()
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		entries, err = ReadJournal(file)
+		if journalErr, ok := err.(*JournalError); ok {
+			// Offsets are relative to the start of the file
+			journalErr.Offset += offset
+		}
+		if err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	result, err := ob.Replay(entries)
+	if err != nil {
+		return result, err
+	}
+
+	ob.Journal, err = OpenJournal(path)
+	return result, err
+}
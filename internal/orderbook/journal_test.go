@@ -0,0 +1,198 @@
+package orderbook_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+// newJournaledOrderBook creates an order book with a volatility guard, so that outputs depend on time.
+func newJournaledOrderBook(clock orderbook.Clock) *orderbook.OrderBook {
+	ob := orderbook.NewOrderBook(true)
+	ob.Clock = clock
+	ob.Guard = orderbook.NewVolatilityGuard(10, time.Minute, 30*time.Second)
+	ob.HaltPolicy = orderbook.QueueHaltPolicy
+	return ob
+}
+
+func TestOrderBook_Recover(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	path := filepath.Join(t.TempDir(), "journal")
+	clock := orderbook.NewFakeClock(time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC))
+
+	// No journal yet
+	ob := newJournaledOrderBook(clock)
+	output, err := ob.Recover(path)
+	require.CmpNoError(err)
+	assert.Nil(output)
+
+	var outputs []string
+	for _, instruction := range []string{
+		"N, 1, IBM, 100, 10, S, 1",
+		"N, 2, IBM, 100, 10, B, 2",
+		"N, 1, IBM, 120, 10, S, 3",
+		"N, 2, IBM, 120, 10, B, 4",
+		"N, 3, IBM, 90, 10, B, 5",
+		"N, 3, IBM, 1",
+		"C, 3, 5",
+		"N, 3, IBM, 95, 10, B, 6",
+	} {
+		clock.Advance(15 * time.Second)
+		output, err := ob.ProcessInstruction(instruction)
+		if err != nil {
+			// Invalid instructions are not journaled
+			continue
+		}
+		outputs = append(outputs, output...)
+	}
+	require.CmpNoError(ob.Journal.Close())
+
+	// The halt ended before the cancel
+	assert.Contains(outputs, "S, IBM, CONTINUOUS")
+
+	// Replaying the journal gives the same outputs, even with another clock
+	recovered := newJournaledOrderBook(orderbook.SystemClock{})
+	output, err = recovered.Recover(path)
+	require.CmpNoError(err)
+	assert.Cmp(output, outputs)
+	assert.Cmp(recovered.BidQueue.Orders(), ob.BidQueue.Orders())
+	assert.Cmp(recovered.AskQueue.Orders(), ob.AskQueue.Orders())
+
+	// Next instructions are appended to the journal
+	_, err = recovered.ProcessInstruction("C, 3, 6")
+	require.CmpNoError(err)
+	require.CmpNoError(recovered.Journal.Close())
+
+	f, err := os.Open(path)
+	require.CmpNoError(err)
+	defer f.Close()
+
+	entries, err := orderbook.ReadJournal(f)
+	require.CmpNoError(err)
+	assert.Len(entries, 8)
+	assert.Cmp(entries[7].Instruction, "C,3,6")
+}
+
+func TestReadJournal_InvalidTail(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	path := filepath.Join(t.TempDir(), "journal")
+	journal, err := orderbook.OpenJournal(path)
+	require.CmpNoError(err)
+
+	entry := orderbook.JournalEntry{Time: time.Unix(0, 42).UTC(), Instruction: "N,1,IBM,10,100,B,1"}
+	require.CmpNoError(journal.Append(entry))
+	firstRecordSize := journal.Offset()
+	require.CmpNoError(journal.Append(orderbook.JournalEntry{Time: time.Unix(0, 43), Instruction: "C,1,1"}))
+	require.CmpNoError(journal.Close())
+
+	content, err := os.ReadFile(path)
+	require.CmpNoError(err)
+
+	readJournal := func(content []byte) ([]orderbook.JournalEntry, error) {
+		require.CmpNoError(os.WriteFile(path, content, 0o644))
+		f, err := os.Open(path)
+		require.CmpNoError(err)
+		defer f.Close()
+		return orderbook.ReadJournal(f)
+	}
+
+	// Truncated tail
+	entries, err := readJournal(content[:len(content)-2])
+	assert.Cmp(entries, []orderbook.JournalEntry{entry})
+	assert.Cmp(err, td.Smuggle(func(err error) error { return err.(*orderbook.JournalError).Err }, orderbook.ErrTruncatedRecord))
+	assert.Cmp(err, td.Smuggle("Offset", firstRecordSize))
+
+	// Corrupt tail
+	corrupt := append([]byte(nil), content...)
+	corrupt[len(corrupt)-1] = 'X'
+	entries, err = readJournal(corrupt)
+	assert.Cmp(entries, []orderbook.JournalEntry{entry})
+	assert.Cmp(err, td.Smuggle(func(err error) error { return err.(*orderbook.JournalError).Err }, orderbook.ErrCorruptRecord))
+
+	// A book can't be recovered from an invalid journal until it is repaired
+	_, err = orderbook.NewOrderBook(true).Recover(path)
+	assert.CmpError(err)
+
+	removed, err := orderbook.RepairJournal(path)
+	require.CmpNoError(err)
+	assert.Cmp(removed, int64(len(content))-firstRecordSize)
+
+	output, err := orderbook.NewOrderBook(true).Recover(path)
+	require.CmpNoError(err)
+	assert.Cmp(output, []string{"A, 1, 1", "B, B, 10, 100"})
+}
+
+func TestOrderBook_RecoverSequences(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	dir := t.TempDir()
+	journalPath, snapshotPath := filepath.Join(dir, "journal"), filepath.Join(dir, "snapshot")
+
+	now := time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC)
+	ob := orderbook.NewOrderBook(true)
+	ob.Clock = orderbook.NewFakeClock(now)
+	_, err := ob.Recover(journalPath)
+	require.CmpNoError(err)
+
+	outputs, err := ob.ProcessSequencedInstruction("N, 1, IBM, 10, 100, S, 1")
+	require.CmpNoError(err)
+	assert.Cmp(outputs, []orderbook.SequencedOutput{
+		{Time: now, Sequence: 1, Output: "A, 1, 1"},
+		{Time: now, Sequence: 2, Output: "B, S, 10, 100"},
+	})
+
+	outputs, err = ob.ProcessSequencedInstruction("N, 2, IBM, 10, 40, B, 1")
+	require.CmpNoError(err)
+	assert.Cmp(outputs, []orderbook.SequencedOutput{
+		{Time: now, Sequence: 3, Output: "A, 2, 1"},
+		{Time: now, Sequence: 4, TradeID: 1, Output: "T, 2, 1, 1, 1, 10, 40"},
+		{Time: now, Sequence: 5, Output: "B, S, 10, 60"},
+	})
+	require.CmpNoError(ob.SaveSnapshot(snapshotPath))
+
+	_, err = ob.ProcessSequencedInstruction("N, 3, IBM, 10, 10, B, 1")
+	require.CmpNoError(err)
+
+	// A trading state change is an instruction too
+	output, err := ob.SetTradingState("IBM", orderbook.HaltedTradingState)
+	require.CmpNoError(err)
+	assert.Cmp(output, []string{"S, IBM, HALTED"})
+	_, err = ob.SetTradingState("IBM", orderbook.ContinuousTradingState)
+	require.CmpNoError(err)
+	assert.Cmp(ob.LastSequence(), uint64(10))
+	require.CmpNoError(ob.Journal.Close())
+
+	// Sequence numbers and trade IDs go on after a restart, from the journal or from a snapshot
+	next := "N, 4, IBM, 10, 10, B, 1"
+	expected := []orderbook.SequencedOutput{
+		{Time: now, Sequence: 11, Output: "A, 4, 1"},
+		{Time: now, Sequence: 12, TradeID: 3, Output: "T, 4, 1, 1, 1, 10, 10"},
+		{Time: now, Sequence: 13, Output: "B, S, 10, 40"},
+	}
+
+	fromJournal := orderbook.NewOrderBook(true)
+	fromJournal.Clock = orderbook.NewFakeClock(now)
+	_, err = fromJournal.Recover(journalPath)
+	require.CmpNoError(err)
+	defer fromJournal.Journal.Close()
+	assert.Cmp(fromJournal.LastSequence(), uint64(10))
+
+	fromSnapshot := orderbook.NewOrderBook(true)
+	fromSnapshot.Clock = orderbook.NewFakeClock(now)
+	_, err = fromSnapshot.RecoverFromSnapshot(snapshotPath, journalPath)
+	require.CmpNoError(err)
+	defer fromSnapshot.Journal.Close()
+
+	for _, recovered := range []*orderbook.OrderBook{fromJournal, fromSnapshot} {
+		outputs, err = recovered.ProcessSequencedInstruction(next)
+		require.CmpNoError(err)
+		assert.Cmp(outputs, expected)
+	}
+}
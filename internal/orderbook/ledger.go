@@ -0,0 +1,420 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Special accounts of the ledger, besides the accounts of the users.
+const (
+	FeeAccount      = -2 // Fees collected (and rebates paid) by the venue
+	ExternalAccount = -3 // Counterpart of the deposits and withdrawals
+)
+
+// Posting is a movement of an asset on the account of a user: a positive amount credits the account
+// (its balance increases) and a negative amount debits it.
+type Posting struct {
+	User   int
+	Asset  string
+	Amount int
+}
+
+// LedgerEntry is an immutable entry of the ledger: its postings sum to zero for each asset.
+// Entries are numbered from 1 without gap.
+type LedgerEntry struct {
+	ID       int
+	Time     time.Time
+	Type     string // TRADE, FEE or TRANSFER
+	TradeID  int    `json:",omitempty"` // Trade of a TRADE or FEE entry
+	Symbol   string `json:",omitempty"`
+	Base     string `json:",omitempty"` // Assets exchanged by a TRADE entry
+	Quote    string `json:",omitempty"` // Asset of a FEE entry too
+	Postings []Posting
+}
+
+// Ledger is a double-entry ledger of the settlement of trades: each trade is an entry which moves the quote amount
+// from the buyer to the seller and the base quantity from the seller to the buyer, then each non-zero fee is an entry
+// between the user and the FeeAccount (fees are in minor units of the quote asset, see FeeEngine). Deposits and
+// withdrawals are TRANSFER entries with the ExternalAccount, so the balances always sum to zero for each asset.
+// It implements the TradeListener interface, all the entries are kept in memory and written as JSON lines to
+// the writer (if any). It is goroutine-safe, so it can be shared by the order books of an engine.
+type Ledger struct {
+	Instruments func(symbol string) Instrument // Assets of a symbol, by default quoted in DefaultQuoteAsset
+
+	mu       sync.Mutex
+	entries  []LedgerEntry
+	balances map[int]map[string]int
+	encoder  *json.Encoder
+	err      error
+}
+
+// LedgerDiscrepancy is a difference found when the ledger is verified (see VerifyLedger).
+type LedgerDiscrepancy struct {
+	EntryID int // 0 if the discrepancy is about a trade missing in the ledger
+	Symbol  string
+	TradeID int
+	Reason  string
+}
+
+// String returns the discrepancy in a human readable format.
+func (ld LedgerDiscrepancy) String() string {
+	return fmt.Sprintf("entry %d, trade %s %d: %s", ld.EntryID, ld.Symbol, ld.TradeID, ld.Reason)
+}
+
+// tradeKey identifies a trade: trade IDs are only unique within the order book of a symbol,
+// and a ledger or a tape can be shared by the order books of an engine.
+type tradeKey struct {
+	Symbol  string
+	TradeID int
+}
+
+// NewLedger creates an empty ledger which writes its entries to the given writer (nil to keep them only in memory).
+func NewLedger(w io.Writer) *Ledger {
+	l := &Ledger{balances: map[int]map[string]int{}}
+	if w != nil {
+		l.encoder = json.NewEncoder(w)
+	}
+
+	return l
+}
+
+// OnTrade records the settlement of a trade and its fees. It implements the TradeListener interface.
+func (l *Ledger) OnTrade(trade *Trade) {
+	instrument := Instrument{Base: trade.Symbol(), Quote: DefaultQuoteAsset}
+	if l.Instruments != nil {
+		instrument = l.Instruments(trade.Symbol())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buyer, seller := trade.BuyOrder.User, trade.SellOrder.User
+	l.post(LedgerEntry{
+		Time:     trade.Time,
+		Type:     "TRADE",
+		TradeID:  trade.ID,
+		Symbol:   trade.Symbol(),
+		Base:     instrument.Base,
+		Quote:    instrument.Quote,
+		Postings: settlementPostings(buyer, seller, instrument, trade.Price, trade.Quantity),
+	})
+
+	for _, fee := range []struct {
+		user   int
+		amount int
+	}{{buyer, trade.BuyFee}, {seller, trade.SellFee}} {
+		if fee.amount == 0 {
+			continue
+		}
+
+		l.post(LedgerEntry{
+			Time:     trade.Time,
+			Type:     "FEE",
+			TradeID:  trade.ID,
+			Symbol:   trade.Symbol(),
+			Quote:    instrument.Quote,
+			Postings: feePostings(fee.user, instrument.Quote, fee.amount),
+		})
+	}
+}
+
+// Transfer records a deposit (positive amount) or a withdrawal (negative amount) of an asset by a user.
+func (l *Ledger) Transfer(user int, asset string, amount int, t time.Time) error {
+	if amount == 0 {
+		return fmt.Errorf("Transfer amount should not be 0")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.post(LedgerEntry{
+		Time: t,
+		Type: "TRANSFER",
+		Postings: []Posting{
+			{User: user, Asset: asset, Amount: amount},
+			{User: ExternalAccount, Asset: asset, Amount: -amount},
+		},
+	})
+	return l.err
+}
+
+// Balance returns the balance of an account for an asset.
+func (l *Ledger) Balance(user int, asset string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.balances[user][asset]
+}
+
+// Entries returns a copy of all the entries, the oldest first.
+func (l *Ledger) Entries() []LedgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]LedgerEntry, len(l.entries))
+	for i, entry := range l.entries {
+		entries[i] = entry
+		entries[i].Postings = append([]Posting(nil), entry.Postings...)
+	}
+
+	return entries
+}
+
+// Reconcile checks that the balances of all the accounts sum to zero for each asset.
+func (l *Ledger) Reconcile() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	totals := map[string]int{}
+	for _, balances := range l.balances {
+		for asset, balance := range balances {
+			totals[asset] += balance
+		}
+	}
+
+	return checkTotals(totals)
+}
+
+// Err returns the first error which happened when writing an entry (entries are not written anymore after it).
+func (l *Ledger) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// post numbers an entry, applies its postings to the balances and writes it, the lock must be held.
+func (l *Ledger) post(entry LedgerEntry) {
+	entry.ID = len(l.entries) + 1
+	l.entries = append(l.entries, entry)
+
+	for _, p := range entry.Postings {
+		balances, ok := l.balances[p.User]
+		if !ok {
+			balances = map[string]int{}
+			l.balances[p.User] = balances
+		}
+		balances[p.Asset] += p.Amount
+	}
+
+	if l.encoder != nil && l.err == nil {
+		l.err = l.encoder.Encode(entry)
+	}
+}
+
+// ReadLedger reads the entries written by a ledger.
+func ReadLedger(r io.Reader) ([]LedgerEntry, error) {
+	var entries []LedgerEntry
+	decoder := json.NewDecoder(r)
+	for decoder.More() {
+		var entry LedgerEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return entries, fmt.Errorf("Can't read ledger entry %d: %w", len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// VerifyLedger audits the entries of a ledger against the trades of the tape and returns the discrepancies:
+// entries which are not numbered in sequence or not balanced, balances which don't sum to zero,
+// trades of the ledger missing in the tape or which don't settle the trade of the tape, fees which
+// differ from the fees of the trade (amount or quote asset of the settlement), and trades or fees
+// of the tape missing in the ledger. Trades are identified by their symbol and their ID.
+func VerifyLedger(entries []LedgerEntry, tape []TapeEntry) []LedgerDiscrepancy {
+	var discrepancies []LedgerDiscrepancy
+	report := func(entryID int, key tradeKey, format string, args ...interface{}) {
+		discrepancies = append(discrepancies, LedgerDiscrepancy{EntryID: entryID, Symbol: key.Symbol, TradeID: key.TradeID,
+			Reason: fmt.Sprintf(format, args...)})
+	}
+
+	trades := map[tradeKey]TapeEntry{}
+	for _, trade := range tape {
+		trades[tradeKey{trade.Symbol, trade.TradeID}] = trade
+	}
+
+	quotes := map[tradeKey]string{} // Quote asset of the settled trades
+	charged := map[tradeKey]map[int]bool{}
+	totals := map[string]int{}
+	for i, entry := range entries {
+		key := tradeKey{entry.Symbol, entry.TradeID}
+		if entry.ID != i+1 {
+			report(entry.ID, key, "Entry should be %d", i+1)
+		}
+
+		sums := map[string]int{}
+		for _, p := range entry.Postings {
+			sums[p.Asset] += p.Amount
+			totals[p.Asset] += p.Amount
+		}
+		for _, asset := range sortedKeys(sums) {
+			if sums[asset] != 0 {
+				report(entry.ID, key, "Entry is not balanced for %s: %d", asset, sums[asset])
+			}
+		}
+
+		if entry.Type != "TRADE" && entry.Type != "FEE" {
+			continue
+		}
+
+		trade, ok := trades[key]
+		if !ok {
+			report(entry.ID, key, "%s of a trade which is not in the tape", entry.Type)
+			continue
+		}
+
+		if entry.Type == "FEE" {
+			quote, ok := quotes[key]
+			if !ok {
+				report(entry.ID, key, "FEE before the settlement of the trade")
+				continue
+			}
+
+			user := feePayer(entry.Postings)
+			fee, ok := tapeFee(trade, user)
+			if !ok {
+				report(entry.ID, key, "FEE of user %d who is not a party of the trade", user)
+				continue
+			}
+
+			if charged[key][user] {
+				report(entry.ID, key, "Fee of user %d is charged twice", user)
+				continue
+			}
+			if charged[key] == nil {
+				charged[key] = map[int]bool{}
+			}
+			charged[key][user] = true
+
+			expected := feePostings(user, quote, fee)
+			if entry.Quote != quote || !samePostings(entry.Postings, expected) {
+				report(entry.ID, key, "Fee %v in %s of %s differs from the fee %v in %s of the trade of %s",
+					entry.Postings, entry.Quote, entry.Symbol, expected, quote, trade.Symbol)
+			}
+			continue
+		}
+
+		if _, ok := quotes[key]; ok {
+			report(entry.ID, key, "Trade is settled twice")
+			continue
+		}
+		quotes[key] = entry.Quote
+
+		expected := settlementPostings(trade.BuyUser, trade.SellUser, Instrument{Base: entry.Base, Quote: entry.Quote},
+			trade.Price, trade.Quantity)
+		if !samePostings(entry.Postings, expected) {
+			report(entry.ID, key, "Settlement %v of %s differs from the trade %v of %s",
+				entry.Postings, entry.Symbol, expected, trade.Symbol)
+		}
+	}
+
+	for _, trade := range tape {
+		key := tradeKey{trade.Symbol, trade.TradeID}
+		if _, ok := quotes[key]; !ok {
+			report(0, key, "Trade of the tape is not settled in the ledger")
+			continue
+		}
+
+		for _, user := range []int{trade.BuyUser, trade.SellUser} {
+			if fee, _ := tapeFee(trade, user); fee != 0 && !charged[key][user] {
+				report(0, key, "Fee of user %d is not charged in the ledger", user)
+			}
+		}
+	}
+
+	if err := checkTotals(totals); err != nil {
+		report(0, tradeKey{}, "%s", err)
+	}
+
+	return discrepancies
+}
+
+// settlementPostings returns the postings of the settlement of a trade.
+func settlementPostings(buyer, seller int, instrument Instrument, price, quantity int) []Posting {
+	return []Posting{
+		{User: buyer, Asset: instrument.Quote, Amount: -price * quantity},
+		{User: seller, Asset: instrument.Quote, Amount: price * quantity},
+		{User: seller, Asset: instrument.Base, Amount: -quantity},
+		{User: buyer, Asset: instrument.Base, Amount: quantity},
+	}
+}
+
+// feePostings returns the postings of the fee of a user in the quote asset (a negative fee is a rebate).
+func feePostings(user int, quote string, fee int) []Posting {
+	return []Posting{
+		{User: user, Asset: quote, Amount: -fee},
+		{User: FeeAccount, Asset: quote, Amount: fee},
+	}
+}
+
+// feePayer returns the user of the postings of a fee which is not the FeeAccount.
+func feePayer(postings []Posting) int {
+	for _, p := range postings {
+		if p.User != FeeAccount {
+			return p.User
+		}
+	}
+
+	return FeeAccount
+}
+
+// tapeFee returns the fee of a party of a trade of the tape, and false if the user is not a party.
+func tapeFee(trade TapeEntry, user int) (int, bool) {
+	switch user {
+	case trade.BuyUser:
+		return trade.BuyFee, true
+	case trade.SellUser:
+		return trade.SellFee, true
+	}
+
+	return 0, false
+}
+
+// samePostings indicates if both lists of postings have the same net amount by user and asset.
+func samePostings(postings, expected []Posting) bool {
+	type key struct {
+		user  int
+		asset string
+	}
+
+	amounts := map[key]int{}
+	for _, p := range postings {
+		amounts[key{p.User, p.Asset}] += p.Amount
+	}
+	for _, p := range expected {
+		amounts[key{p.User, p.Asset}] -= p.Amount
+	}
+
+	for _, amount := range amounts {
+		if amount != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkTotals returns an error if a total by asset is not zero.
+func checkTotals(totals map[string]int) error {
+	for _, asset := range sortedKeys(totals) {
+		if totals[asset] != 0 {
+			return fmt.Errorf("Balances of %s sum to %d instead of 0", asset, totals[asset])
+		}
+	}
+
+	return nil
+}
+
+// sortedKeys returns the keys of the map sorted.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,183 @@
+package orderbook_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestLedger(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	start := time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	ledger := orderbook.NewLedger(&buf)
+	ledger.Instruments = func(symbol string) orderbook.Instrument {
+		return orderbook.Instrument{Base: "BTC", Quote: "USD"}
+	}
+	dir := t.TempDir()
+	tape := orderbook.NewTradeTape(1)
+	require.CmpNoError(tape.SpillTo(dir, 1))
+
+	ob := orderbook.NewOrderBook(true)
+	ob.Clock = orderbook.NewFakeClock(start)
+	ob.Fees = orderbook.NewFeeEngine()
+	ob.Fees.SetSchedule(orderbook.AllUsers, "", orderbook.FeeSchedule{{MakerBps: -15, TakerBps: 25}})
+	ob.Accounts = orderbook.NewAccountService()
+	ob.Accounts.SetInstrument("BTC/USD", orderbook.Instrument{Base: "BTC", Quote: "USD"})
+	ob.TradeListeners = []orderbook.TradeListener{ledger, tape}
+
+	require.CmpNoError(ledger.Transfer(1, "BTC", 10, start))
+	require.CmpNoError(ledger.Transfer(2, "USD", 5000, start))
+	assert.CmpError(ledger.Transfer(2, "USD", 0, start))
+	require.CmpNoError(ob.Deposit(1, "BTC", 10))
+	require.CmpNoError(ob.Deposit(2, "USD", 5000))
+
+	_, err := ob.ProcessFromStringInstructions(`
+N, 1, BTC/USD, 1000, 3, S, 1
+N, 2, BTC/USD, 1000, 2, B, 1
+N, 2, BTC/USD, 1000, 1, B, 2
+`)
+	require.CmpNoError(err)
+
+	entries := ledger.Entries()
+	require.Len(entries, 8)
+	assert.Cmp(entries[2], orderbook.LedgerEntry{
+		ID:      3,
+		Time:    start,
+		Type:    "TRADE",
+		TradeID: 1,
+		Symbol:  "BTC/USD",
+		Base:    "BTC",
+		Quote:   "USD",
+		Postings: []orderbook.Posting{
+			{User: 2, Asset: "USD", Amount: -2000},
+			{User: 1, Asset: "USD", Amount: 2000},
+			{User: 1, Asset: "BTC", Amount: -2},
+			{User: 2, Asset: "BTC", Amount: 2},
+		},
+	})
+
+	// The taker pays 5 (25 bps), the maker receives a rebate of 3 (-15 bps)
+	assert.Cmp(entries[3].Postings, []orderbook.Posting{
+		{User: 2, Asset: "USD", Amount: -5},
+		{User: orderbook.FeeAccount, Asset: "USD", Amount: 5},
+	})
+	assert.Cmp(entries[4].Postings, []orderbook.Posting{
+		{User: 1, Asset: "USD", Amount: 3},
+		{User: orderbook.FeeAccount, Asset: "USD", Amount: -3},
+	})
+
+	// The fees of the second trade (2.5 and -1.5) are rounded
+	assert.Cmp(entries[6].Postings[0], orderbook.Posting{User: 2, Asset: "USD", Amount: -3})
+	assert.Cmp(entries[7].Postings[0], orderbook.Posting{User: 1, Asset: "USD", Amount: 2})
+
+	assert.Cmp(ledger.Balance(1, "BTC"), 7)
+	assert.Cmp(ledger.Balance(1, "USD"), 3000+3+2)
+	assert.Cmp(ledger.Balance(2, "USD"), 5000-3000-5-3)
+	assert.Cmp(ledger.Balance(orderbook.FeeAccount, "USD"), 3)
+	assert.Cmp(ledger.Balance(orderbook.ExternalAccount, "BTC"), -10)
+	assert.CmpNoError(ledger.Reconcile())
+	require.CmpNoError(ledger.Err())
+
+	// The account service applies the same postings
+	for _, user := range []int{1, 2, orderbook.FeeAccount} {
+		for _, asset := range []string{"BTC", "USD"} {
+			assert.Cmp(ob.Accounts.GetBalance(user, asset).Total, ledger.Balance(user, asset), "user %d, %s", user, asset)
+		}
+	}
+
+	// The written ledger matches the tape written in the segments (the last trade when it is closed)
+	require.CmpNoError(tape.Close())
+	var tapeEntries []orderbook.TapeEntry
+	segments, err := orderbook.TapeSegments(dir)
+	require.CmpNoError(err)
+	require.Len(segments, 2)
+	for _, segment := range segments {
+		trades, err := orderbook.ReadTapeSegment(segment)
+		require.CmpNoError(err)
+		tapeEntries = append(tapeEntries, trades...)
+	}
+	assert.Cmp(tapeEntries, td.Smuggle(tradeIDs, []int{1, 2}))
+	assert.Cmp(tapeEntries[1].BuyFee, 3)
+	assert.Cmp(tapeEntries[1].SellFee, -2)
+
+	written, err := orderbook.ReadLedger(&buf)
+	require.CmpNoError(err)
+	assert.Cmp(written, entries)
+	assert.Len(orderbook.VerifyLedger(written, tapeEntries), 0)
+
+	written, _ = orderbook.ReadLedger(bytes.NewReader(nil))
+	assert.Len(written, 0)
+
+	// Tampered entries are reported
+	written = ledger.Entries()
+	written[2].Postings[0].Amount = -1999
+	written = append(written[:5], written[6:]...)
+	assert.Cmp(orderbook.VerifyLedger(written, tapeEntries[1:]), []orderbook.LedgerDiscrepancy{
+		{EntryID: 3, Symbol: "BTC/USD", TradeID: 1, Reason: "Entry is not balanced for USD: 1"},
+		{EntryID: 3, Symbol: "BTC/USD", TradeID: 1, Reason: "TRADE of a trade which is not in the tape"},
+		{EntryID: 4, Symbol: "BTC/USD", TradeID: 1, Reason: "FEE of a trade which is not in the tape"},
+		{EntryID: 5, Symbol: "BTC/USD", TradeID: 1, Reason: "FEE of a trade which is not in the tape"},
+		{EntryID: 7, Symbol: "BTC/USD", TradeID: 2, Reason: "Entry should be 6"},
+		{EntryID: 7, Symbol: "BTC/USD", TradeID: 2, Reason: "FEE before the settlement of the trade"},
+		{EntryID: 8, Symbol: "BTC/USD", TradeID: 2, Reason: "Entry should be 7"},
+		{EntryID: 8, Symbol: "BTC/USD", TradeID: 2, Reason: "FEE before the settlement of the trade"},
+		{EntryID: 0, Symbol: "BTC/USD", TradeID: 2, Reason: "Trade of the tape is not settled in the ledger"},
+		{EntryID: 0, TradeID: 0, Reason: "Balances of USD sum to 1 instead of 0"},
+	})
+
+	// Fees are checked against the fees of the tape
+	written = ledger.Entries()
+	written[3].Postings[0].Amount, written[3].Postings[1].Amount = -6, 6
+	written[4].Quote = "EUR"
+	written[6] = written[3]
+	written = written[:7]
+	written[6].ID = 7
+	assert.Cmp(orderbook.VerifyLedger(written, tapeEntries), []orderbook.LedgerDiscrepancy{
+		{EntryID: 4, Symbol: "BTC/USD", TradeID: 1, Reason: "Fee [{2 USD -6} {-2 USD 6}] in USD of BTC/USD differs from the fee [{2 USD -5} {-2 USD 5}] in USD of the trade of BTC/USD"},
+		{EntryID: 5, Symbol: "BTC/USD", TradeID: 1, Reason: "Fee [{1 USD 3} {-2 USD -3}] in EUR of BTC/USD differs from the fee [{1 USD 3} {-2 USD -3}] in USD of the trade of BTC/USD"},
+		{EntryID: 7, Symbol: "BTC/USD", TradeID: 1, Reason: "Fee of user 2 is charged twice"},
+		{EntryID: 0, Symbol: "BTC/USD", TradeID: 2, Reason: "Fee of user 2 is not charged in the ledger"},
+		{EntryID: 0, Symbol: "BTC/USD", TradeID: 2, Reason: "Fee of user 1 is not charged in the ledger"},
+	})
+
+}
+
+func TestLedger_SharedByBooks(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ledger := orderbook.NewLedger(nil)
+	tape := orderbook.NewTradeTape(10)
+
+	// Both order books number their trades from 1
+	for _, symbol := range []string{"IBM", "AAPL"} {
+		ob := orderbook.NewOrderBook(true)
+		ob.Fees = orderbook.NewFeeEngine()
+		ob.Fees.SetSchedule(orderbook.AllUsers, "", orderbook.FeeSchedule{{MakerBps: 10, TakerBps: 20}})
+		ob.TradeListeners = []orderbook.TradeListener{ledger, tape}
+
+		_, err := ob.ProcessFromStringInstructions(`
+N, 1, ` + symbol + `, 1000, 3, S, 1
+N, 2, ` + symbol + `, 1000, 3, B, 1
+`)
+		require.CmpNoError(err)
+	}
+
+	entries := ledger.Entries()
+	trades := tape.Last(10)
+	require.Len(trades, 2)
+	assert.Cmp(trades, td.Smuggle(tradeIDs, []int{1, 1}))
+	assert.Len(orderbook.VerifyLedger(entries, trades), 0)
+
+	// A trade is found with its symbol
+	assert.Cmp(orderbook.VerifyLedger(entries, trades[:1]), []orderbook.LedgerDiscrepancy{
+		{EntryID: 4, Symbol: "AAPL", TradeID: 1, Reason: "TRADE of a trade which is not in the tape"},
+		{EntryID: 5, Symbol: "AAPL", TradeID: 1, Reason: "FEE of a trade which is not in the tape"},
+		{EntryID: 6, Symbol: "AAPL", TradeID: 1, Reason: "FEE of a trade which is not in the tape"},
+	})
+}
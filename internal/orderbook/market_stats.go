@@ -0,0 +1,93 @@
+package orderbook
+
+import (
+	"sort"
+	"time"
+)
+
+// SymbolStats is the statistics of the trades of a symbol during the session.
+// The close price is the price of the last trade.
+type SymbolStats struct {
+	Symbol   string
+	LastSize int
+	LastTime time.Time
+	OHLCV
+}
+
+// add adds a trade to the statistics.
+func (s *SymbolStats) add(trade *Trade) {
+	s.OHLCV.add(trade)
+	s.LastSize = trade.Quantity
+	s.LastTime = trade.Time
+}
+
+// MarketStats keeps the session statistics of each symbol, updated on every trade.
+// The statistics are published to 'OnPublish' (if any) when Tick is called, at most once per 'Interval'.
+// They must be reset at the start of each session.
+type MarketStats struct {
+	Interval  time.Duration
+	OnPublish func(stats []SymbolStats)
+
+	stats       map[string]*SymbolStats
+	lastPublish time.Time
+}
+
+// NewMarketStats creates empty statistics published every interval.
+func NewMarketStats(interval time.Duration) *MarketStats {
+	return &MarketStats{
+		Interval: interval,
+		stats:    map[string]*SymbolStats{},
+	}
+}
+
+// OnTrade updates the statistics of the symbol of the trade.
+// It implements the TradeListener interface.
+func (ms *MarketStats) OnTrade(trade *Trade) {
+	stats, ok := ms.stats[trade.Symbol()]
+	if !ok {
+		stats = &SymbolStats{Symbol: trade.Symbol()}
+		ms.stats[trade.Symbol()] = stats
+	}
+
+	stats.add(trade)
+}
+
+// Get returns a copy of the statistics of a symbol (false if it did not trade during the session).
+func (ms *MarketStats) Get(symbol string) (SymbolStats, bool) {
+	if stats, ok := ms.stats[symbol]; ok {
+		return *stats, true
+	}
+
+	return SymbolStats{}, false
+}
+
+// GetAll returns a copy of the statistics of all the symbols sorted by symbol.
+func (ms *MarketStats) GetAll() []SymbolStats {
+	all := make([]SymbolStats, 0, len(ms.stats))
+	for _, stats := range ms.stats {
+		all = append(all, *stats)
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Symbol < all[j].Symbol })
+	return all
+}
+
+// Tick publishes the statistics of all the symbols if the interval elapsed since the last publication.
+// It returns true if the statistics were published.
+func (ms *MarketStats) Tick(now time.Time) bool {
+	if !ms.lastPublish.IsZero() && now.Sub(ms.lastPublish) < ms.Interval {
+		return false
+	}
+
+	ms.lastPublish = now
+	if ms.OnPublish != nil {
+		ms.OnPublish(ms.GetAll())
+	}
+
+	return true
+}
+
+// Reset clears the statistics of a symbol, at the start of its session.
+func (ms *MarketStats) Reset(symbol string) {
+	delete(ms.stats, symbol)
+}
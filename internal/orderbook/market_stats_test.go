@@ -0,0 +1,87 @@
+package orderbook_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestMarketStats(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	start := time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock := orderbook.NewFakeClock(start)
+
+	var published [][]orderbook.SymbolStats
+	stats := orderbook.NewMarketStats(time.Minute)
+	stats.OnPublish = func(s []orderbook.SymbolStats) { published = append(published, s) }
+
+	// One order book per symbol, as orders of all the symbols of a book are in the same queues
+	for symbol, instructions := range map[string]string{
+		"IBM": `
+N, 1, IBM, 10, 100, S, 1
+N, 1, IBM, 12, 100, S, 2
+N, 2, IBM, 12, 150, B, 1
+`,
+		"AAPL": `
+N, 1, AAPL, 50, 10, S, 3
+N, 2, AAPL, 50, 4, B, 2
+`,
+	} {
+		ob := orderbook.NewOrderBook(true)
+		ob.Clock = clock
+		ob.TradeListeners = append(ob.TradeListeners, stats)
+		_, err := ob.ProcessFromStringInstructions(instructions)
+		require.CmpNoError(err, symbol)
+	}
+
+	ibm := orderbook.SymbolStats{
+		Symbol:   "IBM",
+		LastSize: 50,
+		LastTime: start,
+		OHLCV: orderbook.OHLCV{
+			Open:       10,
+			High:       12,
+			Low:        10,
+			Close:      12,
+			Volume:     150,
+			Turnover:   10*100 + 12*50,
+			VWAP:       1600.0 / 150,
+			TradeCount: 2,
+		},
+	}
+	aapl := orderbook.SymbolStats{
+		Symbol:   "AAPL",
+		LastSize: 4,
+		LastTime: start,
+		OHLCV: orderbook.OHLCV{
+			Open:       50,
+			High:       50,
+			Low:        50,
+			Close:      50,
+			Volume:     4,
+			Turnover:   200,
+			VWAP:       50,
+			TradeCount: 1,
+		},
+	}
+	got, ok := stats.Get("IBM")
+	require.True(ok)
+	assert.Cmp(got, ibm)
+	assert.Cmp(stats.GetAll(), []orderbook.SymbolStats{aapl, ibm})
+
+	// Statistics are published at most once per interval
+	assert.True(stats.Tick(start))
+	assert.False(stats.Tick(start.Add(30 * time.Second)))
+	assert.True(stats.Tick(start.Add(time.Minute)))
+	assert.Cmp(published, [][]orderbook.SymbolStats{{aapl, ibm}, {aapl, ibm}})
+
+	// A new session starts without statistics
+	stats.Reset("IBM")
+	_, ok = stats.Get("IBM")
+	assert.False(ok)
+	assert.Cmp(stats.GetAll(), []orderbook.SymbolStats{aapl})
+}
@@ -0,0 +1,136 @@
+package orderbook
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AllUsers is the user of a mass cancel which cancels the orders of every user.
+const AllUsers = -1
+
+// MassCancel represents a cancel of all the orders matching a filter.
+// 'User' is AllUsers, 'Symbol' and 'Side' are empty to match any value.
+type MassCancel struct {
+	User   int
+	Symbol string
+	Side   string
+}
+
+// NewMassCancelFromInstruction creates a new MassCancel from a string.
+// Instruction should have the form: 'M, user(int or *), symbol(string or *), side(B, S or *)'.
+// It returns an error if it can't parse the string.
+func NewMassCancelFromInstruction(instruction string) (*MassCancel, error) {
+	params := strings.Split(instruction, ",")
+	if len(params) != 4 {
+		return nil,
+			fmt.Errorf("Can't create new mass cancel from instruction as it has not 4 parameters: %q", instruction)
+	}
+
+	mc := &MassCancel{User: AllUsers}
+	if params[1] != "*" {
+		user, err := strconv.Atoi(params[1])
+		if err != nil {
+			return nil, err
+		}
+		mc.User = user
+	}
+
+	if params[2] != "*" {
+		mc.Symbol = params[2]
+	}
+
+	switch params[3] {
+	case "B", "S":
+		mc.Side = params[3]
+	case "*":
+	default:
+		return nil, fmt.Errorf("Unknown side for mass cancel: %q", params[3])
+	}
+
+	return mc, nil
+}
+
+// Instruction returns the instruction of the mass cancel.
+func (mc *MassCancel) Instruction() string {
+	user, symbol, side := "*", "*", "*"
+	if mc.User != AllUsers {
+		user = strconv.Itoa(mc.User)
+	}
+	if mc.Symbol != "" {
+		symbol = mc.Symbol
+	}
+	if mc.Side != "" {
+		side = mc.Side
+	}
+
+	return fmt.Sprintf("M, %s, %s, %s", user, symbol, side)
+}
+
+// Matches indicates if the order is cancelled by the mass cancel.
+func (mc *MassCancel) Matches(order *Order) bool {
+	return (mc.User == AllUsers || order.User == mc.User) &&
+		(mc.Symbol == "" || order.Symbol == mc.Symbol) &&
+		(mc.Side == "" || order.OrderSide == mc.Side)
+}
+
+// processMassCancel cancels all the orders matching the mass cancel, including the orders queued
+// during a halt. It acknowledges the number of cancelled orders with 'M, user, symbol, side, count',
+// then publishes the TOB change of each side once.
+// Orders are found with the indexes of the queues by user or symbol, without scanning the heap.
+func (ob *OrderBook) processMassCancel(mc *MassCancel) []SequencedOutput {
+	count := 0
+
+	var tobOutputs []SequencedOutput
+	for _, queue := range []*OrderQueue{ob.BidQueue, ob.AskQueue} {
+		if mc.Side != "" && mc.Side != queue.OrderSide {
+			continue
+		}
+
+		oldTOB := queue.GetTOBInfo()
+		for _, order := range queue.ordersOf(mc.User, mc.Symbol) {
+			if !mc.Matches(order) {
+				continue
+			}
+
+			queue.Delete(order.GetIdentifier())
+			ob.Positions.addExposure(order, -order.Quantity)
+			ob.Accounts.release(order, order.Quantity)
+			ob.Orders.cancel(order)
+			ob.Metrics.cancel(order.Symbol)
+			ob.audit.order("CANCEL", order)
+			count++
+		}
+
+		if oldTOB != queue.GetTOBInfo() {
+			tobOutputs = append(tobOutputs, outputsOf(ob.generateTopOfBookChangeOutput(queue))...)
+		}
+	}
+
+	// Sort symbols to keep the order statuses deterministic
+	symbols := make([]string, 0, len(ob.symbolStatuses))
+	for symbol := range ob.symbolStatuses {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	for _, symbol := range symbols {
+		status := ob.symbolStatuses[symbol]
+		queuedOrders := status.queuedOrders[:0]
+		for _, order := range status.queuedOrders {
+			if mc.Matches(order) {
+				ob.Accounts.release(order, order.Quantity)
+				ob.Orders.cancel(order)
+				ob.Metrics.cancel(order.Symbol)
+				ob.audit.order("CANCEL", order)
+				count++
+				continue
+			}
+			queuedOrders = append(queuedOrders, order)
+		}
+		status.queuedOrders = queuedOrders
+	}
+
+	return append(outputsOf(fmt.Sprintf("%s, %d", mc.Instruction(), count)), tobOutputs...)
+}
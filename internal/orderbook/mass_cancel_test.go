@@ -0,0 +1,67 @@
+package orderbook_test
+
+import (
+	"testing"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestNewMassCancelFromInstruction(t *testing.T) {
+	assert := td.Assert(t)
+
+	mc, err := orderbook.NewMassCancelFromInstruction("M,1,IBM,B")
+	assert.CmpNoError(err)
+	assert.Cmp(mc, &orderbook.MassCancel{User: 1, Symbol: "IBM", Side: "B"})
+	assert.Cmp(mc.Instruction(), "M, 1, IBM, B")
+
+	mc, err = orderbook.NewMassCancelFromInstruction("M,*,*,*")
+	assert.CmpNoError(err)
+	assert.Cmp(mc, &orderbook.MassCancel{User: orderbook.AllUsers})
+	assert.Cmp(mc.Instruction(), "M, *, *, *")
+
+	_, err = orderbook.NewMassCancelFromInstruction("M,1,IBM")
+	assert.String(err, `Can't create new mass cancel from instruction as it has not 4 parameters: "M,1,IBM"`)
+
+	_, err = orderbook.NewMassCancelFromInstruction("M,1,IBM,X")
+	assert.String(err, `Unknown side for mass cancel: "X"`)
+}
+
+func TestOrderBook_MassCancel(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ob := orderbook.NewOrderBook(true)
+	ob.HaltPolicy = orderbook.QueueHaltPolicy
+	process := func(instruction string) []string {
+		output, err := ob.ProcessInstruction(instruction)
+		require.CmpNoError(err)
+		return output
+	}
+
+	process("N, 1, IBM, 10, 100, B, 1")
+	process("N, 1, IBM, 9, 100, B, 2")
+	process("N, 2, IBM, 10, 50, B, 3")
+	process("N, 1, IBM, 12, 100, S, 4")
+	process("N, 1, AAPL, 20, 100, S, 5")
+	process("N, 2, IBM, 13, 100, S, 6")
+	process("S, MSFT, HALTED")
+	process("N, 1, MSFT, 30, 100, B, 7")
+
+	// All the orders of user 1 on IBM: a single TOB change per side
+	assert.Cmp(process("M, 1, IBM, *"), []string{
+		"M, 1, IBM, *, 3",
+		"B, B, 10, 50",
+		"B, S, 13, 100",
+	})
+	assert.Cmp(ob.Positions.GetPosition(1, "IBM").OpenBuyQuantity, 0)
+
+	// Orders queued during a halt are cancelled as well
+	assert.Cmp(process("M, 1, *, B"), []string{"M, 1, *, B, 1"})
+
+	// Nothing left to cancel
+	assert.Cmp(process("M, 1, *, B"), []string{"M, 1, *, B, 0"})
+
+	assert.Cmp(process("M, *, *, S"), []string{"M, *, *, S, 2", "B, S, -, -"})
+	assert.Cmp(ob.BidQueue.Orders(), td.Bag(td.Struct(&orderbook.Order{User: 2, UserOrderId: 3}, nil)))
+}
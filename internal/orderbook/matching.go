@@ -0,0 +1,117 @@
+package orderbook
+
+import "sort"
+
+// MatchingPolicy indicates how an incoming order is allocated between the resting orders of a price level.
+type MatchingPolicy int
+
+const (
+	PriceTimeMatchingPolicy MatchingPolicy = iota // The oldest order of the level is filled first (FIFO)
+	ProRataMatchingPolicy                         // The level is filled in proportion to the resting quantities
+)
+
+// SelfTradePrevention indicates what happens when an incoming order reaches an order of the same user.
+// Orders of the same user never match each other.
+type SelfTradePrevention int
+
+const (
+	// The orders of the same user are skipped: the incoming order matches the orders of the other users
+	// and the remaining quantity rests, possibly crossing orders of its user (the book is only crossed by
+	// the orders of a user). During an auction, orders of the same user can cross.
+	NoSelfTradePrevention SelfTradePrevention = iota
+	// The remaining quantity of the incoming order is rejected (SELF_TRADE), so the book is never crossed.
+	// During an auction, an order crossing any order of the same user is rejected.
+	CancelNewestSelfTradePrevention
+)
+
+// bestOrderCrossing returns the order of the queue with the highest priority which crosses the given order
+// and belongs to another user, nil if there is none. It walks all the orders of the queue.
+func (oq *OrderQueue) bestOrderCrossing(order *Order) *Order {
+	var best *Order
+	for _, o := range oq.orders {
+		if o.User == order.User || !crosses(order, o) {
+			continue
+		}
+		if best == nil || oq.Less(o.index, best.index) {
+			best = o
+		}
+	}
+
+	return best
+}
+
+// ordersAtPrice returns the orders of the queue at the given price, sorted by priority.
+func (oq *OrderQueue) ordersAtPrice(price int) []*Order {
+	level := &OrderQueue{compareFunc: oq.compareFunc}
+	for _, o := range oq.orders {
+		if o.Price == price {
+			level.orders = append(level.orders, o)
+		}
+	}
+	sort.Sort(sortableOrders{level})
+
+	return level.orders
+}
+
+// allocateProRata allocates a quantity between orders in proportion to their quantity (rounded down).
+// The lots left by the rounding are allocated one by one to the orders by priority.
+// The quantity must be lower than the total quantity of the orders.
+func allocateProRata(orders []*Order, quantity int) []int {
+	total := 0
+	for _, o := range orders {
+		total += o.Quantity
+	}
+
+	allocations := make([]int, len(orders))
+	left := quantity
+	for i, o := range orders {
+		allocations[i] = o.Quantity * quantity / total
+		left -= allocations[i]
+	}
+
+	for i := 0; left > 0; i = (i + 1) % len(orders) {
+		if allocations[i] < orders[i].Quantity {
+			allocations[i]++
+			left--
+		}
+	}
+
+	return allocations
+}
+
+// matchProRata matches the order against a price level of the opposite queue, in proportion to the
+// quantities of the resting orders. Orders of the same user don't take part in the allocation.
+// It returns the outputs of the trades.
+func (ob *OrderBook) matchProRata(order *Order, queueToCompare *OrderQueue, price int) []SequencedOutput {
+	var level []*Order
+	total := 0
+	for _, o := range queueToCompare.ordersAtPrice(price) {
+		if o.User != order.User {
+			level = append(level, o)
+			total += o.Quantity
+		}
+	}
+
+	allocations := make([]int, len(level))
+	if order.Quantity >= total {
+		for i, o := range level {
+			allocations[i] = o.Quantity
+		}
+	} else {
+		allocations = allocateProRata(level, order.Quantity)
+	}
+
+	var result []SequencedOutput
+	for i, o := range level {
+		if allocations[i] == 0 {
+			continue
+		}
+
+		trade := NewTrade(order, o, o.Price, allocations[i])
+		queueToCompare.fill(o, allocations[i])
+		order.Quantity -= allocations[i]
+		result = append(result, ob.processTrade(trade, o)...)
+	}
+
+	return result
+}
@@ -0,0 +1,105 @@
+package orderbook_test
+
+import (
+	"testing"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestOrderBook_SelfTradePrevention(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	var ob *orderbook.OrderBook
+	process := func(instruction string) []string {
+		output, err := ob.ProcessInstruction(instruction)
+		require.CmpNoError(err)
+		return output
+	}
+
+	// By default, the order rests when it reaches an order of the same user, even if it crosses the book
+	ob = orderbook.NewOrderBook(true)
+	process("N, 1, IBM, 10, 100, S, 1")
+	process("N, 2, IBM, 11, 100, S, 2")
+	assert.Cmp(process("N, 1, IBM, 10, 50, B, 2"), []string{"A, 1, 2", "B, B, 10, 50"})
+	assert.Cmp(process("N, 2, IBM, 12, 150, B, 3"), []string{
+		"A, 2, 3",
+		"T, 2, 3, 1, 1, 10, 100",
+		"B, S, 11, 100",
+		"B, B, 12, 50",
+	})
+
+	// Or it is accepted if the book can't trade
+	ob = orderbook.NewOrderBook(false)
+	process("N, 1, IBM, 10, 100, S, 1")
+	assert.Cmp(process("N, 1, IBM, 10, 50, B, 2"), []string{"A, 1, 2", "B, B, 10, 50"})
+
+	// With CancelNewest, the top of the book is an order of the same user: the order is rejected
+	ob = orderbook.NewOrderBook(true)
+	ob.SelfTradePrevention = orderbook.CancelNewestSelfTradePrevention
+	process("N, 1, IBM, 10, 100, S, 1")
+	process("N, 2, IBM, 11, 100, S, 2")
+	assert.Cmp(process("N, 1, IBM, 10, 50, B, 2"), []string{"R, 1, 2"})
+
+	// The remaining quantity is rejected when the matching reaches an order of the same user
+	assert.Cmp(process("N, 2, IBM, 12, 150, B, 3"), []string{
+		"A, 2, 3",
+		"T, 2, 3, 1, 1, 10, 100",
+		"B, S, 11, 100",
+		"R, 2, 3",
+	})
+	status, ok := ob.Orders.GetOrderStatus(2, 3)
+	require.True(ok)
+	assert.Cmp(status.RejectReason, orderbook.SelfTradeRejectReason)
+	assert.Cmp(status.CumulativeQuantity, 100)
+	assert.Nil(ob.BidQueue.Peak())
+	assert.CmpNoError(ob.CheckInvariants())
+
+	// During an auction, an order crossing any order of the same user is rejected
+	process("S, IBM, AUCTION")
+	assert.Cmp(process("N, 2, IBM, 12, 10, B, 4"), []string{"R, 2, 4"})
+	assert.Cmp(process("N, 1, IBM, 12, 10, B, 4"), []string{"A, 1, 4", "B, B, 12, 10"})
+}
+
+func TestOrderBook_ProRata(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ob := orderbook.NewOrderBook(true)
+	ob.MatchingPolicy = orderbook.ProRataMatchingPolicy
+
+	_, err := ob.ProcessFromStringInstructions(`
+N, 1, IBM, 10, 100, S, 1
+N, 2, IBM, 10, 300, S, 2
+N, 4, IBM, 10, 100, S, 5
+N, 3, IBM, 10, 50, S, 3
+N, 3, IBM, 11, 50, S, 4
+`)
+	require.CmpNoError(err)
+
+	// 200 of 450 (the order of the same user doesn't take part): 44.4, 133.3 and 22.2,
+	// the lot left by the rounding goes to the oldest order
+	output, err := ob.ProcessInstruction("N, 4, IBM, 10, 200, B, 1")
+	require.CmpNoError(err)
+	assert.Cmp(output, []string{
+		"A, 4, 1",
+		"T, 4, 1, 1, 1, 10, 45",
+		"T, 4, 1, 2, 2, 10, 133",
+		"T, 4, 1, 3, 3, 10, 22",
+		"B, S, 10, 350",
+	})
+
+	// The level is totally filled but the order of the same user, which is skipped
+	output, err = ob.ProcessInstruction("N, 4, IBM, 11, 1000, B, 2")
+	require.CmpNoError(err)
+	assert.Cmp(output, []string{
+		"A, 4, 2",
+		"T, 4, 2, 1, 1, 10, 55",
+		"T, 4, 2, 2, 2, 10, 167",
+		"T, 4, 2, 3, 3, 10, 28",
+		"T, 4, 2, 3, 4, 11, 50",
+		"B, S, 10, 100",
+		"B, B, 11, 700",
+	})
+	assert.CmpNoError(ob.CheckInvariants())
+}
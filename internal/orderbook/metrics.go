@@ -0,0 +1,294 @@
+package orderbook
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds (in seconds) of the buckets of the instruction latency histogram.
+var LatencyBuckets = []float64{0.000001, 0.000005, 0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1}
+
+// Metrics is a registry of the metrics of order books, exposed in the Prometheus text format.
+// Each order book records its metrics in its own BookMetrics with atomic operations, so order books never
+// wait for each other nor for a scrape. A scrape sums the counters and the histograms of all the books.
+// It is goroutine-safe, so it can be shared by the order books of an engine and scraped over HTTP
+// while they process instructions.
+type Metrics struct {
+	mu    sync.Mutex // Guards the list of the books only
+	books []*BookMetrics
+}
+
+// BookMetrics records the metrics of one order book in a registry (see OrderBook.Metrics).
+// A nil BookMetrics records nothing.
+type BookMetrics struct {
+	book      string
+	symbols   sync.Map // Symbol => *symbolCounters
+	latencies sync.Map // Instruction type => *histogram
+	queues    map[string]*queueGauges
+}
+
+// symbolCounters are the counters of a symbol.
+type symbolCounters struct {
+	orders         atomic.Uint64
+	cancels        atomic.Uint64
+	rejects        atomic.Uint64
+	trades         atomic.Uint64
+	tradedQuantity atomic.Uint64
+}
+
+// queueGauges are the gauges of the queue of a side.
+type queueGauges struct {
+	restingOrders atomic.Int64
+	depth         atomic.Int64
+	priceLevels   atomic.Int64
+}
+
+// histogram counts observations by bucket (see LatencyBuckets).
+type histogram struct {
+	counts []atomic.Uint64 // Not cumulative, the last one is for +Inf
+	sum    atomic.Int64    // In nanoseconds
+}
+
+// NewMetrics creates an empty registry.
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// Book returns the recorder of the metrics of an order book, the name is the 'book' label of its queues.
+// The same recorder is returned for the same name.
+func (m *Metrics) Book(name string) *BookMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, bm := range m.books {
+		if bm.book == name {
+			return bm
+		}
+	}
+
+	bm := &BookMetrics{
+		book:   name,
+		queues: map[string]*queueGauges{"B": {}, "S": {}},
+	}
+	m.books = append(m.books, bm)
+
+	return bm
+}
+
+// counters returns the counters of a symbol.
+func (bm *BookMetrics) counters(symbol string) *symbolCounters {
+	if counters, ok := bm.symbols.Load(symbol); ok {
+		return counters.(*symbolCounters)
+	}
+
+	counters, _ := bm.symbols.LoadOrStore(symbol, &symbolCounters{})
+	return counters.(*symbolCounters)
+}
+
+// order counts a new or modify order.
+func (bm *BookMetrics) order(symbol string) {
+	if bm == nil {
+		return
+	}
+
+	bm.counters(symbol).orders.Add(1)
+}
+
+// cancel counts a cancelled order.
+func (bm *BookMetrics) cancel(symbol string) {
+	if bm == nil {
+		return
+	}
+
+	bm.counters(symbol).cancels.Add(1)
+}
+
+// reject counts a rejected order.
+func (bm *BookMetrics) reject(symbol string) {
+	if bm == nil {
+		return
+	}
+
+	bm.counters(symbol).rejects.Add(1)
+}
+
+// trade counts a trade and its quantity.
+func (bm *BookMetrics) trade(symbol string, quantity int) {
+	if bm == nil {
+		return
+	}
+
+	counters := bm.counters(symbol)
+	counters.trades.Add(1)
+	counters.tradedQuantity.Add(uint64(quantity))
+}
+
+// observe records the latency of an instruction and the state of the queues of the book after it.
+// The depth and the price levels are maintained by the queues, so nothing is scanned.
+func (bm *BookMetrics) observe(instructionType string, latency time.Duration, queues ...*OrderQueue) {
+	if bm == nil {
+		return
+	}
+
+	h, ok := bm.latencies.Load(instructionType)
+	if !ok {
+		h, _ = bm.latencies.LoadOrStore(instructionType, &histogram{counts: make([]atomic.Uint64, len(LatencyBuckets)+1)})
+	}
+	h.(*histogram).observe(latency)
+
+	for _, queue := range queues {
+		gauges := bm.queues[queue.OrderSide]
+		gauges.restingOrders.Store(int64(queue.Len()))
+		gauges.depth.Store(int64(queue.quantity))
+		gauges.priceLevels.Store(int64(queue.levels))
+	}
+}
+
+// observe adds an observation to the histogram.
+func (h *histogram) observe(latency time.Duration) {
+	i := sort.SearchFloat64s(LatencyBuckets, latency.Seconds())
+	h.counts[i].Add(1)
+	h.sum.Add(int64(latency))
+}
+
+// WriteTo writes all the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	books := append([]*BookMetrics(nil), m.books...)
+	m.mu.Unlock()
+
+	// Sum the counters and the histograms of all the books
+	counters := map[string]map[string]uint64{}
+	for _, name := range []string{"orders", "cancels", "rejects", "trades", "traded_quantity"} {
+		counters[name] = map[string]uint64{}
+	}
+	gauges := map[string]map[queueLabels]int64{"resting": {}, "depth": {}, "levels": {}}
+	latencies := map[string][]uint64{}
+	sums := map[string]time.Duration{}
+	for _, bm := range books {
+		bm.symbols.Range(func(key, value interface{}) bool {
+			symbol, c := key.(string), value.(*symbolCounters)
+			counters["orders"][symbol] += c.orders.Load()
+			counters["cancels"][symbol] += c.cancels.Load()
+			counters["rejects"][symbol] += c.rejects.Load()
+			counters["trades"][symbol] += c.trades.Load()
+			counters["traded_quantity"][symbol] += c.tradedQuantity.Load()
+			return true
+		})
+
+		for side, g := range bm.queues {
+			labels := queueLabels{book: bm.book, side: side}
+			gauges["resting"][labels] = g.restingOrders.Load()
+			gauges["depth"][labels] = g.depth.Load()
+			gauges["levels"][labels] = g.priceLevels.Load()
+		}
+
+		bm.latencies.Range(func(key, value interface{}) bool {
+			instructionType, h := key.(string), value.(*histogram)
+			if latencies[instructionType] == nil {
+				latencies[instructionType] = make([]uint64, len(h.counts))
+			}
+			for i := range h.counts {
+				latencies[instructionType][i] += h.counts[i].Load()
+			}
+			sums[instructionType] += time.Duration(h.sum.Load())
+			return true
+		})
+	}
+
+	var sb strings.Builder
+	writeSymbolCounter(&sb, "orderbook_orders_total", "Number of new or modify orders received.", counters["orders"])
+	writeSymbolCounter(&sb, "orderbook_cancels_total", "Number of cancelled orders.", counters["cancels"])
+	writeSymbolCounter(&sb, "orderbook_rejects_total", "Number of rejected orders.", counters["rejects"])
+	writeSymbolCounter(&sb, "orderbook_trades_total", "Number of trades.", counters["trades"])
+	writeSymbolCounter(&sb, "orderbook_traded_quantity_total", "Quantity traded.", counters["traded_quantity"])
+	writeQueueGauge(&sb, "orderbook_resting_orders", "Number of orders resting in a queue.", gauges["resting"])
+	writeQueueGauge(&sb, "orderbook_depth_quantity", "Total quantity of the orders resting in a queue.", gauges["depth"])
+	writeQueueGauge(&sb, "orderbook_price_levels", "Number of price levels of a queue.", gauges["levels"])
+
+	name := "orderbook_instruction_duration_seconds"
+	fmt.Fprintf(&sb, "# HELP %s Time to match an instruction by type.\n# TYPE %s histogram\n", name, name)
+	instructionTypes := make([]string, 0, len(latencies))
+	for instructionType := range latencies {
+		instructionTypes = append(instructionTypes, instructionType)
+	}
+	sort.Strings(instructionTypes)
+
+	for _, instructionType := range instructionTypes {
+		counts := latencies[instructionType]
+		labels := fmt.Sprintf("type=\"%s\"", escapeLabel(instructionType))
+
+		var cumulative uint64
+		for i, bound := range LatencyBuckets {
+			cumulative += counts[i]
+			fmt.Fprintf(&sb, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		cumulative += counts[len(LatencyBuckets)]
+		fmt.Fprintf(&sb, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, cumulative)
+		fmt.Fprintf(&sb, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(sums[instructionType].Seconds(), 'g', -1, 64))
+		fmt.Fprintf(&sb, "%s_count{%s} %d\n", name, labels, cumulative)
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+// ServeHTTP exposes the metrics, so the registry can be registered as the '/metrics' handler.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// writeSymbolCounter writes a counter by symbol.
+func writeSymbolCounter(sb *strings.Builder, name, help string, values map[string]uint64) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	symbols := make([]string, 0, len(values))
+	for symbol := range values {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	for _, symbol := range symbols {
+		fmt.Fprintf(sb, "%s{symbol=\"%s\"} %d\n", name, escapeLabel(symbol), values[symbol])
+	}
+}
+
+// queueLabels identifies the queue of an order book.
+type queueLabels struct {
+	book string
+	side string
+}
+
+// writeQueueGauge writes a gauge by order book and side.
+func writeQueueGauge(sb *strings.Builder, name, help string, values map[queueLabels]int64) {
+	labels := make([]queueLabels, 0, len(values))
+	for l := range values {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].book != labels[j].book {
+			return labels[i].book < labels[j].book
+		}
+		return labels[i].side < labels[j].side
+	})
+
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, l := range labels {
+		fmt.Fprintf(sb, "%s{book=\"%s\",side=\"%s\"} %d\n", name, escapeLabel(l.book), escapeLabel(l.side), values[l])
+	}
+}
+
+// labelReplacer escapes the characters which can't be in a label value.
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value for the Prometheus text format.
+func escapeLabel(value string) string {
+	return labelReplacer.Replace(value)
+}
@@ -0,0 +1,134 @@
+package orderbook_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestMetrics(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	metrics := orderbook.NewMetrics()
+	process := func(ob *orderbook.OrderBook, instructions string) {
+		_, err := ob.ProcessFromStringInstructions(instructions)
+		require.CmpNoError(err)
+	}
+
+	// One symbol per order book, as orders of all the symbols of a book are in the same queues
+	ibm := orderbook.NewOrderBook(false)
+	ibm.Metrics = metrics.Book("main")
+	process(ibm, `
+N, 1, IBM, 10, 100, B, 1
+N, 1, IBM, 12, 100, S, 2
+N, 2, IBM, 9, 50, B, 3
+N, 3, IBM, 10, 10, S, 5
+C, 2, 3
+`)
+	ibm.ShouldTrade = true
+	process(ibm, "N, 3, IBM, 12, 40, B, 6")
+
+	escaped := orderbook.NewOrderBook(true)
+	escaped.Metrics = metrics.Book(`"A\B"`)
+	process(escaped, `
+N, 2, "A\B", 11, 50, B, 4
+N, 4, "A\B", 11, 20, S, 7
+`)
+
+	// Counters of a symbol are summed over the order books
+	other := orderbook.NewOrderBook(true)
+	other.Metrics = metrics.Book("other")
+	process(other, "N, 5, IBM, 20, 10, S, 8")
+
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.CmpNoError(err)
+	defer resp.Body.Close()
+	assert.Cmp(resp.Header.Get("Content-Type"), td.HasPrefix("text/plain; version=0.0.4"))
+
+	body, err := io.ReadAll(resp.Body)
+	require.CmpNoError(err)
+	lines := strings.Split(string(body), "\n")
+
+	assert.Cmp(lines, td.SuperBagOf(
+		`# TYPE orderbook_orders_total counter`,
+		`orderbook_orders_total{symbol="IBM"} 6`,
+		`orderbook_orders_total{symbol="\"A\\B\""} 2`,
+		`orderbook_cancels_total{symbol="IBM"} 1`,
+		`orderbook_rejects_total{symbol="IBM"} 1`,
+		`orderbook_trades_total{symbol="IBM"} 1`,
+		`orderbook_traded_quantity_total{symbol="IBM"} 40`,
+		`orderbook_trades_total{symbol="\"A\\B\""} 1`,
+		`orderbook_traded_quantity_total{symbol="\"A\\B\""} 20`,
+		`# TYPE orderbook_resting_orders gauge`,
+		`orderbook_resting_orders{book="main",side="B"} 1`,
+		`orderbook_resting_orders{book="main",side="S"} 1`,
+		`orderbook_resting_orders{book="other",side="S"} 1`,
+		`orderbook_depth_quantity{book="main",side="B"} 100`,
+		`orderbook_depth_quantity{book="main",side="S"} 60`,
+		`orderbook_depth_quantity{book="\"A\\B\"",side="B"} 30`,
+		`orderbook_price_levels{book="main",side="B"} 1`,
+		`orderbook_price_levels{book="\"A\\B\"",side="S"} 0`,
+		`# TYPE orderbook_instruction_duration_seconds histogram`,
+		`orderbook_instruction_duration_seconds_bucket{type="N",le="+Inf"} 8`,
+		`orderbook_instruction_duration_seconds_count{type="N"} 8`,
+		`orderbook_instruction_duration_seconds_count{type="C"} 1`,
+	))
+}
+
+// TestMetrics_Concurrency must be run with the race detector.
+func TestMetrics_Concurrency(t *testing.T) {
+	assert := td.Assert(t)
+
+	metrics := orderbook.NewMetrics()
+	var wg sync.WaitGroup
+	for _, symbol := range []string{"IBM", "AAPL"} {
+		wg.Add(1)
+		go func(symbol string) {
+			defer wg.Done()
+			ob := orderbook.NewOrderBook(true)
+			ob.Metrics = metrics.Book(symbol)
+			for i := 1; i <= 100; i++ {
+				if _, err := ob.ProcessInstruction(fmt.Sprintf("N, %d, %s, %d, 10, B, %d", i%3, symbol, 90+i%20, i)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(symbol)
+	}
+
+	// The metrics are scraped while the order books process instructions
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for scraping := true; scraping; {
+		select {
+		case <-done:
+			scraping = false
+		default:
+		}
+		_, err := metrics.WriteTo(io.Discard)
+		assert.CmpNoError(err)
+	}
+
+	var sb strings.Builder
+	_, err := metrics.WriteTo(&sb)
+	assert.CmpNoError(err)
+	assert.Cmp(strings.Split(sb.String(), "\n"), td.SuperBagOf(
+		`orderbook_orders_total{symbol="IBM"} 100`,
+		`orderbook_orders_total{symbol="AAPL"} 100`,
+		`orderbook_instruction_duration_seconds_count{type="N"} 200`,
+	))
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Order is the main structure to represents an order
@@ -14,19 +15,22 @@ type Order struct {
 	Quantity    int
 	UserOrderId int
 	OrderSide   string
+	TimeInForce string    // 'D' (DAY, expired at close) or 'G' (Good Till Cancel)
+	ReceivedAt  time.Time // Time the order book received the order (set when it is processed)
 
 	index int // It will be used by the priority queue
-	time  int // To track which order is the oldest
+	time  int // To track which order is the oldest (receive times can be equal)
 }
 
 // Create a new order from a string.
-// Instruction should be: N, user(int),symbol(string),price(int),qty(int),side(char B or S),userOrderId(int).
+// Instruction should be: N, user(int),symbol(string),price(int),qty(int),side(char B or S),userOrderId(int)
+// with an optional timeInForce(char D or G, D by default).
 // It returns an error if it can't parse the string.
 func NewOrderFromInstruction(instruction string) (*Order, error) {
 	params := strings.Split(instruction, ",")
-	if len(params) != 7 {
+	if len(params) != 7 && len(params) != 8 {
 		return nil,
-			fmt.Errorf("Can't create new order from instruction as it has less than 7 parameters: %q", instruction)
+			fmt.Errorf("Can't create new order from instruction as it has not 7 or 8 parameters: %q", instruction)
 	}
 
 	user, err := strconv.Atoi(params[1])
@@ -56,6 +60,14 @@ func NewOrderFromInstruction(instruction string) (*Order, error) {
 		return nil, err
 	}
 
+	timeInForce := "D"
+	if len(params) == 8 {
+		timeInForce = params[7]
+		if timeInForce != "D" && timeInForce != "G" {
+			return nil, fmt.Errorf("Unknown time in force for order: %q", timeInForce)
+		}
+	}
+
 	return &Order{
 		User:        user,
 		Symbol:      symbole,
@@ -63,6 +75,7 @@ func NewOrderFromInstruction(instruction string) (*Order, error) {
 		Quantity:    quantity,
 		OrderSide:   side,
 		UserOrderId: userOrderId,
+		TimeInForce: timeInForce,
 	}, nil
 }
 
@@ -70,3 +83,14 @@ func NewOrderFromInstruction(instruction string) (*Order, error) {
 func (o *Order) GetIdentifier() string {
 	return fmt.Sprintf("%d-%d", o.User, o.UserOrderId)
 }
+
+// Instruction returns the 'N' instruction which creates (or modifies) the order.
+func (o *Order) Instruction() string {
+	timeInForce := o.TimeInForce
+	if timeInForce == "" {
+		timeInForce = "D"
+	}
+
+	return fmt.Sprintf("N, %d, %s, %d, %d, %s, %d, %s",
+		o.User, o.Symbol, o.Price, o.Quantity, o.OrderSide, o.UserOrderId, timeInForce)
+}
@@ -4,221 +4,1036 @@ import (
 	"bufio"
 	"container/heap"
 	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // OrderBook is the main structure that represents the order book.
 // It contains 2 queues (one for ask and one for bid), a boolean to indicate
 // to trade or to reject orders that cross the book.
+// It keeps as well the positions of the users and can reject orders that would
+// make a position exceed 'MaxPosition' (0 means no limit).
+// Each symbol has a trading state, a symbol can be halted by the volatility 'Guard' (if any)
+// and new orders on a halted symbol are rejected or queued depending of the 'HaltPolicy'.
 type OrderBook struct {
 	AskQueue    *OrderQueue
 	BidQueue    *OrderQueue
 	ShouldTrade bool
+	MaxPosition int
+	Positions   *PositionKeeper
+	Clock       Clock
+	Guard       *VolatilityGuard
+	HaltPolicy  HaltPolicy
+	Journal     *Journal // If not nil, every accepted instruction is appended to it before being processed
+	Orders      *OrderStore
+	// If true, each trade output is followed by the execution report of each party (see processTrade)
+	ExecutionReports bool
+	TradeListeners   []TradeListener // Notified of each trade, in order
+	Metrics          *BookMetrics    // If not nil, metrics of the instructions and of the queues are recorded
+	Audit            *AuditLog       // If not nil, every instruction is recorded with the decisions made
+	Fees             *FeeEngine      // If not nil, the fees of both sides of each trade are computed
+	Accounts         *AccountService // If not nil, orders reserve the funds of their user (see AccountService)
+	MatchingPolicy   MatchingPolicy
+	// What happens when an order reaches an order of the same user (orders of a user never match each other)
+	SelfTradePrevention SelfTradePrevention
 
-	// For cancel, we store only if an order is a buy one (if not it is a sell by default)
-	// to consume less memory
-	// As well using an empty struct consumes less memory
-	mapOrderIsBuy map[string]struct{}
+	symbolStatuses map[string]*symbolStatus
+	now            time.Time    // Time of the instruction being processed
+	audit          *auditRecord // Record of the instruction being processed (if there is an audit log)
+	lastTradeID    int
+	lastSequence   uint64
+}
+
+// SequencedOutput is an output of the order book with its sequence number and its time.
+// Sequence numbers are consecutive (starting at 1) for all the outputs of the order book, so a consumer
+// can detect a gap or a duplicate. The time is the one of the instruction which produced the output
+// (given by the clock). The trade ID is set for trade outputs only.
+type SequencedOutput struct {
+	Sequence uint64
+	Time     time.Time
+	TradeID  int
+	Output   string
 }
 
 // NewOrderBook create an order book that will be able to trade or not depending of
 // the given 'shouldTrade'
 func NewOrderBook(shouldTrade bool) *OrderBook {
 	return &OrderBook{
-		AskQueue:      NewOrderQueue(AskOrderType),
-		BidQueue:      NewOrderQueue(BidOrderType),
-		ShouldTrade:   shouldTrade,
-		mapOrderIsBuy: map[string]struct{}{},
+		AskQueue:       NewOrderQueue(AskOrderType),
+		BidQueue:       NewOrderQueue(BidOrderType),
+		ShouldTrade:    shouldTrade,
+		Positions:      NewPositionKeeper(),
+		Orders:         NewOrderStore(DefaultTerminalOrders),
+		Clock:          SystemClock{},
+		symbolStatuses: map[string]*symbolStatus{},
 	}
 }
 
 // ProcessFromStringInstructions processes all the instructions until a Flush message.
 // Then it returns all the output of the given instructions.
-// It can process 3 types of instruction: 'N' (New or Modify), 'C' (Cancel) and 'F' (Flush).
 func (ob *OrderBook) ProcessFromStringInstructions(instructions string) (string, error) {
 	var result []string
 
 	scanner := bufio.NewScanner(strings.NewReader(instructions))
-L:
 	for scanner.Scan() {
 		instruction := strings.Replace(scanner.Text(), " ", "", -1)
 		if instruction == "" {
 			continue
 		}
 
-		switch instruction[0] {
-		case 'N':
-			order, err := NewOrderFromInstruction(instruction)
-			if err != nil {
-				return "", err
+		if instruction[0] == 'F' {
+			break
+		}
+
+		output, err := ob.ProcessInstruction(instruction)
+		if err != nil {
+			return "", err
+		}
+		result = append(result, output...)
+	}
+
+	return strings.Join(result, "\n"), nil
+}
+
+// ProcessInstruction processes one instruction and returns its outputs (see ProcessSequencedInstruction).
+func (ob *OrderBook) ProcessInstruction(instruction string) ([]string, error) {
+	outputs, err := ob.ProcessSequencedInstruction(instruction)
+	if err != nil {
+		return nil, err
+	}
+
+	return outputLines(outputs), nil
+}
+
+// ProcessSequencedInstruction processes one instruction and returns its outputs with their sequence number.
+// It can process 7 types of instruction: 'N' (New or Modify), 'C' (Cancel), 'M' (Mass cancel),
+// 'S' (trading State change), 'D' and 'W' (Deposit and Withdrawal, see Transfer) and 'F' (Flush).
+// Once parsed, the instruction is appended to the journal (if any) with the time of the clock,
+// so that the same outputs, sequence numbers and trade IDs can be produced by replaying it.
+// Before processing the instruction, halts that reached their end are resumed.
+func (ob *OrderBook) ProcessSequencedInstruction(instruction string) ([]SequencedOutput, error) {
+	instruction = strings.Replace(instruction, " ", "", -1)
+	if instruction == "" {
+		return nil, nil
+	}
+
+	process, revert, parsed, err := ob.parseInstruction(instruction)
+	if err != nil {
+		ob.Audit.invalid(ob.Clock.Now(), instruction, err)
+		return nil, err
+	}
+
+	ob.now = ob.Clock.Now()
+	if ob.Journal != nil {
+		if err := ob.Journal.Append(JournalEntry{Time: ob.now, Instruction: instruction}); err != nil {
+			if revert != nil {
+				revert()
 			}
+			ob.Audit.invalid(ob.now, instruction, err)
+			return nil, err
+		}
+	}
+
+	// Only the matching is timed, not the journal nor the audit log
+	ob.audit = ob.Audit.begin(ob)
+	start := time.Now()
+	outputs := ob.resumeExpiredHalts()
+	outputs = append(outputs, process()...)
+	ob.Metrics.observe(instruction[:1], time.Since(start), ob.BidQueue, ob.AskQueue)
+	ob.Audit.end(ob, ob.audit, "Instruction processed", instruction, parsed, outputLines(outputs))
+	ob.audit = nil
+
+	for i := range outputs {
+		ob.lastSequence++
+		outputs[i].Sequence = ob.lastSequence
+		outputs[i].Time = ob.now
+	}
+
+	return outputs, nil
+}
+
+// outputsOf returns outputs which don't publish a trade, to be sequenced once the instruction is processed.
+func outputsOf(lines ...string) []SequencedOutput {
+	outputs := make([]SequencedOutput, len(lines))
+	for i, line := range lines {
+		outputs[i].Output = line
+	}
+
+	return outputs
+}
+
+// outputLines returns the lines of the outputs.
+func outputLines(outputs []SequencedOutput) []string {
+	lines := make([]string, len(outputs))
+	for i, output := range outputs {
+		lines[i] = output.Output
+	}
+
+	return lines
+}
+
+// parseInstruction parses an instruction and returns the function which processes it,
+// the function which reverts what was already applied (if any) and its parsed fields (for the audit log).
+func (ob *OrderBook) parseInstruction(instruction string) (process func() []SequencedOutput, revert func(), parsed slog.Attr, err error) {
+	switch instruction[0] {
+	case 'N':
+		order, err := NewOrderFromInstruction(instruction)
+		if err != nil {
+			return nil, nil, slog.Attr{}, err
+		}
+
+		parsed = slog.Any("Order", *order) // A copy, as the quantity changes when the order trades
+		process = func() []SequencedOutput {
+			order.ReceivedAt = ob.now
+			ob.Metrics.order(order.Symbol)
+			return ob.processNewOrModifyOrder(order)
+		}
+
+	case 'C':
+		cancelOrder, err := NewCancelOrderFromInstruction(instruction)
+		if err != nil {
+			return nil, nil, slog.Attr{}, err
+		}
 
-			result = append(result, ob.processNewOrModifyOrder(order)...)
+		parsed = slog.Any("Cancel", *cancelOrder)
+		process = func() []SequencedOutput { return ob.processCancelOrder(cancelOrder) }
 
-		case 'C':
-			cancelOrder, err := NewCancelOrderFromInstruction(instruction)
-			if err != nil {
-				return "", err
+	case 'M':
+		massCancel, err := NewMassCancelFromInstruction(instruction)
+		if err != nil {
+			return nil, nil, slog.Attr{}, err
+		}
+
+		parsed = slog.Any("MassCancel", *massCancel)
+		process = func() []SequencedOutput { return ob.processMassCancel(massCancel) }
+
+	case 'S':
+		stateChange, err := NewStateChangeFromInstruction(instruction)
+		if err != nil {
+			return nil, nil, slog.Attr{}, err
+		}
+
+		parsed = slog.Group("StateChange", "Symbol", stateChange.Symbol, "State", stateChange.State.String(),
+			"Phase", stateChange.Phase)
+		process = func() []SequencedOutput {
+			var result []SequencedOutput
+			if stateChange.Phase != "" {
+				result = append(result, outputsOf(ob.generatePhaseChangeOutput(stateChange.Symbol, stateChange.Phase))...)
 			}
+			return append(result, ob.setTradingState(stateChange.Symbol, stateChange.State)...)
+		}
 
-			result = append(result, ob.processCancelOrder(cancelOrder)...)
+	case 'D', 'W':
+		transfer, err := NewTransferFromInstruction(instruction)
+		if err != nil {
+			return nil, nil, slog.Attr{}, err
+		}
 
-		case 'F':
-			break L
+		// Applied before the instruction is journaled (and reverted if it can't be),
+		// so that only applied transfers are replayed. A transfer has no output.
+		if err := ob.applyTransfer(transfer); err != nil {
+			return nil, nil, slog.Attr{}, err
+		}
 
-		default:
-			return "", fmt.Errorf("Unknown transaction type: %q", string(instruction[0]))
+		parsed = slog.Any("Transfer", *transfer)
+		process = func() []SequencedOutput { return nil }
+		revert = func() { ob.revertTransfer(transfer) }
+
+	case 'F':
+		process = func() []SequencedOutput {
+			ob.Flush()
+			return nil
 		}
+
+	default:
+		return nil, nil, slog.Attr{}, fmt.Errorf("Unknown transaction type: %q", string(instruction[0]))
 	}
 
-	return strings.Join(result, "\n"), nil
+	return process, revert, parsed, nil
+}
+
+// LastSequence returns the sequence number of the last output of the order book (0 if none).
+func (ob *OrderBook) LastSequence() uint64 {
+	return ob.lastSequence
 }
 
 // processNewOrModifyOrder processes a NewOrModify order.
 // It adds the order to the given queue depending of its side.
 // If orders cross the book, it creates a Reject or Trade output depending if the
-// order book can trade or not
-func (ob *OrderBook) processNewOrModifyOrder(order *Order) []string {
-	var queue, queueToCompare *OrderQueue
-
-	isBuy := order.OrderSide == "B"
-	if isBuy {
-		queue = ob.BidQueue
-		queueToCompare = ob.AskQueue
-	} else {
-		queue = ob.AskQueue
-		queueToCompare = ob.BidQueue
+// order book can trade or not.
+// If the symbol is not trading, the order is rejected or queued (see 'HaltPolicy').
+// If an order with the same identifier is resting in the book, it is modified.
+// An accepted order reserves the funds of its user, it is rejected if they are insufficient.
+func (ob *OrderBook) processNewOrModifyOrder(order *Order) []SequencedOutput {
+	// As in instructions, an order without time in force is a DAY order
+	if order.TimeInForce == "" {
+		order.TimeInForce = "D"
 	}
 
-	// Check if the book is crossed
-	orderToCompare := queueToCompare.Peak()
-	if orderToCompare != nil &&
-		orderToCompare.User != order.User &&
-		((isBuy && (order.Price >= orderToCompare.Price)) || (!isBuy && (order.Price <= orderToCompare.Price))) {
-		if ob.ShouldTrade {
-			// Generate acknoledgement output
-			result := []string{ob.generateAcknowledgmentOutput(order)}
+	if existing, queue := ob.findOrder(order.GetIdentifier()); existing != nil {
+		return ob.processModifyOrder(existing, queue, order)
+	}
 
-			// Generate trade output
-			return append(result, ob.generateTrade(order, queue, queueToCompare)...)
+	// As resting orders, queued orders can't be modified during a halt
+	if status, _ := ob.findQueuedOrder(order.GetIdentifier()); status != nil {
+		return outputsOf(ob.rejectModify(order, SymbolHaltedRejectReason))
+	}
+
+	if order.Quantity <= 0 {
+		return outputsOf(ob.rejectOrder(order, InvalidQuantityRejectReason))
+	}
 
-		} else {
-			// Generate a reject output
-			return []string{ob.generateRejectOutput(order)}
+	switch status := ob.getSymbolStatus(order.Symbol); status.state {
+	case HaltedTradingState:
+		if ob.HaltPolicy == QueueHaltPolicy {
+			if !ob.Accounts.tryReserve(order) {
+				return outputsOf(ob.rejectOrder(order, InsufficientFundsRejectReason))
+			}
+			status.queuedOrders = append(status.queuedOrders, order)
+			output := ob.acceptOrder(order)
+			ob.audit.order("QUEUE", order)
+			return outputsOf(output)
 		}
+		return outputsOf(ob.rejectOrder(order, SymbolHaltedRejectReason))
+
+	case ClosedTradingState, PreOpenTradingState:
+		return outputsOf(ob.rejectOrder(order, rejectReasonOfState(status.state)))
+
+	case AuctionTradingState:
+		return ob.processAuctionOrder(order)
+	}
+
+	if reason := ob.rejectReason(order); reason != NoRejectReason {
+		return outputsOf(ob.rejectOrder(order, reason))
+	}
+
+	if !ob.Accounts.tryReserve(order) {
+		return outputsOf(ob.rejectOrder(order, InsufficientFundsRejectReason))
+	}
+
+	// Generate acknoledgement output
+	result := outputsOf(ob.acceptOrder(order))
+
+	return append(result, ob.placeOrder(order)...)
+}
+
+// processModifyOrder modifies a resting order with the NewOrModify order which has the same identifier.
+// Reducing the quantity at the same price keeps the priority of the order, else the resting order
+// is replaced by the new one (which loses its priority and can trade).
+// An order can't change of side or symbol, and it can be modified only if the symbol is in continuous
+// trading or in auction. If the modification is rejected, the resting order is kept.
+func (ob *OrderBook) processModifyOrder(existing *Order, queue *OrderQueue, order *Order) []SequencedOutput {
+	state := ob.getSymbolStatus(order.Symbol).state
+	if reason := modifyRejectReason(existing, order, state); reason != NoRejectReason {
+		return outputsOf(ob.rejectModify(order, reason))
 	}
 
 	// To check if the TOB changes
 	oldTOB := queue.GetTOBInfo()
 
-	heap.Push(queue, order)
+	if order.Price == existing.Price && order.Quantity <= existing.Quantity {
+		reduced := existing.Quantity - order.Quantity
+		queue.fill(existing, reduced)
+		ob.Positions.addExposure(existing, -reduced)
+		ob.Accounts.release(existing, reduced)
+		existing.TimeInForce = order.TimeInForce
+		ob.Orders.modify(existing)
+		ob.audit.order("ACK", order)
 
-	if isBuy {
-		// To easily know if a given order is a Sell or a Buy
-		ob.mapOrderIsBuy[order.GetIdentifier()] = struct{}{}
+		result := outputsOf(ob.generateAcknowledgmentOutput(order))
+		if oldTOB != queue.GetTOBInfo() {
+			result = append(result, outputsOf(ob.generateTopOfBookChangeOutput(queue))...)
+		}
+		return result
+	}
+
+	// The exposure of the resting order is replaced by the new one for the position limit
+	ob.Positions.addExposure(existing, -existing.Quantity)
+	reason := NoRejectReason
+	if state == ContinuousTradingState {
+		reason = ob.rejectReason(order)
+	} else {
+		reason = ob.auctionRejectReason(order)
+	}
+	if reason == NoRejectReason && !ob.Accounts.tryReplace(existing, order) {
+		reason = InsufficientFundsRejectReason
+	}
+	if reason != NoRejectReason {
+		ob.Positions.addExposure(existing, existing.Quantity)
+		return outputsOf(ob.rejectModify(order, reason))
+	}
+
+	queue.Delete(existing.GetIdentifier())
+	ob.Orders.modify(order)
+	ob.audit.order("ACK", order)
+
+	var output []SequencedOutput
+	if state == AuctionTradingState {
+		output = ob.restAuctionOrder(order)
+	} else {
+		output = ob.placeOrder(order)
+	}
+
+	// The TOB may have changed only because the resting order was removed
+	tobOutput := ob.generateTopOfBookChangeOutput(queue)
+	if oldTOB != queue.GetTOBInfo() && !containsString(outputLines(output), tobOutput) {
+		output = append(output, outputsOf(tobOutput)...)
+	}
+
+	return append(outputsOf(ob.generateAcknowledgmentOutput(order)), output...)
+}
+
+// modifyRejectReason returns the reason to reject a modification whatever the state of the book
+// (NoRejectReason if it can be applied).
+func modifyRejectReason(existing, order *Order, state TradingState) RejectReason {
+	switch {
+	case existing.OrderSide != order.OrderSide || existing.Symbol != order.Symbol:
+		return ModifyMismatchRejectReason
+	case order.Quantity <= 0:
+		return InvalidQuantityRejectReason
+	case state != ContinuousTradingState && state != AuctionTradingState:
+		return rejectReasonOfState(state)
+	}
+
+	return NoRejectReason
+}
+
+// findOrder returns a resting order and its queue (nil if not found).
+func (ob *OrderBook) findOrder(identifier string) (*Order, *OrderQueue) {
+	for _, queue := range []*OrderQueue{ob.BidQueue, ob.AskQueue} {
+		if order, ok := queue.mapSearchByIdentifier[identifier]; ok {
+			return order, queue
+		}
+	}
+
+	return nil, nil
+}
+
+// isLive indicates if an order is resting in the book or queued during a halt.
+func (ob *OrderBook) isLive(identifier string) bool {
+	if order, _ := ob.findOrder(identifier); order != nil {
+		return true
+	}
+
+	status, _ := ob.findQueuedOrder(identifier)
+	return status != nil
+}
+
+// containsString indicates if the slice contains the string.
+func containsString(slice []string, s string) bool {
+	for _, x := range slice {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// processAuctionOrder processes a NewOrModify order during a call auction.
+// The order is never matched, so it can cross the book, until the auction is uncrossed.
+func (ob *OrderBook) processAuctionOrder(order *Order) []SequencedOutput {
+	if reason := ob.auctionRejectReason(order); reason != NoRejectReason {
+		return outputsOf(ob.rejectOrder(order, reason))
+	}
+
+	if !ob.Accounts.tryReserve(order) {
+		return outputsOf(ob.rejectOrder(order, InsufficientFundsRejectReason))
 	}
 
 	// Generate acknoledgement output
-	result := []string{ob.generateAcknowledgmentOutput(order)}
+	result := outputsOf(ob.acceptOrder(order))
+
+	return append(result, ob.restAuctionOrder(order)...)
+}
+
+// restAuctionOrder puts the order in its queue without matching it.
+func (ob *OrderBook) restAuctionOrder(order *Order) []SequencedOutput {
+	queue, _ := ob.getQueues(order)
+
+	// To check if the TOB changes
+	oldTOB := queue.GetTOBInfo()
+
+	ob.restOrder(queue, order)
 
 	// If the TOB is modified, generate a change of TOB
 	if oldTOB != queue.GetTOBInfo() {
-		result = append(result, ob.generateTopOfBookChangeOutput(queue))
+		return outputsOf(ob.generateTopOfBookChangeOutput(queue))
 	}
 
-	return result
+	return nil
+}
+
+// rejectReason returns the reason to reject an order in continuous trading because of the position limit
+// of the user, because it crosses the top of the book which is an order of the same user (with
+// CancelNewestSelfTradePrevention) or because it crosses the book and the order book can't trade (NoRejectReason if it is accepted).
+func (ob *OrderBook) rejectReason(order *Order) RejectReason {
+	if ob.exceedsPositionLimit(order) {
+		return PositionLimitRejectReason
+	}
+
+	_, queueToCompare := ob.getQueues(order)
+	if top := queueToCompare.Peak(); ob.SelfTradePrevention == CancelNewestSelfTradePrevention &&
+		top != nil && isSelfTrade(order, top) && crosses(order, top) {
+		return SelfTradeRejectReason
+	}
+
+	if !ob.ShouldTrade && ob.crossesBook(order, queueToCompare) {
+		return CrossesBookRejectReason
+	}
+
+	return NoRejectReason
+}
+
+// auctionRejectReason returns the reason to reject an order during an auction because of the position limit
+// of the user or because it crosses any order of the same user (with CancelNewestSelfTradePrevention, so that
+// the book is not crossed after the uncross) (NoRejectReason if it is accepted).
+func (ob *OrderBook) auctionRejectReason(order *Order) RejectReason {
+	if ob.exceedsPositionLimit(order) {
+		return PositionLimitRejectReason
+	}
+
+	if ob.SelfTradePrevention == CancelNewestSelfTradePrevention && ob.crossesOwnOrder(order) {
+		return SelfTradeRejectReason
+	}
+
+	return NoRejectReason
+}
+
+// exceedsPositionLimit checks the position limit of the user.
+func (ob *OrderBook) exceedsPositionLimit(order *Order) bool {
+	return ob.MaxPosition > 0 && ob.Positions.ExceedsLimit(order, ob.MaxPosition)
+}
+
+// placeOrder trades the order if it crosses the book, else it puts it in its queue.
+func (ob *OrderBook) placeOrder(order *Order) []SequencedOutput {
+	queue, queueToCompare := ob.getQueues(order)
+
+	// Check if the book is crossed
+	if ob.crossesBook(order, queueToCompare) {
+		// Generate trade output
+		return ob.generateTrade(order, queue, queueToCompare)
+	}
+
+	// To check if the TOB changes
+	oldTOB := queue.GetTOBInfo()
+
+	ob.restOrder(queue, order)
+
+	// If the TOB is modified, generate a change of TOB
+	if oldTOB != queue.GetTOBInfo() {
+		return outputsOf(ob.generateTopOfBookChangeOutput(queue))
+	}
+
+	return nil
+}
+
+// getQueues returns the queue of the order and the opposite queue.
+func (ob *OrderBook) getQueues(order *Order) (queue, queueToCompare *OrderQueue) {
+	if order.OrderSide == "B" {
+		return ob.BidQueue, ob.AskQueue
+	}
+
+	return ob.AskQueue, ob.BidQueue
+}
+
+// crossesBook indicates if the order crosses an order it can match in the opposite queue (see 'matchingOrder').
+func (ob *OrderBook) crossesBook(order *Order, queueToCompare *OrderQueue) bool {
+	return ob.matchingOrder(order, queueToCompare) != nil
+}
+
+// matchingOrder returns the next order of the opposite queue the order matches, nil if there is none.
+// It is the top of the queue, unless the top is an order of the same user: the matching stops with
+// CancelNewestSelfTradePrevention, else the orders of the user are skipped and the best order of another
+// user crossing the order is returned (all the orders of the queue are walked).
+func (ob *OrderBook) matchingOrder(order *Order, queueToCompare *OrderQueue) *Order {
+	top := queueToCompare.Peak()
+	if top == nil || !crosses(order, top) {
+		return nil
+	}
+
+	if top.User != order.User {
+		return top
+	}
+	if ob.SelfTradePrevention != NoSelfTradePrevention {
+		return nil
+	}
+
+	return queueToCompare.bestOrderCrossing(order)
+}
+
+// crossesOwnOrder indicates if the order crosses an order of the same user and symbol on the opposite side.
+func (ob *OrderBook) crossesOwnOrder(order *Order) bool {
+	_, queueToCompare := ob.getQueues(order)
+	for _, orderToCompare := range queueToCompare.mapUserToOrders[order.User] {
+		if isSelfTrade(order, orderToCompare) && crosses(order, orderToCompare) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSelfTrade indicates if both orders are orders of the same user and symbol.
+func isSelfTrade(order, orderToCompare *Order) bool {
+	return order.User == orderToCompare.User && order.Symbol == orderToCompare.Symbol
+}
+
+// crosses indicates if the price of an order crosses the price of an order of the opposite side.
+func crosses(order, orderToCompare *Order) bool {
+	if order.OrderSide == "B" {
+		return order.Price >= orderToCompare.Price
+	}
+
+	return order.Price <= orderToCompare.Price
+}
+
+// restOrder puts the order in its queue.
+func (ob *OrderBook) restOrder(queue *OrderQueue, order *Order) {
+	heap.Push(queue, order)
+	ob.Positions.addExposure(order, order.Quantity)
+	ob.audit.order("REST", order)
 }
 
 // processCancelOrder processes a cancel order.
 // It removes the given order on the queue, and then check if the TOB changes.
 // If it changes, it publishes a TOB change output
-func (ob *OrderBook) processCancelOrder(cancelOrder *CancelOrder) []string {
+func (ob *OrderBook) processCancelOrder(cancelOrder *CancelOrder) []SequencedOutput {
 	identifier := cancelOrder.GetIdentifier()
-	// Get the side
-	var queue *OrderQueue
-	if _, ok := ob.mapOrderIsBuy[identifier]; ok {
-		queue = ob.BidQueue
-	} else {
-		queue = ob.AskQueue
+	order, queue := ob.findOrder(identifier)
+	if order == nil {
+		// The order may wait for the end of a halt
+		if order = ob.removeQueuedOrder(identifier); order != nil {
+			ob.Accounts.release(order, order.Quantity)
+			ob.Orders.cancel(order)
+			ob.Metrics.cancel(order.Symbol)
+			ob.audit.order("CANCEL", order)
+			return outputsOf(ob.generateAcknowledgmentOutput(order))
+		}
+		return nil
 	}
 
 	// To check if the TOB changes
 	oldTOB := queue.GetTOBInfo()
 
 	// Remove order
-	order := queue.Delete(identifier)
-	if order == nil {
-		return nil
-	}
+	queue.Delete(identifier)
+	ob.Positions.addExposure(order, -order.Quantity)
+	ob.Accounts.release(order, order.Quantity)
+	ob.Orders.cancel(order)
+	ob.Metrics.cancel(order.Symbol)
+	ob.audit.order("CANCEL", order)
 
 	// Acknowledge
-	result := []string{ob.generateAcknowledgmentOutput(order)}
+	result := outputsOf(ob.generateAcknowledgmentOutput(order))
 
 	// If TOB changes, generate a TOB change output
 	if oldTOB != queue.GetTOBInfo() {
-		result = append(result, ob.generateTopOfBookChangeOutput(queue))
+		result = append(result, outputsOf(ob.generateTopOfBookChangeOutput(queue))...)
 	}
 
 	return result
 }
 
-// Flush cleans all the order book
+// Flush cleans all the order book, the reservations of its orders are released.
 func (ob *OrderBook) Flush() {
+	ob.releaseReservations()
 	ob.BidQueue = NewOrderQueue(BidOrderType)
 	ob.AskQueue = NewOrderQueue(AskOrderType)
-	ob.mapOrderIsBuy = map[string]struct{}{}
+	ob.Positions.clearExposures()
+	ob.Orders.clear()
+	ob.symbolStatuses = map[string]*symbolStatus{}
+	if ob.Guard != nil {
+		ob.Guard.Reset()
+	}
+}
+
+// releaseReservations releases the funds reserved by the live orders (resting or queued during a halt).
+func (ob *OrderBook) releaseReservations() {
+	if ob.Accounts == nil {
+		return
+	}
+
+	for _, order := range ob.liveOrders() {
+		ob.Accounts.release(order, order.Quantity)
+	}
+}
+
+// liveOrders returns the orders resting in the book or queued during a halt.
+func (ob *OrderBook) liveOrders() []*Order {
+	orders := append(ob.BidQueue.Orders(), ob.AskQueue.Orders()...)
+	for _, status := range ob.symbolStatuses {
+		orders = append(orders, status.queuedOrders...)
+	}
+
+	return orders
+}
+
+// String returns the state of the book: the orders of both queues by priority
+// and the symbols which are not in continuous trading.
+func (ob *OrderBook) String() string {
+	var sb strings.Builder
+	for _, queue := range []*OrderQueue{ob.AskQueue, ob.BidQueue} {
+		fmt.Fprintf(&sb, "%s queue (%s):\n", queue.OrderSide, queue.GetTOBInfo())
+		for _, o := range queue.Orders() {
+			fmt.Fprintf(&sb, "  %s, %d, %d, %s (%s)\n", o.Symbol, o.Price, o.Quantity, o.GetIdentifier(), o.TimeInForce)
+		}
+	}
+
+	var symbols []string
+	for symbol, status := range ob.symbolStatuses {
+		if status.state != ContinuousTradingState || len(status.queuedOrders) > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	sort.Strings(symbols)
+
+	for _, symbol := range symbols {
+		status := ob.symbolStatuses[symbol]
+		fmt.Fprintf(&sb, "%s: %s (%d queued orders)\n", symbol, status.state, len(status.queuedOrders))
+	}
+
+	return sb.String()
+}
+
+// GetTradingState returns the trading state of a symbol.
+func (ob *OrderBook) GetTradingState(symbol string) TradingState {
+	return ob.getSymbolStatus(symbol).state
+}
+
+// SetTradingState changes the trading state of a symbol and returns the outputs of the change.
+// It processes a 'S' instruction, so the change is journaled and its outputs are sequenced.
+// When the symbol goes to continuous or closed from another state (e.g. at the end of a call auction,
+// even if it was halted in between), the book is uncrossed first: all executable orders match at the
+// equilibrium price (see GetEquilibrium).
+// When trading resumes (or an auction starts), the orders queued during the halt are processed
+// in their arrival order. When the symbol is closed (or pre-opened), they are rejected.
+// At close, the DAY orders of the symbol are expired.
+func (ob *OrderBook) SetTradingState(symbol string, state TradingState) ([]string, error) {
+	return ob.ProcessInstruction(fmt.Sprintf("S, %s, %s", symbol, state))
+}
+
+// setTradingState changes the trading state of a symbol at the time of the instruction being processed.
+func (ob *OrderBook) setTradingState(symbol string, state TradingState) []SequencedOutput {
+	status := ob.getSymbolStatus(symbol)
+	if status.state == state {
+		return nil
+	}
+
+	var result []SequencedOutput
+	if status.state != ContinuousTradingState && (state == ContinuousTradingState || state == ClosedTradingState) {
+		result = ob.uncross(symbol)
+	}
+
+	status.state = state
+	status.haltedUntil = time.Time{}
+	ob.audit.state(symbol, state)
+	result = append(result, outputsOf(ob.generateStateChangeOutput(symbol, state))...)
+
+	if state == HaltedTradingState {
+		return result
+	}
+
+	queuedOrders := status.queuedOrders
+	status.queuedOrders = nil
+	for _, order := range queuedOrders {
+		reason := NoRejectReason
+		switch {
+		case state == ClosedTradingState || state == PreOpenTradingState:
+			reason = rejectReasonOfState(state)
+		case state == AuctionTradingState:
+			reason = ob.auctionRejectReason(order)
+		default:
+			reason = ob.rejectReason(order)
+		}
+
+		switch {
+		case reason != NoRejectReason:
+			// The funds were reserved when the order was queued
+			ob.Accounts.release(order, order.Quantity)
+			result = append(result, outputsOf(ob.rejectOrder(order, reason))...)
+		case state == AuctionTradingState:
+			result = append(result, ob.restAuctionOrder(order)...)
+		default:
+			result = append(result, ob.placeOrder(order)...)
+		}
+	}
+
+	if state == ClosedTradingState {
+		result = append(result, ob.expireDayOrders(symbol)...)
+	}
+
+	return result
+}
+
+// expireDayOrders removes all the DAY orders of the symbol from the book (all the orders but the GTC ones,
+// as an order without time in force is a DAY order).
+// It publishes an expiration for each order and the TOB changes.
+func (ob *OrderBook) expireDayOrders(symbol string) []SequencedOutput {
+	var result []SequencedOutput
+	for _, queue := range []*OrderQueue{ob.BidQueue, ob.AskQueue} {
+		// To check if the TOB changes
+		oldTOB := queue.GetTOBInfo()
+
+		for _, order := range filterBySymbol(queue.Orders(), symbol) {
+			if order.TimeInForce == "G" {
+				continue
+			}
+
+			queue.Delete(order.GetIdentifier())
+			ob.Positions.addExposure(order, -order.Quantity)
+			ob.Accounts.release(order, order.Quantity)
+			ob.Orders.expire(order)
+			ob.audit.order("EXPIRE", order)
+			result = append(result, outputsOf(ob.generateExpirationOutput(order))...)
+		}
+
+		// If TOB changes, generate a TOB change output
+		if oldTOB != queue.GetTOBInfo() {
+			result = append(result, outputsOf(ob.generateTopOfBookChangeOutput(queue))...)
+		}
+	}
+
+	return result
+}
+
+// getSymbolStatus returns the status of a symbol (continuous trading by default).
+func (ob *OrderBook) getSymbolStatus(symbol string) *symbolStatus {
+	status, ok := ob.symbolStatuses[symbol]
+	if !ok {
+		status = &symbolStatus{state: ContinuousTradingState}
+		ob.symbolStatuses[symbol] = status
+	}
+
+	return status
+}
+
+// resumeExpiredHalts resumes the trading of symbols whose halt duration is over.
+func (ob *OrderBook) resumeExpiredHalts() []SequencedOutput {
+	var symbols []string
+	for symbol, status := range ob.symbolStatuses {
+		if status.state == HaltedTradingState && !status.haltedUntil.IsZero() && !ob.now.Before(status.haltedUntil) {
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	// Sort symbols to keep the outputs deterministic
+	sort.Strings(symbols)
+
+	var result []SequencedOutput
+	for _, symbol := range symbols {
+		result = append(result, ob.setTradingState(symbol, ContinuousTradingState)...)
+	}
+
+	return result
+}
+
+// haltOnVolatility halts the symbol of the order because the next trade would breach the volatility band.
+// The remaining quantity of the order is queued or rejected depending of the 'HaltPolicy'.
+func (ob *OrderBook) haltOnVolatility(order *Order) []SequencedOutput {
+	result := ob.setTradingState(order.Symbol, HaltedTradingState)
+
+	status := ob.getSymbolStatus(order.Symbol)
+	if ob.Guard.HaltDuration > 0 {
+		status.haltedUntil = ob.now.Add(ob.Guard.HaltDuration)
+	}
+
+	if ob.HaltPolicy == QueueHaltPolicy {
+		status.queuedOrders = append(status.queuedOrders, order)
+		ob.audit.order("QUEUE", order)
+		return result
+	}
+
+	ob.Accounts.release(order, order.Quantity)
+	return append(result, outputsOf(ob.rejectOrder(order, VolatilityHaltRejectReason))...)
+}
+
+// removeQueuedOrder removes an order queued during a halt and returns it (nil if not found).
+func (ob *OrderBook) removeQueuedOrder(identifier string) *Order {
+	status, i := ob.findQueuedOrder(identifier)
+	if status == nil {
+		return nil
+	}
+
+	order := status.queuedOrders[i]
+	status.queuedOrders = append(status.queuedOrders[:i], status.queuedOrders[i+1:]...)
+	return order
+}
+
+// findQueuedOrder returns the status of the symbol of an order queued during a halt and the index
+// of the order in its queued orders (nil if not found).
+func (ob *OrderBook) findQueuedOrder(identifier string) (*symbolStatus, int) {
+	for _, status := range ob.symbolStatuses {
+		for i, order := range status.queuedOrders {
+			if order.GetIdentifier() == identifier {
+				return status, i
+			}
+		}
+	}
+
+	return nil, -1
 }
 
 // generateTrade processes a trade when an order crosses the book.
 // It will trade the order until, the price of the opposite queue is to High or Low (depending of the
 // order type) or if the order quantity becomes 0.
-func (ob *OrderBook) generateTrade(order *Order, queue, queueToCompare *OrderQueue) []string {
-	var result []string
-	isBuy := order.OrderSide == "B"
+// A price level is filled by time priority or in proportion to the resting quantities (see 'MatchingPolicy').
+// A user never trades with himself: his orders are skipped or the matching stops at them and the remaining
+// quantity of the order is rejected (see 'SelfTradePrevention').
+func (ob *OrderBook) generateTrade(order *Order, queue, queueToCompare *OrderQueue) []SequencedOutput {
+	var result []SequencedOutput
+	halted, selfTrade := false, false
 
-	// Trade while quantity is greater than 0 and until the opposite queue
-	// is not empty and the top price is not too high/low depending the order type
+	// Trade while quantity is greater than 0 and until the order doesn't cross
+	// an order it can match in the opposite queue
 	for order.Quantity > 0 {
-		if queueToCompare.Peak() == nil {
+		orderToCompare := ob.matchingOrder(order, queueToCompare)
+		if orderToCompare == nil {
+			top := queueToCompare.Peak()
+			selfTrade = ob.SelfTradePrevention == CancelNewestSelfTradePrevention &&
+				top != nil && isSelfTrade(order, top) && crosses(order, top)
 			break
 		}
 
-		// Price to low/high for the given ask/bid
-		if (isBuy && (order.Price < queueToCompare.Peak().Price)) ||
-			(!isBuy && (order.Price > queueToCompare.Peak().Price)) {
+		// Halt instead of trading outside of the volatility band
+		if ob.Guard != nil && ob.Guard.Breaches(order.Symbol, orderToCompare.Price, ob.now) {
+			halted = true
 			break
 		}
 
+		if ob.MatchingPolicy == ProRataMatchingPolicy {
+			result = append(result, ob.matchProRata(order, queueToCompare, orderToCompare.Price)...)
+			continue
+		}
+
 		// If the quantity of the order on the opposite queue is greater that than
-		// the actual order quantity, do a partial trade.
-		orderToCompare := heap.Pop(queueToCompare).(*Order)
+		// the actual order quantity, do a partial trade (the resting order keeps its priority).
 		if orderToCompare.Quantity > order.Quantity {
-			orderToCompare.Quantity -= order.Quantity
-			heap.Push(queueToCompare, orderToCompare)
-			return append(result,
-				ob.generateTradeOutput(order, orderToCompare, orderToCompare.Price, order.Quantity),
-				ob.generateTopOfBookChangeOutput(queueToCompare),
-			)
+			trade := NewTrade(order, orderToCompare, orderToCompare.Price, order.Quantity)
+			queueToCompare.fill(orderToCompare, order.Quantity)
+			result = append(result, ob.processTrade(trade, orderToCompare)...)
+			return append(result, outputsOf(ob.generateTopOfBookChangeOutput(queueToCompare))...)
 		}
 
 		// Else trade the entire order
-		order.Quantity -= orderToCompare.Quantity
-		result = append(result, ob.generateTradeOutput(order, orderToCompare, orderToCompare.Price, orderToCompare.Quantity))
+		trade := NewTrade(order, orderToCompare, orderToCompare.Price, orderToCompare.Quantity)
+		queueToCompare.fill(orderToCompare, trade.Quantity)
+		order.Quantity -= trade.Quantity
+		result = append(result, ob.processTrade(trade, orderToCompare)...)
+	}
+
+	// The TOB of the opposite queue necesserly changed if we traded
+	if len(result) > 0 {
+		result = append(result, outputsOf(ob.generateTopOfBookChangeOutput(queueToCompare))...)
 	}
 
-	// The TOB of the opposite queue necesserly changed
-	result = append(result, ob.generateTopOfBookChangeOutput(queueToCompare))
+	if halted {
+		return append(result, ob.haltOnVolatility(order)...)
+	}
+
+	if selfTrade {
+		ob.Accounts.release(order, order.Quantity)
+		return append(result, outputsOf(ob.rejectOrder(order, SelfTradeRejectReason))...)
+	}
 
 	// If we cannot trade all our quantity, push back the order in the right queue and
 	// change the TOB
 	if order.Quantity > 0 {
-		heap.Push(queue, order)
-		result = append(result, ob.generateTopOfBookChangeOutput(queue))
+		ob.restOrder(queue, order)
+		result = append(result, outputsOf(ob.generateTopOfBookChangeOutput(queue))...)
 	}
 
 	return result
 }
 
+// processTrade updates the positions, the fees and the order statuses of both parties of a trade,
+// releases the exposure of the resting orders and returns the trade output,
+// followed by the execution reports if they are enabled (the aggressor first).
+// Both orders of an auction uncross are resting: there is no aggressor.
+func (ob *OrderBook) processTrade(trade *Trade, restingOrders ...*Order) []SequencedOutput {
+	ob.lastTradeID++
+	trade.ID = ob.lastTradeID
+	trade.Time = ob.now
+	ob.Fees.apply(trade, isResting(trade.BuyOrder, restingOrders), isResting(trade.SellOrder, restingOrders))
+
+	for _, o := range restingOrders {
+		ob.Positions.addExposure(o, -trade.Quantity)
+	}
+	ob.Positions.applyTrade(trade)
+	ob.Accounts.applyTrade(trade)
+	ob.getSymbolStatus(trade.Symbol()).lastPrice = trade.Price
+	if ob.Guard != nil {
+		ob.Guard.Record(trade.Symbol(), trade.Price, ob.now)
+	}
+	ob.Metrics.trade(trade.Symbol(), trade.Quantity)
+	ob.audit.trade(trade)
+	for _, listener := range ob.TradeListeners {
+		listener.OnTrade(trade)
+	}
+
+	var reports []string
+	for _, o := range []*Order{trade.BuyOrder, trade.SellOrder} {
+		status, err := ob.Orders.fill(o, trade.Quantity, trade.Price)
+		if err != nil {
+			ob.audit.inconsistency(err)
+		}
+		if !ob.ExecutionReports {
+			continue
+		}
+
+		fee := trade.BuyFee
+		if o == trade.SellOrder {
+			fee = trade.SellFee
+		}
+
+		switch {
+		case len(restingOrders) == 2:
+			reports = append(reports, ob.generateExecutionReportOutput(trade, status, "", fee))
+		case isResting(o, restingOrders):
+			reports = append(reports, ob.generateExecutionReportOutput(trade, status, "M", fee))
+		default:
+			reports = append([]string{ob.generateExecutionReportOutput(trade, status, "T", fee)}, reports...)
+		}
+	}
+
+	tradeOutput := SequencedOutput{TradeID: trade.ID, Output: ob.generateTradeOutput(trade)}
+	return append([]SequencedOutput{tradeOutput}, outputsOf(reports...)...)
+}
+
+// isResting indicates if the order is one of the resting orders.
+func isResting(order *Order, restingOrders []*Order) bool {
+	for _, o := range restingOrders {
+		if o == order {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptOrder starts tracking the status of a new order and generates its acknowledgement output.
+func (ob *OrderBook) acceptOrder(order *Order) string {
+	ob.Orders.accept(order)
+	ob.audit.order("ACK", order)
+	return ob.generateAcknowledgmentOutput(order)
+}
+
+// rejectOrder updates the status of a rejected order and generates its reject output.
+func (ob *OrderBook) rejectOrder(order *Order, reason RejectReason) string {
+	ob.Orders.reject(order, reason)
+	ob.Metrics.reject(order.Symbol)
+	ob.audit.reject(order, reason)
+	return ob.generateRejectOutput(order)
+}
+
+// rejectModify generates the reject output of a modification, the resting order is kept.
+func (ob *OrderBook) rejectModify(order *Order, reason RejectReason) string {
+	ob.Metrics.reject(order.Symbol)
+	ob.audit.reject(order, reason)
+	return ob.generateRejectOutput(order)
+}
+
 // generateAcknowledgmentOutput generates an aknowledgement output
 func (ob *OrderBook) generateAcknowledgmentOutput(order *Order) string {
 	return fmt.Sprintf("A, %d, %d", order.User, order.UserOrderId)
@@ -234,14 +1049,48 @@ func (ob *OrderBook) generateRejectOutput(order *Order) string {
 	return fmt.Sprintf("R, %d, %d", order.User, order.UserOrderId)
 }
 
+// generateExpirationOutput generates an expiration output
+func (ob *OrderBook) generateExpirationOutput(order *Order) string {
+	return fmt.Sprintf("X, %d, %d", order.User, order.UserOrderId)
+}
+
+// generateStateChangeOutput generates a trading state change output
+func (ob *OrderBook) generateStateChangeOutput(symbol string, state TradingState) string {
+	return fmt.Sprintf("S, %s, %s", symbol, state)
+}
+
+// generatePhaseChangeOutput generates a session phase change output
+func (ob *OrderBook) generatePhaseChangeOutput(symbol, phase string) string {
+	return fmt.Sprintf("P, %s, %s", symbol, phase)
+}
+
 // generateTradeOutput generates an trade output
-func (ob *OrderBook) generateTradeOutput(buyOrder, sellOrder *Order, price, quantity int) string {
+func (ob *OrderBook) generateTradeOutput(trade *Trade) string {
 	return fmt.Sprintf("T, %d, %d, %d, %d, %d, %d",
-		buyOrder.User,
-		buyOrder.UserOrderId,
-		sellOrder.User,
-		sellOrder.UserOrderId,
-		price,
-		quantity,
+		trade.BuyOrder.User,
+		trade.BuyOrder.UserOrderId,
+		trade.SellOrder.User,
+		trade.SellOrder.UserOrderId,
+		trade.Price,
+		trade.Quantity,
+	)
+}
+
+// generateExecutionReportOutput generates the execution report of a party of a trade
+// ('M' if its order was resting in the book (maker), 'T' (taker) if it was the aggressor,
+// empty for an auction uncross) with its fee
+func (ob *OrderBook) generateExecutionReportOutput(trade *Trade, status OrderStatus, liquidity string, fee int) string {
+	return fmt.Sprintf("E, %d, %d, %d, %s, %d, %d, %d, %d, %s, %s, %d",
+		status.User,
+		status.UserOrderId,
+		trade.ID,
+		status.Side,
+		trade.Price,
+		trade.Quantity,
+		status.LeavesQuantity,
+		status.CumulativeQuantity,
+		strconv.FormatFloat(status.AveragePrice, 'f', -1, 64),
+		liquidity,
+		fee,
 	)
 }
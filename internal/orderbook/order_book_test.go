@@ -2,6 +2,7 @@ package orderbook_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/maxatome/go-testdeep/td"
 
@@ -27,3 +28,148 @@ func TestOrderBook(t *testing.T) {
 	}
 
 }
+
+func TestOrderBook_ModifyOrder(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ob := orderbook.NewOrderBook(true)
+	process := func(instruction string) []string {
+		output, err := ob.ProcessInstruction(instruction)
+		require.CmpNoError(err)
+		return output
+	}
+
+	process("N, 1, IBM, 10, 100, B, 1")
+	process("N, 2, IBM, 10, 100, B, 2")
+
+	// Reducing the quantity keeps the priority
+	assert.Cmp(process("N, 1, IBM, 10, 50, B, 1"), []string{"A, 1, 1", "B, B, 10, 150"})
+	assert.Cmp(ob.BidQueue.Orders()[0].UserOrderId, 1)
+
+	// Increasing the quantity loses the priority
+	assert.Cmp(process("N, 1, IBM, 10, 60, B, 1"), []string{"A, 1, 1", "B, B, 10, 160"})
+	assert.Cmp(ob.BidQueue.Orders()[0].UserOrderId, 2)
+
+	// An order can't change of side
+	assert.Cmp(process("N, 1, IBM, 10, 60, S, 1"), []string{"R, 1, 1"})
+
+	// A modified order can trade
+	process("N, 3, IBM, 12, 100, S, 3")
+	assert.Cmp(process("N, 3, IBM, 10, 100, S, 3"), []string{
+		"A, 3, 3",
+		"T, 2, 2, 3, 3, 10, 100",
+		"B, B, 10, 60",
+		"B, S, -, -",
+	})
+}
+
+func TestOrderBook_Timestamps(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	start := time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock := orderbook.NewFakeClock(start)
+	ob := orderbook.NewOrderBook(true)
+	ob.Clock = clock
+
+	_, err := ob.ProcessInstruction("N, 1, IBM, 10, 100, S, 1")
+	require.CmpNoError(err)
+
+	clock.Advance(time.Millisecond)
+	outputs, err := ob.ProcessSequencedInstruction("N, 2, IBM, 10, 40, B, 1")
+	require.CmpNoError(err)
+
+	// Every output has the time of its instruction
+	assert.Cmp(outputs, td.All(td.Len(3), td.ArrayEach(td.Smuggle("Time", start.Add(time.Millisecond)))))
+
+	// Orders keep the time they were received
+	assert.Cmp(ob.AskQueue.Peak().ReceivedAt, start)
+}
+
+func TestOrderBook_SelfTrade(t *testing.T) {
+	assert := td.Assert(t)
+
+	for _, tc := range []struct {
+		name       string
+		prevention orderbook.SelfTradePrevention
+		output     []string
+		position   int
+	}{
+		{
+			// The order of the same user is skipped, the remaining quantity rests crossing it
+			name:       "None",
+			prevention: orderbook.NoSelfTradePrevention,
+			output:     []string{"A, 1, 2", "T, 1, 2, 2, 1, 10, 100", "B, S, 10, 100", "B, B, 10, 50"},
+			position:   100,
+		},
+		{
+			// The top of the book is an order of the same user
+			name:       "CancelNewest",
+			prevention: orderbook.CancelNewestSelfTradePrevention,
+			output:     []string{"R, 1, 2"},
+		},
+	} {
+		assert.RunAssertRequire(tc.name, func(assert, require *td.T) {
+			ob := orderbook.NewOrderBook(true)
+			ob.SelfTradePrevention = tc.prevention
+			_, err := ob.ProcessFromStringInstructions(`
+N, 1, IBM, 10, 100, S, 1
+N, 2, IBM, 10, 100, S, 1
+`)
+			require.CmpNoError(err)
+
+			output, err := ob.ProcessInstruction("N, 1, IBM, 10, 150, B, 2")
+			require.CmpNoError(err)
+			assert.Cmp(output, tc.output)
+			assert.Cmp(ob.Positions.GetPosition(1, "IBM").NetPosition, tc.position)
+			assert.CmpNoError(ob.CheckInvariants())
+		})
+	}
+}
+
+func TestOrderBook_InvalidQuantity(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	// An order without quantity is rejected
+	ob := orderbook.NewOrderBook(true)
+	output, err := ob.ProcessInstruction("N, 3, IBM, 10, 0, B, 1")
+	require.CmpNoError(err)
+	assert.Cmp(output, []string{"R, 3, 1"})
+
+	status, _ := ob.Orders.GetOrderStatus(3, 1)
+	assert.Cmp(status.RejectReason, orderbook.InvalidQuantityRejectReason)
+	assert.CmpNoError(ob.CheckInvariants())
+}
+
+func TestOrderBook_PartialFillPriority(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ob := orderbook.NewOrderBook(true)
+	_, err := ob.ProcessFromStringInstructions(`
+N, 1, IBM, 10, 100, S, 1
+N, 2, IBM, 10, 100, S, 2
+N, 3, IBM, 10, 50, B, 1
+`)
+	require.CmpNoError(err)
+
+	// The partially filled order is still the oldest of its level
+	output, err := ob.ProcessInstruction("N, 3, IBM, 10, 50, B, 2")
+	require.CmpNoError(err)
+	assert.Cmp(output, []string{"A, 3, 2", "T, 3, 2, 1, 1, 10, 50", "B, S, 10, 100"})
+}
+
+func TestOrderBook_CancelReusedIdentifier(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	// The identifier of a filled buy order is reused by a sell order, which is found in its queue
+	ob := orderbook.NewOrderBook(true)
+	_, err := ob.ProcessFromStringInstructions(`
+N, 1, IBM, 10, 5, B, 1
+N, 2, IBM, 10, 5, S, 1
+N, 1, IBM, 20, 5, S, 1
+`)
+	require.CmpNoError(err)
+
+	output, err := ob.ProcessInstruction("C, 1, 1")
+	require.CmpNoError(err)
+	assert.Cmp(output, []string{"A, 1, 1", "B, S, -, -"})
+}
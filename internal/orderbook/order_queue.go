@@ -3,6 +3,7 @@ package orderbook
 import (
 	"container/heap"
 	"fmt"
+	"sort"
 )
 
 // Type of order (BID or ASK)
@@ -24,11 +25,15 @@ type CompareFunc func(i, j int) bool
 // or to retrieve the total quantity for a given price and a given user (Easy to detect changement of volume).
 type OrderQueue struct {
 	orders                []*Order
-	compareFunc           CompareFunc       // For the 'Less(i,j)' implemementation
-	mapPriceToQuantity    map[int]int       // For modification of the quantity (and TOB status)
-	mapSearchByIdentifier map[string]*Order // Use to make 'Cancel' order quicker
-	OrderSide             string            // Order type
-	timer                 int               // Simulate a timer in order to know which order is older
+	compareFunc           CompareFunc                  // For the 'Less(i,j)' implemementation
+	mapPriceToQuantity    map[int]int                  // For modification of the quantity (and TOB status)
+	mapSearchByIdentifier map[string]*Order            // Use to make 'Cancel' order quicker
+	mapUserToOrders       map[int]map[string]*Order    // Use to make 'MassCancel' by user quicker
+	mapSymbolToOrders     map[string]map[string]*Order // Use to make 'MassCancel' by symbol quicker
+	OrderSide             string                       // Order type
+	timer                 int                          // Simulate a timer in order to know which order is older
+	quantity              int                          // Total quantity of the orders (depth)
+	levels                int                          // Number of prices with a quantity
 }
 
 // NewOrderQueue creates a new priority queue (heap) for Ask or Bid orders depending
@@ -48,6 +53,8 @@ func NewOrderQueue(orderType OrderType) *OrderQueue {
 		compareFunc:           cf,
 		mapPriceToQuantity:    map[int]int{},
 		mapSearchByIdentifier: map[string]*Order{},
+		mapUserToOrders:       map[int]map[string]*Order{},
+		mapSymbolToOrders:     map[string]map[string]*Order{},
 		OrderSide:             side,
 	}
 }
@@ -165,14 +172,120 @@ func (oq *OrderQueue) GetTOBInfo() string {
 // using Identifier or to retrieve the volume of a kind of order using price.
 func (oq *OrderQueue) addToMaps(o *Order) {
 	oq.mapSearchByIdentifier[o.GetIdentifier()] = o
-	oq.mapPriceToQuantity[o.Price] += o.Quantity
+	oq.addQuantity(o.Price, o.Quantity)
+
+	if oq.mapUserToOrders[o.User] == nil {
+		oq.mapUserToOrders[o.User] = map[string]*Order{}
+	}
+	oq.mapUserToOrders[o.User][o.GetIdentifier()] = o
+
+	if oq.mapSymbolToOrders[o.Symbol] == nil {
+		oq.mapSymbolToOrders[o.Symbol] = map[string]*Order{}
+	}
+	oq.mapSymbolToOrders[o.Symbol][o.GetIdentifier()] = o
 }
 
 // deleteFromMaps removes the order of all the maps.
 func (oq *OrderQueue) deleteFromMaps(o *Order) {
 	delete(oq.mapSearchByIdentifier, o.GetIdentifier())
+
+	delete(oq.mapUserToOrders[o.User], o.GetIdentifier())
+	if len(oq.mapUserToOrders[o.User]) == 0 {
+		delete(oq.mapUserToOrders, o.User)
+	}
+
+	delete(oq.mapSymbolToOrders[o.Symbol], o.GetIdentifier())
+	if len(oq.mapSymbolToOrders[o.Symbol]) == 0 {
+		delete(oq.mapSymbolToOrders, o.Symbol)
+	}
+
 	if oq.mapPriceToQuantity[o.Price] == 0 {
 		return
 	}
-	oq.mapPriceToQuantity[o.Price] -= o.Quantity
+	oq.addQuantity(o.Price, -o.Quantity)
+}
+
+// addQuantity updates the total quantity at a price, and the depth and the number of price levels of the queue
+// (so they are never computed by scanning the prices).
+func (oq *OrderQueue) addQuantity(price, quantity int) {
+	before := oq.mapPriceToQuantity[price]
+	oq.mapPriceToQuantity[price] = before + quantity
+	oq.quantity += quantity
+
+	switch {
+	case before <= 0 && before+quantity > 0:
+		oq.levels++
+	case before > 0 && before+quantity <= 0:
+		oq.levels--
+	}
+}
+
+// Orders returns the orders of the queue sorted by priority.
+// The queue itself is not modified.
+func (oq *OrderQueue) Orders() []*Order {
+	sorted := &OrderQueue{
+		orders:      append([]*Order(nil), oq.orders...),
+		compareFunc: oq.compareFunc,
+	}
+	sort.Sort(sortableOrders{sorted})
+
+	return sorted.orders
+}
+
+// ordersOf returns the orders of a user (all users if AllUsers) and of a symbol (all symbols if empty).
+// The orders are retrieved with the smallest index, so the result may contain orders of another user
+// or symbol: they must be filtered by the caller. Orders are sorted by priority.
+func (oq *OrderQueue) ordersOf(user int, symbol string) []*Order {
+	var index map[string]*Order
+	switch {
+	case user != AllUsers && symbol != "":
+		index = oq.mapUserToOrders[user]
+		if len(oq.mapSymbolToOrders[symbol]) < len(index) {
+			index = oq.mapSymbolToOrders[symbol]
+		}
+	case user != AllUsers:
+		index = oq.mapUserToOrders[user]
+	case symbol != "":
+		index = oq.mapSymbolToOrders[symbol]
+	default:
+		return oq.Orders()
+	}
+
+	sorted := &OrderQueue{
+		orders:      make([]*Order, 0, len(index)),
+		compareFunc: oq.compareFunc,
+	}
+	for _, o := range index {
+		sorted.orders = append(sorted.orders, o)
+	}
+
+	// Sort orders by priority so that they are always processed in the same order
+	sort.Sort(sortableOrders{sorted})
+
+	return sorted.orders
+}
+
+// fill removes the given quantity from an order of the queue.
+// The order keeps its priority (neither its price nor its time change)
+// and it is removed from the queue once it is totally filled.
+func (oq *OrderQueue) fill(order *Order, quantity int) {
+	if quantity >= order.Quantity {
+		// Call Pop() so the total quantity is updated by 'deleteFromMaps'
+		heap.Remove(oq, order.index)
+		order.Quantity = 0
+		return
+	}
+
+	order.Quantity -= quantity
+	oq.addQuantity(order.Price, -quantity)
+}
+
+// sortableOrders sorts the orders of a queue without updating their index.
+type sortableOrders struct {
+	*OrderQueue
+}
+
+// Swap swaps two orders without modifying their index in the real queue.
+func (so sortableOrders) Swap(i, j int) {
+	so.orders[i], so.orders[j] = so.orders[j], so.orders[i]
 }
@@ -145,3 +145,23 @@ func TestOrderQueue_PushOrderWithSamePriceButDifferentUser(t *testing.T) {
 	assert.Cmp(heap.Pop(askOrderQueue), orders[0])
 	assert.Cmp(heap.Pop(askOrderQueue), orders[1])
 }
+
+func TestOrderQueue_Orders(t *testing.T) {
+	assert := td.Assert(t)
+
+	orders := []*orderbook.Order{
+		{User: 1, Price: 9, Quantity: 100, UserOrderId: 1},
+		{User: 1, Price: 10, Quantity: 100, UserOrderId: 2},
+		{User: 2, Price: 9, Quantity: 100, UserOrderId: 3},
+	}
+
+	bidOrderQueue := orderbook.NewOrderQueue(orderbook.BidOrderType)
+	for _, order := range orders {
+		heap.Push(bidOrderQueue, order)
+	}
+
+	// Sorted by price then by time, without modifying the queue
+	assert.Cmp(bidOrderQueue.Orders(), []*orderbook.Order{orders[1], orders[0], orders[2]})
+	assert.Cmp(bidOrderQueue.Len(), 3)
+	assert.Cmp(bidOrderQueue.Peak(), orders[1])
+}
@@ -0,0 +1,308 @@
+package orderbook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultTerminalOrders is the default number of terminal orders kept by an order store.
+const DefaultTerminalOrders = 10000
+
+// OrderState is the state of an order in its lifecycle.
+type OrderState int
+
+const (
+	NewOrderState OrderState = iota
+	PartiallyFilledOrderState
+	FilledOrderState
+	CancelledOrderState
+	RejectedOrderState
+	ExpiredOrderState
+)
+
+var orderStateNames = map[OrderState]string{
+	NewOrderState:             "NEW",
+	PartiallyFilledOrderState: "PARTIALLY_FILLED",
+	FilledOrderState:          "FILLED",
+	CancelledOrderState:       "CANCELLED",
+	RejectedOrderState:        "REJECTED",
+	ExpiredOrderState:         "EXPIRED",
+}
+
+// String returns the name of the order state.
+func (s OrderState) String() string {
+	if name, ok := orderStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("OrderState(%d)", int(s))
+}
+
+// ParseOrderState returns the order state of the given name (case insensitive).
+func ParseOrderState(name string) (OrderState, error) {
+	for state, stateName := range orderStateNames {
+		if strings.EqualFold(name, stateName) {
+			return state, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Unknown order state: %q", name)
+}
+
+// IsTerminal indicates if the order can't change anymore (filled, cancelled, rejected or expired).
+func (s OrderState) IsTerminal() bool {
+	return s != NewOrderState && s != PartiallyFilledOrderState
+}
+
+// RejectReason is the reason why an order was rejected.
+type RejectReason int
+
+const (
+	NoRejectReason RejectReason = iota
+	SymbolHaltedRejectReason
+	SymbolClosedRejectReason
+	SymbolPreOpenRejectReason
+	VolatilityHaltRejectReason
+	PositionLimitRejectReason
+	CrossesBookRejectReason
+	ModifyMismatchRejectReason // A modify can't change the side or the symbol of an order
+	InvalidQuantityRejectReason
+	InsufficientFundsRejectReason
+	SelfTradeRejectReason // The order crosses an order of the same user
+)
+
+var rejectReasonNames = map[RejectReason]string{
+	NoRejectReason:                "",
+	SymbolHaltedRejectReason:      "SYMBOL_HALTED",
+	SymbolClosedRejectReason:      "SYMBOL_CLOSED",
+	SymbolPreOpenRejectReason:     "SYMBOL_PRE_OPEN",
+	VolatilityHaltRejectReason:    "VOLATILITY_HALT",
+	PositionLimitRejectReason:     "POSITION_LIMIT",
+	CrossesBookRejectReason:       "CROSSES_BOOK",
+	ModifyMismatchRejectReason:    "MODIFY_MISMATCH",
+	InvalidQuantityRejectReason:   "INVALID_QUANTITY",
+	InsufficientFundsRejectReason: "INSUFFICIENT_FUNDS",
+	SelfTradeRejectReason:         "SELF_TRADE",
+}
+
+// String returns the name of the reject reason (empty if the order was not rejected).
+func (r RejectReason) String() string {
+	if name, ok := rejectReasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("RejectReason(%d)", int(r))
+}
+
+// ParseRejectReason returns the reject reason of the given name (case insensitive).
+func ParseRejectReason(name string) (RejectReason, error) {
+	for reason, reasonName := range rejectReasonNames {
+		if strings.EqualFold(name, reasonName) {
+			return reason, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Unknown reject reason: %q", name)
+}
+
+// MarshalText serializes the reject reason by its name (in snapshots and audit logs).
+func (r RejectReason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText parses the name of a reject reason.
+func (r *RejectReason) UnmarshalText(text []byte) error {
+	reason, err := ParseRejectReason(string(text))
+	if err != nil {
+		return err
+	}
+
+	*r = reason
+	return nil
+}
+
+// rejectReasonOfState returns the reason to reject an order because of the trading state of its symbol.
+func rejectReasonOfState(state TradingState) RejectReason {
+	switch state {
+	case HaltedTradingState:
+		return SymbolHaltedRejectReason
+	case ClosedTradingState:
+		return SymbolClosedRejectReason
+	case PreOpenTradingState:
+		return SymbolPreOpenRejectReason
+	}
+
+	return NoRejectReason
+}
+
+// OrderStatus is the lifecycle of an order.
+// The original quantity is the quantity of the order when it was accepted (or modified),
+// it is always the sum of the leaves quantity (still to fill, 0 once terminal) and the cumulative quantity
+// (already filled), unless the order was cancelled, rejected or expired.
+type OrderStatus struct {
+	User               int
+	UserOrderId        int
+	Symbol             string
+	Side               string
+	Price              int
+	State              OrderState
+	OriginalQuantity   int
+	LeavesQuantity     int
+	CumulativeQuantity int
+	AveragePrice       float64      // Average price of the fills
+	RejectReason       RejectReason // Set if the order was rejected
+}
+
+// OrderStore keeps track of the status of the orders of an order book.
+// The status of live orders is kept until they become terminal, then only the
+// 'MaxTerminal' most recent terminal orders are kept.
+type OrderStore struct {
+	MaxTerminal int
+
+	orders   map[string]*OrderStatus
+	terminal []*OrderStatus // Terminal orders, the oldest first
+	err      error          // First inconsistency with the order book, reported by CheckInvariants
+}
+
+// NewOrderStore creates an empty order store which keeps the given number of terminal orders.
+func NewOrderStore(maxTerminal int) *OrderStore {
+	return &OrderStore{
+		MaxTerminal: maxTerminal,
+		orders:      map[string]*OrderStatus{},
+	}
+}
+
+// GetOrderStatus returns a copy of the status of an order.
+// It returns false if the order is unknown or if it became terminal too long ago.
+func (st *OrderStore) GetOrderStatus(user, userOrderId int) (OrderStatus, bool) {
+	if status, ok := st.orders[fmt.Sprintf("%d-%d", user, userOrderId)]; ok {
+		return *status, true
+	}
+
+	return OrderStatus{}, false
+}
+
+// GetOrderStatuses returns a copy of the statuses of all the orders of a user sorted by user order id.
+func (st *OrderStore) GetOrderStatuses(user int) []OrderStatus {
+	var statuses []OrderStatus
+	for _, status := range st.orders {
+		if status.User == user {
+			statuses = append(statuses, *status)
+		}
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].UserOrderId < statuses[j].UserOrderId })
+	return statuses
+}
+
+// accept starts tracking a new order.
+func (st *OrderStore) accept(order *Order) {
+	st.orders[order.GetIdentifier()] = &OrderStatus{
+		User:             order.User,
+		UserOrderId:      order.UserOrderId,
+		Symbol:           order.Symbol,
+		Side:             order.OrderSide,
+		Price:            order.Price,
+		State:            NewOrderState,
+		OriginalQuantity: order.Quantity,
+		LeavesQuantity:   order.Quantity,
+	}
+}
+
+// modify applies the new price and quantity of a live order.
+// The quantity is the new leaves quantity, so the original quantity includes what was already filled.
+func (st *OrderStore) modify(order *Order) {
+	status, ok := st.orders[order.GetIdentifier()]
+	if !ok || status.State.IsTerminal() {
+		st.accept(order)
+		return
+	}
+
+	status.Price = order.Price
+	status.LeavesQuantity = order.Quantity
+	status.OriginalQuantity = status.CumulativeQuantity + order.Quantity
+}
+
+// fill applies a fill to a live order and returns its new status.
+// Only live orders can trade, so it returns an error if the order is not tracked or is terminal:
+// the order book and the order store are out of sync. The order is then tracked again with the
+// quantity left in the book, so the fill is still reported, and the error is kept for CheckInvariants.
+func (st *OrderStore) fill(order *Order, quantity, price int) (OrderStatus, error) {
+	var err error
+	status, ok := st.orders[order.GetIdentifier()]
+	if !ok || status.State.IsTerminal() {
+		err = fmt.Errorf("Fill of order %s which is not live in the order store", order.GetIdentifier())
+		if st.err == nil {
+			st.err = err
+		}
+
+		st.accept(order)
+		status = st.orders[order.GetIdentifier()]
+		status.OriginalQuantity += quantity
+		status.LeavesQuantity += quantity
+	}
+
+	status.AveragePrice = (status.AveragePrice*float64(status.CumulativeQuantity) + float64(price*quantity)) /
+		float64(status.CumulativeQuantity+quantity)
+	status.CumulativeQuantity += quantity
+	status.LeavesQuantity -= quantity
+
+	if status.LeavesQuantity > 0 {
+		status.State = PartiallyFilledOrderState
+		return *status, err
+	}
+
+	// The status may be forgotten as soon as it is terminal
+	st.terminate(status, FilledOrderState)
+	return *status, err
+}
+
+// reject rejects an order, which may be a new order or a live order
+// (e.g. an order queued during a halt, rejected when the symbol closes).
+func (st *OrderStore) reject(order *Order, reason RejectReason) {
+	status, ok := st.orders[order.GetIdentifier()]
+	if !ok || status.State.IsTerminal() {
+		st.accept(order)
+		status = st.orders[order.GetIdentifier()]
+	}
+
+	status.RejectReason = reason
+	st.terminate(status, RejectedOrderState)
+}
+
+// cancel cancels a live order.
+func (st *OrderStore) cancel(order *Order) {
+	if status, ok := st.orders[order.GetIdentifier()]; ok && !status.State.IsTerminal() {
+		st.terminate(status, CancelledOrderState)
+	}
+}
+
+// expire expires a live order.
+func (st *OrderStore) expire(order *Order) {
+	if status, ok := st.orders[order.GetIdentifier()]; ok && !status.State.IsTerminal() {
+		st.terminate(status, ExpiredOrderState)
+	}
+}
+
+// terminate sets the terminal state of an order and forgets the oldest terminal orders.
+func (st *OrderStore) terminate(status *OrderStatus, state OrderState) {
+	status.State = state
+	status.LeavesQuantity = 0
+	st.terminal = append(st.terminal, status)
+
+	for len(st.terminal) > st.MaxTerminal {
+		oldest := st.terminal[0]
+		st.terminal = st.terminal[1:]
+
+		// The identifier may have been reused by a new order
+		identifier := fmt.Sprintf("%d-%d", oldest.User, oldest.UserOrderId)
+		if st.orders[identifier] == oldest {
+			delete(st.orders, identifier)
+		}
+	}
+}
+
+// clear forgets all the orders (used when the book is flushed).
+func (st *OrderStore) clear() {
+	st.orders = map[string]*OrderStatus{}
+	st.terminal = nil
+}
@@ -0,0 +1,126 @@
+package orderbook_test
+
+import (
+	"testing"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestOrderStore(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ob := orderbook.NewOrderBook(true)
+	ob.Orders.MaxTerminal = 3
+	process := func(instruction string) {
+		_, err := ob.ProcessInstruction(instruction)
+		require.CmpNoError(err)
+	}
+	state := func(user, userOrderId int) interface{} {
+		status, ok := ob.Orders.GetOrderStatus(user, userOrderId)
+		if !ok {
+			return nil
+		}
+		return status.State
+	}
+
+	process("N, 1, IBM, 10, 100, S, 1")
+	process("N, 1, IBM, 11, 100, S, 2")
+	assert.Cmp(state(1, 1), orderbook.NewOrderState)
+
+	// Partial fill of both orders of user 1
+	process("N, 2, IBM, 11, 150, B, 1")
+	status, ok := ob.Orders.GetOrderStatus(2, 1)
+	require.True(ok)
+	assert.Cmp(status, orderbook.OrderStatus{
+		User:               2,
+		UserOrderId:        1,
+		Symbol:             "IBM",
+		Side:               "B",
+		Price:              11,
+		State:              orderbook.FilledOrderState,
+		OriginalQuantity:   150,
+		CumulativeQuantity: 150,
+		AveragePrice:       (10*100 + 11*50) / 150.0,
+	})
+	assert.Cmp(state(1, 1), orderbook.FilledOrderState)
+
+	status, _ = ob.Orders.GetOrderStatus(1, 2)
+	assert.Cmp(status, td.SStruct(orderbook.OrderStatus{
+		State:              orderbook.PartiallyFilledOrderState,
+		OriginalQuantity:   100,
+		LeavesQuantity:     50,
+		CumulativeQuantity: 50,
+		AveragePrice:       11,
+	}, td.StructFields{"=*": td.Ignore()}))
+
+	// Modifying a partially filled order keeps what was filled
+	process("N, 1, IBM, 12, 30, S, 2")
+	status, _ = ob.Orders.GetOrderStatus(1, 2)
+	assert.Cmp(status, td.SStruct(orderbook.OrderStatus{
+		Price:              12,
+		State:              orderbook.PartiallyFilledOrderState,
+		OriginalQuantity:   80,
+		LeavesQuantity:     30,
+		CumulativeQuantity: 50,
+		AveragePrice:       11,
+	}, td.StructFields{"=*": td.Ignore()}))
+
+	process("C, 1, 2")
+	assert.Cmp(state(1, 2), orderbook.CancelledOrderState)
+
+	process("S, IBM, CLOSED")
+	process("N, 3, IBM, 10, 100, B, 1")
+	assert.Cmp(state(3, 1), orderbook.RejectedOrderState)
+
+	process("S, IBM, CONTINUOUS")
+	process("N, 3, IBM, 10, 100, B, 2")
+	process("S, IBM, CLOSED")
+	assert.Cmp(state(3, 2), orderbook.ExpiredOrderState)
+
+	// Only the 3 most recent terminal orders are kept
+	assert.Nil(state(2, 1))
+	assert.Nil(state(1, 1))
+	assert.Cmp(ob.Orders.GetOrderStatuses(3), td.Len(2))
+	assert.Nil(state(4, 1))
+}
+
+func TestOrderBook_ExecutionReports(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ob := orderbook.NewOrderBook(true)
+	ob.ExecutionReports = true
+	process := func(instruction string) []string {
+		output, err := ob.ProcessInstruction(instruction)
+		require.CmpNoError(err)
+		return output
+	}
+
+	process("N, 1, IBM, 10, 100, S, 1")
+	process("N, 1, IBM, 11, 100, S, 2")
+
+	// The aggressor first, then the resting order of each trade
+	assert.Cmp(process("N, 2, IBM, 11, 150, B, 1"), []string{
+		"A, 2, 1",
+		"T, 2, 1, 1, 1, 10, 100",
+		"E, 2, 1, 1, B, 10, 100, 50, 100, 10, T, 0",
+		"E, 1, 1, 1, S, 10, 100, 0, 100, 10, M, 0",
+		"T, 2, 1, 1, 2, 11, 50",
+		"E, 2, 1, 2, B, 11, 50, 0, 150, 10.333333333333334, T, 0",
+		"E, 1, 2, 2, S, 11, 50, 50, 50, 11, M, 0",
+		"B, S, 11, 50",
+	})
+
+	// An auction uncross has no aggressor: the liquidity flag is empty
+	process("S, IBM, AUCTION")
+	process("N, 3, IBM, 12, 20, B, 1")
+	assert.Cmp(process("S, IBM, CONTINUOUS"), []string{
+		"T, 3, 1, 1, 2, 11, 20",
+		"E, 3, 1, 3, B, 11, 20, 0, 20, 11, , 0",
+		"E, 1, 2, 3, S, 11, 20, 30, 70, 11, , 0",
+		"B, B, -, -",
+		"B, S, 11, 30",
+		"S, IBM, CONTINUOUS",
+	})
+}
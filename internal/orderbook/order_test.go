@@ -12,10 +12,20 @@ func TestNewOrderFromInstruction(t *testing.T) {
 	assert := td.Assert(t)
 
 	// When we are in NewOrderFromInstruction, orderbook should have remove all empty spaces
-	_, err := orderbook.NewOrderFromInstruction("N,1,IBM,10,100,B,1")
+	order, err := orderbook.NewOrderFromInstruction("N,1,IBM,10,100,B,1")
 	assert.CmpNoError(err)
 
+	// Time in force is DAY by default
+	assert.Cmp(order.TimeInForce, "D")
+
+	order, err = orderbook.NewOrderFromInstruction("N,1,IBM,10,100,B,1,G")
+	assert.CmpNoError(err)
+	assert.Cmp(order.TimeInForce, "G")
+
+	_, err = orderbook.NewOrderFromInstruction("N,1,IBM,10,100,B,1,X")
+	assert.String(err, `Unknown time in force for order: "X"`)
+
 	_, err = orderbook.NewOrderFromInstruction("N,2")
-	assert.CmpError(err, `Can't create new cancel order from instruction as it has less than 7 parameters: "N,2"`)
+	assert.String(err, `Can't create new order from instruction as it has not 7 or 8 parameters: "N,2"`)
 
 }
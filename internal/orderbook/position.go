@@ -0,0 +1,157 @@
+package orderbook
+
+import "sort"
+
+// Position represents what a user holds on a symbol.
+// The net position is positive when the user is long and negative when he is short.
+// Open quantities are the exposure of the resting orders of the user.
+type Position struct {
+	User              int
+	Symbol            string
+	NetPosition       int
+	OpenBuyQuantity   int
+	OpenSellQuantity  int
+	AverageEntryPrice float64 // Average price of the current net position
+	RealizedPnL       float64 // P&L realized by closing (part of) a position
+}
+
+// PositionKeeper keeps track of positions per user and per symbol.
+// It is updated by the order book at each resting order, cancel and fill.
+type PositionKeeper struct {
+	positions map[int]map[string]*Position
+}
+
+// NewPositionKeeper creates an empty position keeper.
+func NewPositionKeeper() *PositionKeeper {
+	return &PositionKeeper{
+		positions: map[int]map[string]*Position{},
+	}
+}
+
+// GetPosition returns a copy of the position of a user on a symbol.
+// If the user never traded nor placed an order on the symbol, it returns an empty position.
+func (pk *PositionKeeper) GetPosition(user int, symbol string) Position {
+	if p, ok := pk.positions[user][symbol]; ok {
+		return *p
+	}
+
+	return Position{User: user, Symbol: symbol}
+}
+
+// GetPositions returns a copy of all the positions of a user sorted by symbol.
+func (pk *PositionKeeper) GetPositions(user int) []Position {
+	positions := make([]Position, 0, len(pk.positions[user]))
+	for _, p := range pk.positions[user] {
+		positions = append(positions, *p)
+	}
+
+	sort.Slice(positions, func(i, j int) bool { return positions[i].Symbol < positions[j].Symbol })
+	return positions
+}
+
+// PotentialPosition returns the worst net position the user can reach on the given side
+// if all his resting orders of this side are filled.
+func (pk *PositionKeeper) PotentialPosition(user int, symbol, side string) int {
+	p := pk.GetPosition(user, symbol)
+	if side == "B" {
+		return p.NetPosition + p.OpenBuyQuantity
+	}
+
+	return p.NetPosition - p.OpenSellQuantity
+}
+
+// ExceedsLimit indicates if the order, once all resting orders of its side are filled,
+// can make the absolute net position of the user greater than the given limit.
+func (pk *PositionKeeper) ExceedsLimit(order *Order, limit int) bool {
+	potential := pk.PotentialPosition(order.User, order.Symbol, order.OrderSide)
+	if order.OrderSide == "B" {
+		potential += order.Quantity
+	} else {
+		potential -= order.Quantity
+	}
+
+	return abs(potential) > limit
+}
+
+// getOrCreate returns the position of a user on a symbol and creates it if needed.
+func (pk *PositionKeeper) getOrCreate(user int, symbol string) *Position {
+	positions, ok := pk.positions[user]
+	if !ok {
+		positions = map[string]*Position{}
+		pk.positions[user] = positions
+	}
+
+	p, ok := positions[symbol]
+	if !ok {
+		p = &Position{User: user, Symbol: symbol}
+		positions[symbol] = p
+	}
+
+	return p
+}
+
+// addExposure adds the given quantity to the open quantity of the order side.
+// A negative quantity releases the exposure (cancel or fill of a resting order).
+func (pk *PositionKeeper) addExposure(order *Order, quantity int) {
+	p := pk.getOrCreate(order.User, order.Symbol)
+	if order.OrderSide == "B" {
+		p.OpenBuyQuantity += quantity
+	} else {
+		p.OpenSellQuantity += quantity
+	}
+}
+
+// applyTrade updates the positions of both parties of a trade.
+func (pk *PositionKeeper) applyTrade(trade *Trade) {
+	pk.getOrCreate(trade.BuyOrder.User, trade.Symbol()).fill(trade.Quantity, trade.Price)
+	pk.getOrCreate(trade.SellOrder.User, trade.Symbol()).fill(-trade.Quantity, trade.Price)
+}
+
+// clearExposures resets the open quantities of all positions (used when the book is flushed).
+func (pk *PositionKeeper) clearExposures() {
+	for _, positions := range pk.positions {
+		for _, p := range positions {
+			p.OpenBuyQuantity = 0
+			p.OpenSellQuantity = 0
+		}
+	}
+}
+
+// fill applies a fill to the position. The quantity is positive for a buy and negative for a sell.
+// Increasing the position updates the average entry price, reducing it realizes the P&L
+// on the closed quantity. If the position is flipped, the new average entry price is the fill price.
+func (p *Position) fill(quantity, price int) {
+	if p.NetPosition == 0 || (p.NetPosition > 0) == (quantity > 0) {
+		held := float64(abs(p.NetPosition))
+		p.AverageEntryPrice = (p.AverageEntryPrice*held + float64(price*abs(quantity))) / (held + float64(abs(quantity)))
+		p.NetPosition += quantity
+		return
+	}
+
+	closed := abs(quantity)
+	if closed > abs(p.NetPosition) {
+		closed = abs(p.NetPosition)
+	}
+
+	direction := 1.0
+	if p.NetPosition < 0 {
+		direction = -1.0
+	}
+	p.RealizedPnL += direction * float64(closed) * (float64(price) - p.AverageEntryPrice)
+
+	p.NetPosition += quantity
+	switch {
+	case p.NetPosition == 0:
+		p.AverageEntryPrice = 0
+	case abs(quantity) > closed:
+		p.AverageEntryPrice = float64(price)
+	}
+}
+
+// abs returns the absolute value of an int.
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
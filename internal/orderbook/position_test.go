@@ -0,0 +1,92 @@
+package orderbook_test
+
+import (
+	"testing"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestPositionKeeper(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ob := orderbook.NewOrderBook(true)
+
+	_, err := ob.ProcessFromStringInstructions(`
+N, 1, IBM, 10, 100, S, 1
+N, 2, IBM, 10, 60, B, 2
+N, 2, IBM, 12, 100, S, 3
+N, 3, IBM, 12, 100, B, 4
+`)
+	require.CmpNoError(err)
+
+	// User 1 sold 100 at 10 in two fills
+	assert.Cmp(ob.Positions.GetPosition(1, "IBM"), orderbook.Position{
+		User:              1,
+		Symbol:            "IBM",
+		NetPosition:       -100,
+		AverageEntryPrice: 10,
+	})
+
+	// User 2 bought 60 at 10 and sold them at 12, 40 are still resting
+	assert.Cmp(ob.Positions.GetPosition(2, "IBM"), orderbook.Position{
+		User:             2,
+		Symbol:           "IBM",
+		OpenSellQuantity: 40,
+		RealizedPnL:      120,
+	})
+
+	// User 3 bought 40 at 10 and 60 at 12
+	assert.Cmp(ob.Positions.GetPosition(3, "IBM"), orderbook.Position{
+		User:              3,
+		Symbol:            "IBM",
+		NetPosition:       100,
+		AverageEntryPrice: 11.2,
+	})
+	assert.Len(ob.Positions.GetPositions(3), 1)
+	assert.Empty(ob.Positions.GetPositions(4))
+
+	// Cancel releases the exposure
+	_, err = ob.ProcessFromStringInstructions("C, 2, 3")
+	require.CmpNoError(err)
+	assert.Cmp(ob.Positions.GetPosition(2, "IBM").OpenSellQuantity, 0)
+
+	// Flip the position of user 3: the new average entry price is the fill price
+	_, err = ob.ProcessFromStringInstructions(`
+N, 4, IBM, 11, 150, B, 5
+N, 3, IBM, 11, 150, S, 6
+`)
+	require.CmpNoError(err)
+	assert.Cmp(ob.Positions.GetPosition(3, "IBM"), td.Struct(orderbook.Position{
+		NetPosition:       -50,
+		AverageEntryPrice: 11,
+	}, td.StructFields{
+		"RealizedPnL": td.Between(-20.1, -19.9),
+	}))
+}
+
+func TestPositionKeeper_MaxPosition(t *testing.T) {
+	assert := td.Assert(t)
+
+	ob := orderbook.NewOrderBook(true)
+	ob.MaxPosition = 100
+
+	output, err := ob.ProcessFromStringInstructions(`
+N, 1, IBM, 10, 80, B, 1
+N, 1, IBM, 9, 20, B, 2
+N, 1, IBM, 8, 1, B, 3
+N, 1, IBM, 12, 100, S, 4
+N, 1, IBM, 12, 1, S, 5
+`)
+	assert.CmpNoError(err)
+
+	// Resting orders count in the potential position of the user
+	assert.Cmp(output, `A, 1, 1
+B, B, 10, 80
+A, 1, 2
+R, 1, 3
+A, 1, 4
+B, S, 12, 100
+R, 1, 5`)
+}
@@ -0,0 +1,106 @@
+package orderbook
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// Divergence describes the first output of a replay which differs from the recorded output.
+type Divergence struct {
+	Scenario    string   // Description of the scenario
+	Instruction string   // Instruction which produced the divergent output (empty if outputs are missing)
+	Line        int      // Line of the divergent output in the scenario outputs (starting at 1)
+	Expected    string   // Recorded output (empty if the replay produced more outputs)
+	Got         string   // Replayed output (empty if the replay produced less outputs)
+	Context     []string // Matching outputs before the divergence
+	Book        string   // State of the book after the instruction
+}
+
+// String returns a report of the divergence.
+func (d *Divergence) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s: first divergence at output line %d\n", d.Scenario, d.Line)
+	if d.Instruction != "" {
+		fmt.Fprintf(&sb, "instruction: %s\n", d.Instruction)
+	}
+	for _, line := range d.Context {
+		fmt.Fprintf(&sb, "  %s\n", line)
+	}
+	fmt.Fprintf(&sb, "- %s\n+ %s\n", d.Expected, d.Got)
+	fmt.Fprintf(&sb, "book:\n%s", d.Book)
+
+	return sb.String()
+}
+
+// DiffScenario replays the instructions of a scenario one by one through a new order book (with the options
+// of the scenario) and compares the outputs line by line to the recorded outputs of the scenario.
+// It returns the first divergence (with at most 'contextLines' outputs before it), or nil if the outputs are the same.
+func DiffScenario(scenario *Scenario, contextLines int) (*Divergence, error) {
+	ob, err := scenario.NewOrderBook()
+	if err != nil {
+		return nil, err
+	}
+
+	var expected []string
+	if scenario.Output != "" {
+		expected = strings.Split(scenario.Output, "\n")
+	}
+
+	var got []string
+
+	// divergence creates the divergence at the given index of outputs
+	divergence := func(instruction string, line int) *Divergence {
+		d := &Divergence{
+			Scenario:    scenario.Description,
+			Instruction: instruction,
+			Line:        line + 1,
+			Book:        ob.String(),
+		}
+
+		if line < len(expected) {
+			d.Expected = expected[line]
+		}
+		if line < len(got) {
+			d.Got = got[line]
+		}
+
+		start := line - contextLines
+		if start < 0 {
+			start = 0
+		}
+		d.Context = got[start:line]
+
+		return d
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(scenario.Instructions))
+	for scanner.Scan() {
+		instruction := strings.TrimSpace(scanner.Text())
+		if instruction == "" {
+			continue
+		}
+
+		if instruction[0] == 'F' {
+			break
+		}
+
+		output, err := ob.ProcessInstruction(instruction)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range output {
+			got = append(got, line)
+			if len(got) > len(expected) || line != expected[len(got)-1] {
+				return divergence(instruction, len(got)-1), nil
+			}
+		}
+	}
+
+	if len(got) < len(expected) {
+		return divergence("", len(got)), nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,94 @@
+package orderbook_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestDiffScenario(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	// All recorded scenarios replay without divergence
+	scenarios, err := orderbook.GetScenarios("testdata")
+	require.CmpNoError(err)
+	for _, s := range scenarios {
+		divergence, err := orderbook.DiffScenario(s, 3)
+		assert.CmpNoError(err)
+		assert.Nil(divergence, s.Description)
+	}
+
+	scenario := &orderbook.Scenario{
+		Description: "Divergent",
+		ShouldTrade: true,
+		Instructions: `N, 1, IBM, 10, 100, B, 1
+N, 2, IBM, 12, 100, S, 2
+N, 3, IBM, 9, 100, B, 3
+F`,
+		Output: `A, 1, 1
+B, B, 10, 100
+A, 2, 2
+B, S, 11, 100
+A, 3, 3`,
+	}
+
+	divergence, err := orderbook.DiffScenario(scenario, 2)
+	require.CmpNoError(err)
+	assert.Cmp(divergence, &orderbook.Divergence{
+		Scenario:    "Divergent",
+		Instruction: "N, 2, IBM, 12, 100, S, 2",
+		Line:        4,
+		Expected:    "B, S, 11, 100",
+		Got:         "B, S, 12, 100",
+		Context:     []string{"B, B, 10, 100", "A, 2, 2"},
+		Book: `S queue (S, 12, 100):
+  IBM, 12, 100, 2-2 (D)
+B queue (B, 10, 100):
+  IBM, 10, 100, 1-1 (D)
+`,
+	})
+
+	// Missing outputs
+	scenario.Output = `A, 1, 1
+B, B, 10, 100
+A, 2, 2
+B, S, 12, 100
+A, 3, 3
+B, B, 9, 100`
+	divergence, err = orderbook.DiffScenario(scenario, 0)
+	require.CmpNoError(err)
+	assert.Cmp(divergence, td.Struct(&orderbook.Divergence{
+		Line:     6,
+		Expected: "B, B, 9, 100",
+		Got:      "",
+	}, nil))
+}
+
+func TestReadScenarios_EmptyOutput(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	dir := t.TempDir()
+	inputPath, outputPath := filepath.Join(dir, "input.txt"), filepath.Join(dir, "output.txt")
+	require.CmpNoError(os.WriteFile(inputPath, []byte("# Scenarios\n# 1 First\nN, 1, IBM, 10, 100, B, 1\n# 1 Second\nF\n"), 0o644))
+	require.CmpNoError(os.WriteFile(outputPath, []byte("# First\nA, 1, 1\nB, B, 10, 100\n# Second\n"), 0o644))
+
+	// A scenario may have no output at all
+	scenarios, err := orderbook.ReadScenarios(inputPath, outputPath)
+	require.CmpNoError(err)
+	require.Len(scenarios, 2)
+	assert.Cmp(scenarios[1].Output, "")
+
+	divergence, err := orderbook.DiffScenario(scenarios[1], 0)
+	require.CmpNoError(err)
+	assert.Nil(divergence)
+
+	// An unexpected output diverges from the empty block
+	scenarios[1].Instructions = "N, 1, IBM, 10, 100, B, 1"
+	divergence, err = orderbook.DiffScenario(scenarios[1], 0)
+	require.CmpNoError(err)
+	assert.Cmp(divergence, td.Struct(&orderbook.Divergence{Line: 1, Expected: "", Got: "A, 1, 1"}, nil))
+}
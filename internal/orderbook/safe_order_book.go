@@ -0,0 +1,226 @@
+package orderbook
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrUnknownOrder is returned when amending an order which is not resting in the book.
+var ErrUnknownOrder = errors.New("Unknown order")
+
+// PriceLevel is the total quantity of the orders at a price.
+type PriceLevel struct {
+	Price    int
+	Quantity int
+}
+
+// BookDepth is the aggregated view of both sides of the book, best prices first.
+type BookDepth struct {
+	Bids []PriceLevel
+	Asks []PriceLevel
+}
+
+// SafeOrderBook is a goroutine-safe facade of an order book.
+// Operations which modify the book are serialized, and the outputs are published to subscribers
+// in the same order. After each operation, an immutable view of the depth is published,
+// so queries never wait for matching.
+type SafeOrderBook struct {
+	mu          sync.Mutex
+	ob          *OrderBook
+	subscribers map[int]subscriber
+	nextID      int
+
+	publishMu sync.Mutex // Held while sending to the subscribers, so outputs are published in order
+
+	depth atomic.Value // BookDepth
+}
+
+// subscriber is the channel of a subscriber, and a channel closed when it unsubscribes.
+type subscriber struct {
+	ch   chan string
+	done chan struct{}
+}
+
+// NewSafeOrderBook creates a goroutine-safe facade of the order book.
+// The order book must not be used directly anymore.
+func NewSafeOrderBook(ob *OrderBook) *SafeOrderBook {
+	sob := &SafeOrderBook{
+		ob:          ob,
+		subscribers: map[int]subscriber{},
+	}
+	sob.depth.Store(computeDepth(ob))
+
+	return sob
+}
+
+// Submit processes a new order and returns its outputs.
+// The order is copied, so the caller can reuse it.
+func (sob *SafeOrderBook) Submit(order Order) ([]string, error) {
+	return sob.process(order.Instruction())
+}
+
+// Cancel cancels an order and returns the outputs.
+func (sob *SafeOrderBook) Cancel(user, userOrderId int) ([]string, error) {
+	return sob.process(fmt.Sprintf("C, %d, %d", user, userOrderId))
+}
+
+// MassCancel cancels all the orders matching the filter and returns the outputs (see MassCancel).
+func (sob *SafeOrderBook) MassCancel(mc MassCancel) ([]string, error) {
+	return sob.process(mc.Instruction())
+}
+
+// Amend modifies the price and the quantity of a resting order and returns the outputs.
+// Reducing the quantity at the same price keeps the priority of the order.
+// Amending an order which is not resting in the book returns ErrUnknownOrder, without any output:
+// every output comes from an instruction of the order book, so it is journaled and sequenced.
+func (sob *SafeOrderBook) Amend(user, userOrderId, price, quantity int) ([]string, error) {
+	sob.mu.Lock()
+
+	existing, _ := sob.ob.findOrder(fmt.Sprintf("%d-%d", user, userOrderId))
+	if existing == nil {
+		sob.mu.Unlock()
+		return nil, ErrUnknownOrder
+	}
+
+	amended := *existing
+	amended.Price = price
+	amended.Quantity = quantity
+
+	output, err := sob.processLocked(amended.Instruction())
+	sob.publishAndUnlock(output)
+	return output, err
+}
+
+// TopOfBook returns the best bid and the best ask (nil if a side is empty).
+func (sob *SafeOrderBook) TopOfBook() (bid, ask *PriceLevel) {
+	depth := sob.depth.Load().(BookDepth)
+	if len(depth.Bids) > 0 {
+		bid = &depth.Bids[0]
+	}
+	if len(depth.Asks) > 0 {
+		ask = &depth.Asks[0]
+	}
+
+	return bid, ask
+}
+
+// Depth returns at most the given number of price levels per side (all of them if levels <= 0).
+func (sob *SafeOrderBook) Depth(levels int) BookDepth {
+	depth := sob.depth.Load().(BookDepth)
+	if levels > 0 && len(depth.Bids) > levels {
+		depth.Bids = depth.Bids[:levels]
+	}
+	if levels > 0 && len(depth.Asks) > levels {
+		depth.Asks = depth.Asks[:levels]
+	}
+
+	return depth
+}
+
+// OrderStatus returns the status of an order (see OrderStore.GetOrderStatus).
+func (sob *SafeOrderBook) OrderStatus(user, userOrderId int) (OrderStatus, bool) {
+	sob.mu.Lock()
+	defer sob.mu.Unlock()
+
+	return sob.ob.Orders.GetOrderStatus(user, userOrderId)
+}
+
+// Subscribe returns a channel which receives all the outputs of the order book from now on,
+// and a function to unsubscribe (which closes the channel).
+// The channel has the given buffer: a subscriber which does not consume its channel blocks the order book,
+// until it unsubscribes (which never waits for the order book).
+func (sob *SafeOrderBook) Subscribe(buffer int) (<-chan string, func()) {
+	sob.mu.Lock()
+	defer sob.mu.Unlock()
+
+	id := sob.nextID
+	sob.nextID++
+	sub := subscriber{ch: make(chan string, buffer), done: make(chan struct{})}
+	sob.subscribers[id] = sub
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			// Unblock a publication in progress, then close the channel once nobody can send to it
+			close(sub.done)
+			sob.mu.Lock()
+			delete(sob.subscribers, id)
+			sob.mu.Unlock()
+
+			sob.publishMu.Lock()
+			close(sub.ch)
+			sob.publishMu.Unlock()
+		})
+	}
+}
+
+// process processes an instruction and publishes its outputs (see processLocked).
+func (sob *SafeOrderBook) process(instruction string) ([]string, error) {
+	sob.mu.Lock()
+	output, err := sob.processLocked(instruction)
+	sob.publishAndUnlock(output)
+
+	return output, err
+}
+
+// processLocked processes an instruction, then publishes the new depth.
+// The lock must be held.
+func (sob *SafeOrderBook) processLocked(instruction string) ([]string, error) {
+	output, err := sob.ob.ProcessInstruction(instruction)
+	if err != nil {
+		return nil, err
+	}
+
+	sob.depth.Store(computeDepth(sob.ob))
+
+	return output, nil
+}
+
+// publishAndUnlock sends the outputs to all the subscribers. The lock must be held: it is released before
+// sending, so a blocked subscriber never holds the lock, while publications keep the order of the operations.
+func (sob *SafeOrderBook) publishAndUnlock(output []string) {
+	sob.publishMu.Lock()
+	defer sob.publishMu.Unlock()
+
+	subscribers := make([]subscriber, 0, len(sob.subscribers))
+	for _, sub := range sob.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	sob.mu.Unlock()
+
+	for _, line := range output {
+		for _, sub := range subscribers {
+			select {
+			case sub.ch <- line:
+			case <-sub.done:
+			}
+		}
+	}
+}
+
+// computeDepth aggregates the orders of the book by price level.
+func computeDepth(ob *OrderBook) BookDepth {
+	return BookDepth{
+		Bids: priceLevels(ob.BidQueue),
+		Asks: priceLevels(ob.AskQueue),
+	}
+}
+
+// priceLevels returns the price levels of the queue, best prices first.
+func priceLevels(queue *OrderQueue) []PriceLevel {
+	levels := make([]PriceLevel, 0, len(queue.mapPriceToQuantity))
+	for price, quantity := range queue.mapPriceToQuantity {
+		if quantity > 0 {
+			levels = append(levels, PriceLevel{Price: price, Quantity: quantity})
+		}
+	}
+
+	sort.Slice(levels, func(i, j int) bool {
+		return queue.compareFunc(levels[i].Price, levels[j].Price)
+	})
+
+	return levels
+}
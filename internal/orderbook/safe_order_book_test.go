@@ -0,0 +1,172 @@
+package orderbook_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestSafeOrderBook(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	sob := orderbook.NewSafeOrderBook(orderbook.NewOrderBook(true))
+	outputs, unsubscribe := sob.Subscribe(10)
+
+	output, err := sob.Submit(orderbook.Order{User: 1, Symbol: "IBM", Price: 10, Quantity: 100, UserOrderId: 1, OrderSide: "B"})
+	require.CmpNoError(err)
+	assert.Cmp(output, []string{"A, 1, 1", "B, B, 10, 100"})
+
+	_, err = sob.Submit(orderbook.Order{User: 2, Symbol: "IBM", Price: 9, Quantity: 50, UserOrderId: 1, OrderSide: "B"})
+	require.CmpNoError(err)
+	_, err = sob.Submit(orderbook.Order{User: 2, Symbol: "IBM", Price: 12, Quantity: 20, UserOrderId: 2, OrderSide: "S"})
+	require.CmpNoError(err)
+
+	bid, ask := sob.TopOfBook()
+	assert.Cmp(bid, &orderbook.PriceLevel{Price: 10, Quantity: 100})
+	assert.Cmp(ask, &orderbook.PriceLevel{Price: 12, Quantity: 20})
+
+	output, err = sob.Amend(1, 1, 10, 40)
+	require.CmpNoError(err)
+	assert.Cmp(output, []string{"A, 1, 1", "B, B, 10, 40"})
+
+	output, err = sob.Amend(1, 42, 10, 40)
+	assert.Cmp(err, orderbook.ErrUnknownOrder)
+	assert.Nil(output)
+
+	assert.Cmp(sob.Depth(0), orderbook.BookDepth{
+		Bids: []orderbook.PriceLevel{{Price: 10, Quantity: 40}, {Price: 9, Quantity: 50}},
+		Asks: []orderbook.PriceLevel{{Price: 12, Quantity: 20}},
+	})
+	assert.Cmp(sob.Depth(1).Bids, []orderbook.PriceLevel{{Price: 10, Quantity: 40}})
+
+	output, err = sob.Cancel(2, 2)
+	require.CmpNoError(err)
+	assert.Cmp(output, []string{"A, 2, 2", "B, S, -, -"})
+
+	_, ask = sob.TopOfBook()
+	assert.Nil(ask)
+
+	// Subscribers receive all the outputs in order
+	unsubscribe()
+	var published []string
+	for line := range outputs {
+		published = append(published, line)
+	}
+	assert.Cmp(published, []string{
+		"A, 1, 1", "B, B, 10, 100",
+		"A, 2, 1",
+		"A, 2, 2", "B, S, 12, 20",
+		"A, 1, 1", "B, B, 10, 40",
+		"A, 2, 2", "B, S, -, -",
+	})
+}
+
+// TestSafeOrderBook_Concurrency must be run with the race detector.
+func TestSafeOrderBook_Concurrency(t *testing.T) {
+	assert := td.Assert(t)
+
+	sob := orderbook.NewSafeOrderBook(orderbook.NewOrderBook(true))
+	outputs, unsubscribe := sob.Subscribe(0)
+
+	var published int
+	consumerDone := make(chan struct{})
+	go func() {
+		defer close(consumerDone)
+		for range outputs {
+			published++
+		}
+	}()
+
+	const users, orders = 8, 200
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var returned int
+	for user := 1; user <= users; user++ {
+		wg.Add(2)
+
+		// Writer
+		go func(user int) {
+			defer wg.Done()
+			count := 0
+			for i := 1; i <= orders; i++ {
+				side := "B"
+				if (user+i)%2 == 0 {
+					side = "S"
+				}
+
+				output, err := sob.Submit(orderbook.Order{User: user, Symbol: "IBM", Price: 95 + i%10, Quantity: 10, UserOrderId: i, OrderSide: side})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				count += len(output)
+
+				switch i % 3 {
+				case 0:
+					output, err = sob.Cancel(user, i)
+				case 1:
+					output, err = sob.Amend(user, i, 95+i%10, 5)
+				default:
+					continue
+				}
+				if err != nil && err != orderbook.ErrUnknownOrder { // The order may be filled
+					t.Error(err)
+					return
+				}
+				count += len(output)
+			}
+
+			mu.Lock()
+			returned += count
+			mu.Unlock()
+		}(user)
+
+		// Reader
+		go func() {
+			defer wg.Done()
+			for i := 0; i < orders; i++ {
+				sob.TopOfBook()
+				depth := sob.Depth(5)
+				if len(depth.Bids) > 5 || len(depth.Asks) > 5 {
+					t.Errorf("Too many levels: %v", depth)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	unsubscribe()
+	<-consumerDone
+
+	assert.Cmp(published, returned, fmt.Sprintf("%d outputs returned", returned))
+}
+
+func TestSafeOrderBook_SlowSubscriber(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	sob := orderbook.NewSafeOrderBook(orderbook.NewOrderBook(true))
+	_, unsubscribe := sob.Subscribe(0)
+
+	// The subscriber never consumes its channel, so the order book is blocked
+	submitDone := make(chan []string)
+	go func() {
+		output, err := sob.Submit(orderbook.Order{User: 1, Symbol: "IBM", Price: 10, Quantity: 100, UserOrderId: 1, OrderSide: "B"})
+		if err != nil {
+			t.Error(err)
+		}
+		submitDone <- output
+	}()
+
+	// Unsubscribing unblocks it
+	unsubscribe()
+	assert.Cmp(<-submitDone, []string{"A, 1, 1", "B, B, 10, 100"})
+
+	output, err := sob.Cancel(1, 1)
+	require.CmpNoError(err)
+	assert.Cmp(output, []string{"A, 1, 1", "B, B, -, -"})
+}
@@ -8,19 +8,31 @@ import (
 	"strings"
 )
 
+// Scenario is a list of instructions with the outputs they should produce. Scenarios in format v2 (see ParseScenarios)
+// also have options for their order book and their steps with inline expectations.
 type Scenario struct {
 	Description  string
 	ShouldTrade  bool
 	Instructions string
 	Output       string
+
+	File    string // Format v2 only
+	Line    int
+	Options []ScenarioOption
+	Steps   []ScenarioStep
 }
 
 // GetScenarios gets all scenarios from input.txt and associated output (output.txt)
 func GetScenarios(folderPath string) ([]*Scenario, error) {
+	return ReadScenarios(fmt.Sprintf("%s/input.txt", folderPath), fmt.Sprintf("%s/output.txt", folderPath))
+}
+
+// ReadScenarios gets all scenarios from an input file and associated outputs from an output file
+func ReadScenarios(inputPath, outputPath string) ([]*Scenario, error) {
 	var scenarios []*Scenario
 
 	// Input
-	b, err := os.ReadFile(fmt.Sprintf("%s/input.txt", folderPath))
+	b, err := os.ReadFile(inputPath)
 	if err != nil {
 		return nil, err
 	}
@@ -44,7 +56,7 @@ func GetScenarios(folderPath string) ([]*Scenario, error) {
 	}
 
 	// Output
-	b, err = os.ReadFile(fmt.Sprintf("%s/output.txt", folderPath))
+	b, err = os.ReadFile(outputPath)
 	if err != nil {
 		return nil, err
 	}
@@ -59,11 +71,8 @@ func GetScenarios(folderPath string) ([]*Scenario, error) {
 		return nil, errors.New("Inputs and outputs number should be the same")
 	}
 
+	// Outputs are trimmed, an empty one is a scenario without any output
 	for i, o := range outputs {
-		// Remove '\n'
-		if o[len(o)-1] == '\n' {
-			o = o[:len(o)-1]
-		}
 		scenarios[i].Output = o
 	}
 
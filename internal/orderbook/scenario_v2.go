@@ -0,0 +1,416 @@
+package orderbook
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ScenarioOption is an option of the order book of a scenario (format v2), e.g. '@halt-policy queue'.
+type ScenarioOption struct {
+	Line int
+	Name string
+	Args []string
+}
+
+// ScenarioStep is an instruction of a scenario (format v2) with the outputs it should produce
+// and the assertions on the state of the book checked after it.
+type ScenarioStep struct {
+	Line        int
+	Instruction string
+	Expected    []string
+	Assertions  []ScenarioAssertion
+}
+
+// ScenarioAssertion is a named assertion on the state of the book, e.g. '? best-bid = 10, 100'.
+type ScenarioAssertion struct {
+	Line     int
+	Name     string
+	Args     []string
+	Expected string
+}
+
+// scenarioAssertion evaluates a named assertion: it returns the value to compare to the expected one.
+type scenarioAssertion struct {
+	args int
+	eval func(ob *OrderBook, args []string) (string, error)
+}
+
+var scenarioAssertions = map[string]scenarioAssertion{
+	"best-bid": {0, func(ob *OrderBook, _ []string) (string, error) {
+		return strings.TrimPrefix(ob.BidQueue.GetTOBInfo(), ob.BidQueue.OrderSide+", "), nil
+	}},
+	"best-ask": {0, func(ob *OrderBook, _ []string) (string, error) {
+		return strings.TrimPrefix(ob.AskQueue.GetTOBInfo(), ob.AskQueue.OrderSide+", "), nil
+	}},
+	"orders": {1, func(ob *OrderBook, args []string) (string, error) {
+		switch args[0] {
+		case ob.BidQueue.OrderSide:
+			return strconv.Itoa(ob.BidQueue.Len()), nil
+		case ob.AskQueue.OrderSide:
+			return strconv.Itoa(ob.AskQueue.Len()), nil
+		}
+		return "", fmt.Errorf("Unknown side: %q", args[0])
+	}},
+	"state": {1, func(ob *OrderBook, args []string) (string, error) {
+		return ob.GetTradingState(args[0]).String(), nil
+	}},
+	"status": {2, func(ob *OrderBook, args []string) (string, error) {
+		user, userOrderId, err := atoi2(args[0], args[1])
+		if err != nil {
+			return "", err
+		}
+		if status, ok := ob.Orders.GetOrderStatus(user, userOrderId); ok {
+			return status.State.String(), nil
+		}
+		return "UNKNOWN", nil
+	}},
+	"position": {2, func(ob *OrderBook, args []string) (string, error) {
+		user, err := strconv.Atoi(args[0])
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(ob.Positions.GetPosition(user, args[1]).NetPosition), nil
+	}},
+	"balance": {2, func(ob *OrderBook, args []string) (string, error) {
+		b, err := scenarioBalance(ob, args)
+		return strconv.Itoa(b.Total), err
+	}},
+	"reserved": {2, func(ob *OrderBook, args []string) (string, error) {
+		b, err := scenarioBalance(ob, args)
+		return strconv.Itoa(b.Reserved), err
+	}},
+}
+
+// ReadScenarioFile reads the scenarios of a file in format v2 (see ParseScenarios).
+func ReadScenarioFile(path string) ([]*Scenario, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseScenarios(file, path)
+}
+
+// ParseScenarios parses scenarios in format v2, the name of the file is used in errors. Each line is:
+//
+//	=== description      starts a new scenario
+//	@option args...      an option of the order book of the scenario (before its first instruction)
+//	N, 1, IBM, ...       an instruction
+//	> A, 1, 1            an output expected from the previous instruction, in order
+//	? name args = value  an assertion on the state of the book after the previous instruction
+//	# comment
+//
+// An instruction must produce exactly its expected outputs (none if it has no '>' line).
+// It returns an error with the line number if the file is malformed.
+func ParseScenarios(r io.Reader, name string) ([]*Scenario, error) {
+	var scenarios []*Scenario
+	var current *Scenario
+	var options *OrderBook // Order book of the current scenario, to validate its options
+
+	line := 0
+	errorf := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%s:%d: %s", name, line, fmt.Sprintf(format, args...))
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		if strings.HasPrefix(text, "===") {
+			current = &Scenario{File: name, Line: line, Description: strings.TrimSpace(text[3:]), ShouldTrade: true}
+			options = NewOrderBook(true)
+			scenarios = append(scenarios, current)
+			continue
+		}
+
+		if current == nil {
+			return nil, errorf("%q is outside of a scenario (missing '=== description' line)", text)
+		}
+
+		var step *ScenarioStep
+		if n := len(current.Steps); n > 0 {
+			step = &current.Steps[n-1]
+		}
+
+		switch text[0] {
+		case '@':
+			if step != nil {
+				return nil, errorf("Option %q should be before the first instruction", text)
+			}
+
+			fields := strings.Fields(text[1:])
+			if len(fields) == 0 {
+				return nil, errorf("Missing option name")
+			}
+
+			option := ScenarioOption{Line: line, Name: fields[0], Args: fields[1:]}
+			if err := applyScenarioOption(options, option); err != nil {
+				return nil, errorf("%s", err)
+			}
+			current.Options = append(current.Options, option)
+			current.ShouldTrade = options.ShouldTrade
+
+		case '>':
+			if step == nil {
+				return nil, errorf("Expected output %q should follow an instruction", text)
+			}
+			step.Expected = append(step.Expected, strings.TrimSpace(text[1:]))
+
+		case '?':
+			if step == nil {
+				return nil, errorf("Assertion %q should follow an instruction", text)
+			}
+
+			assertion, err := parseScenarioAssertion(text[1:])
+			if err != nil {
+				return nil, errorf("%s", err)
+			}
+			assertion.Line = line
+			step.Assertions = append(step.Assertions, assertion)
+
+		default:
+			if !strings.ContainsRune("NCMSDWF", rune(text[0])) {
+				return nil, errorf("Unknown instruction: %q", text)
+			}
+			current.Steps = append(current.Steps, ScenarioStep{Line: line, Instruction: text})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Fill the instructions and outputs, as in format v1
+	for _, s := range scenarios {
+		var instructions, outputs []string
+		for _, step := range s.Steps {
+			instructions = append(instructions, step.Instruction)
+			outputs = append(outputs, step.Expected...)
+		}
+		s.Instructions = strings.Join(instructions, "\n")
+		s.Output = strings.Join(outputs, "\n")
+	}
+
+	return scenarios, nil
+}
+
+// NewOrderBook creates an order book with the options of the scenario.
+func (s *Scenario) NewOrderBook() (*OrderBook, error) {
+	ob := NewOrderBook(s.ShouldTrade)
+	for _, option := range s.Options {
+		if err := applyScenarioOption(ob, option); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", s.File, option.Line, err)
+		}
+	}
+
+	return ob, nil
+}
+
+// RunScenario runs the steps of a scenario (format v2) through a new order book: each instruction must
+// produce exactly its expected outputs and its assertions must hold.
+// It returns an error with the line of the first failure.
+func RunScenario(s *Scenario) error {
+	ob, err := s.NewOrderBook()
+	if err != nil {
+		return err
+	}
+
+	for _, step := range s.Steps {
+		output, err := ob.ProcessInstruction(step.Instruction)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", s.File, step.Line, err)
+		}
+
+		if strings.Join(output, "\n") != strings.Join(step.Expected, "\n") {
+			return fmt.Errorf("%s:%d: %q produced %q instead of %q", s.File, step.Line, step.Instruction, output, step.Expected)
+		}
+
+		for _, assertion := range step.Assertions {
+			got, err := scenarioAssertions[assertion.Name].eval(ob, assertion.Args)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", s.File, assertion.Line, err)
+			}
+
+			if got != assertion.Expected {
+				return fmt.Errorf("%s:%d: %s is %q instead of %q",
+					s.File, assertion.Line, strings.Join(append([]string{assertion.Name}, assertion.Args...), " "), got, assertion.Expected)
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseScenarioAssertion parses an assertion of the form 'name args... = expected'.
+func parseScenarioAssertion(text string) (ScenarioAssertion, error) {
+	left, expected, ok := strings.Cut(text, "=")
+	if !ok {
+		return ScenarioAssertion{}, fmt.Errorf("Missing '=' in assertion: %q", text)
+	}
+
+	fields := strings.Fields(left)
+	if len(fields) == 0 {
+		return ScenarioAssertion{}, fmt.Errorf("Missing assertion name: %q", text)
+	}
+
+	assertion, ok := scenarioAssertions[fields[0]]
+	if !ok {
+		return ScenarioAssertion{}, fmt.Errorf("Unknown assertion %q", fields[0])
+	}
+	if len(fields)-1 != assertion.args {
+		return ScenarioAssertion{}, fmt.Errorf("Assertion %q should have %d arguments: %q", fields[0], assertion.args, text)
+	}
+
+	return ScenarioAssertion{Name: fields[0], Args: fields[1:], Expected: strings.TrimSpace(expected)}, nil
+}
+
+// applyScenarioOption applies an option to the order book of a scenario.
+func applyScenarioOption(ob *OrderBook, option ScenarioOption) error {
+	args := option.Args
+	checkArgs := func(n int) error {
+		if len(args) != n {
+			return fmt.Errorf("Option %q should have %d arguments: %q", option.Name, n, args)
+		}
+		return nil
+	}
+
+	switch option.Name {
+	case "trade", "execution-reports":
+		if err := checkArgs(1); err != nil {
+			return err
+		}
+
+		var enabled bool
+		switch args[0] {
+		case "on":
+			enabled = true
+		case "off":
+		default:
+			return fmt.Errorf("Option %q should be 'on' or 'off': %q", option.Name, args[0])
+		}
+
+		if option.Name == "trade" {
+			ob.ShouldTrade = enabled
+		} else {
+			ob.ExecutionReports = enabled
+		}
+
+	case "halt-policy":
+		if err := checkArgs(1); err != nil {
+			return err
+		}
+
+		switch args[0] {
+		case "reject":
+			ob.HaltPolicy = RejectHaltPolicy
+		case "queue":
+			ob.HaltPolicy = QueueHaltPolicy
+		default:
+			return fmt.Errorf("Unknown halt policy: %q", args[0])
+		}
+
+	case "matching":
+		if err := checkArgs(1); err != nil {
+			return err
+		}
+
+		switch args[0] {
+		case "price-time":
+			ob.MatchingPolicy = PriceTimeMatchingPolicy
+		case "pro-rata":
+			ob.MatchingPolicy = ProRataMatchingPolicy
+		default:
+			return fmt.Errorf("Unknown matching policy: %q", args[0])
+		}
+
+	case "stp":
+		if err := checkArgs(1); err != nil {
+			return err
+		}
+
+		switch args[0] {
+		case "none":
+			ob.SelfTradePrevention = NoSelfTradePrevention
+		case "cancel-newest":
+			ob.SelfTradePrevention = CancelNewestSelfTradePrevention
+		default:
+			return fmt.Errorf("Unknown self-trade prevention: %q", args[0])
+		}
+
+	case "max-position":
+		if err := checkArgs(1); err != nil {
+			return err
+		}
+
+		maxPosition, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		ob.MaxPosition = maxPosition
+
+	case "instrument":
+		if err := checkArgs(3); err != nil {
+			return err
+		}
+		scenarioAccounts(ob).SetInstrument(args[0], Instrument{Base: args[1], Quote: args[2]})
+
+	case "deposit":
+		if err := checkArgs(3); err != nil {
+			return err
+		}
+
+		user, amount, err := atoi2(args[0], args[2])
+		if err != nil {
+			return err
+		}
+		return scenarioAccounts(ob).Deposit(user, args[1], amount)
+
+	default:
+		return fmt.Errorf("Unknown option %q", option.Name)
+	}
+
+	return nil
+}
+
+// scenarioAccounts returns the account service of the order book of a scenario, and creates it if needed.
+func scenarioAccounts(ob *OrderBook) *AccountService {
+	if ob.Accounts == nil {
+		ob.Accounts = NewAccountService()
+	}
+
+	return ob.Accounts
+}
+
+// scenarioBalance returns the balance of an assertion with the arguments 'user asset'.
+func scenarioBalance(ob *OrderBook, args []string) (Balance, error) {
+	if ob.Accounts == nil {
+		return Balance{}, fmt.Errorf("Accounts are not enabled (see options 'instrument' and 'deposit')")
+	}
+
+	user, err := strconv.Atoi(args[0])
+	if err != nil {
+		return Balance{}, err
+	}
+
+	return ob.Accounts.GetBalance(user, args[1]), nil
+}
+
+// atoi2 converts two strings to ints.
+func atoi2(a, b string) (int, int, error) {
+	x, err := strconv.Atoi(a)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	y, err := strconv.Atoi(b)
+	return x, y, err
+}
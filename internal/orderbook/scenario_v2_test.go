@@ -0,0 +1,117 @@
+package orderbook_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestRunScenario(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	scenarios, err := orderbook.ReadScenarioFile("testdata/scenarios.txt")
+	require.CmpNoError(err)
+	require.Len(scenarios, 6)
+	for _, s := range scenarios {
+		assert.CmpNoError(orderbook.RunScenario(s), s.Description)
+	}
+
+	// Options and inline expectations
+	s := scenarios[3]
+	assert.Cmp(s.Line, 47)
+	assert.Cmp(s.Options, []orderbook.ScenarioOption{
+		{Line: 48, Name: "instrument", Args: []string{"BTC/USD", "BTC", "USD"}},
+		{Line: 49, Name: "deposit", Args: []string{"1", "USD", "1000"}},
+	})
+	assert.Cmp(s.Steps[0], orderbook.ScenarioStep{
+		Line:        50,
+		Instruction: "N, 1, BTC/USD, 100, 5, B, 1",
+		Expected:    []string{"A, 1, 1", "B, B, 100, 5"},
+		Assertions:  []orderbook.ScenarioAssertion{{Line: 53, Name: "reserved", Args: []string{"1", "USD"}, Expected: "500"}},
+	})
+	assert.Cmp(s.Instructions, "N, 1, BTC/USD, 100, 5, B, 1\nN, 1, BTC/USD, 100, 6, B, 2\nC, 1, 1\nW, 1, USD, 400\nD, 1, USD, 100")
+
+	// The trade bit of format v1 is an option
+	assert.False(scenarios[0].ShouldTrade)
+	assert.True(scenarios[1].ShouldTrade)
+
+	// Scenarios in format v2 can be replayed
+	divergence, err := orderbook.DiffScenario(s, 3)
+	assert.CmpNoError(err)
+	assert.Nil(divergence)
+}
+
+func TestRunScenario_Failures(t *testing.T) {
+	assert := td.Assert(t)
+
+	run := func(content string) error {
+		scenarios, err := orderbook.ParseScenarios(strings.NewReader(content), "test.txt")
+		if err != nil {
+			return err
+		}
+		return orderbook.RunScenario(scenarios[0])
+	}
+
+	assert.CmpNoError(run(`=== OK
+N, 1, IBM, 10, 100, B, 1
+> A, 1, 1
+> B, B, 10, 100
+? best-bid = 10, 100
+? best-ask = -, -
+`))
+
+	assert.String(run(`=== Missing output
+N, 1, IBM, 10, 100, B, 1
+> A, 1, 1
+`), `test.txt:2: "N, 1, IBM, 10, 100, B, 1" produced ["A, 1, 1" "B, B, 10, 100"] instead of ["A, 1, 1"]`)
+
+	assert.String(run(`=== Wrong assertion
+N, 1, IBM, 10, 100, B, 1
+> A, 1, 1
+> B, B, 10, 100
+
+? orders B = 2
+`), `test.txt:6: orders B is "1" instead of "2"`)
+
+	assert.Cmp(run(`=== Invalid instruction
+N, 1, IBM
+`), td.HasPrefix("test.txt:2: "))
+
+	assert.String(run(`=== Accounts disabled
+F
+? balance 1 USD = 0
+`), "test.txt:3: Accounts are not enabled (see options 'instrument' and 'deposit')")
+}
+
+func TestParseScenarios_Errors(t *testing.T) {
+	assert := td.Assert(t)
+
+	parse := func(content string) error {
+		_, err := orderbook.ParseScenarios(strings.NewReader(content), "test.txt")
+		return err
+	}
+
+	for content, expected := range map[string]string{
+		"# comment\nN, 1, IBM, 10, 100, B, 1": `test.txt:2: "N, 1, IBM, 10, 100, B, 1" is outside of a scenario (missing '=== description' line)`,
+		"=== S\n> A, 1, 1":                    `test.txt:2: Expected output "> A, 1, 1" should follow an instruction`,
+		"=== S\n? best-bid = -, -":            `test.txt:2: Assertion "? best-bid = -, -" should follow an instruction`,
+		"=== S\nX, 1":                         `test.txt:2: Unknown instruction: "X, 1"`,
+		"=== S\nF\n@trade off":                `test.txt:3: Option "@trade off" should be before the first instruction`,
+		"=== S\n@":                            "test.txt:2: Missing option name",
+		"=== S\n@tick-size 5":                 `test.txt:2: Unknown option "tick-size"`,
+		"=== S\n@matching random":             `test.txt:2: Unknown matching policy: "random"`,
+		"=== S\n@stp cancel-oldest":           `test.txt:2: Unknown self-trade prevention: "cancel-oldest"`,
+		"=== S\n@trade yes":                   `test.txt:2: Option "trade" should be 'on' or 'off': "yes"`,
+		"=== S\n@halt-policy wait":            `test.txt:2: Unknown halt policy: "wait"`,
+		"=== S\n@instrument BTC/USD BTC":      `test.txt:2: Option "instrument" should have 3 arguments: ["BTC/USD" "BTC"]`,
+		"=== S\n@deposit 1 USD 0":             "test.txt:2: Deposit amount should be positive: 0",
+		"=== S\nF\n? best-bid -, -":           `test.txt:3: Missing '=' in assertion: " best-bid -, -"`,
+		"=== S\nF\n? volume = 0":              `test.txt:3: Unknown assertion "volume"`,
+		"=== S\nF\n? status 1 = NEW":          `test.txt:3: Assertion "status" should have 2 arguments: " status 1 = NEW"`,
+	} {
+		assert.String(parse(content), expected, content)
+	}
+}
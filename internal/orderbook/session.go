@@ -0,0 +1,168 @@
+package orderbook
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SessionPhase is a phase of the trading session of a symbol.
+type SessionPhase int
+
+const (
+	PreOpenSessionPhase SessionPhase = iota
+	OpeningAuctionSessionPhase
+	ContinuousSessionPhase
+	ClosingAuctionSessionPhase
+	ClosedSessionPhase
+)
+
+var sessionPhaseNames = map[SessionPhase]string{
+	PreOpenSessionPhase:        "PRE_OPEN",
+	OpeningAuctionSessionPhase: "OPENING_AUCTION",
+	ContinuousSessionPhase:     "CONTINUOUS",
+	ClosingAuctionSessionPhase: "CLOSING_AUCTION",
+	ClosedSessionPhase:         "CLOSED",
+}
+
+// String returns the name of the session phase as it appears in outputs.
+func (sp SessionPhase) String() string {
+	if name, ok := sessionPhaseNames[sp]; ok {
+		return name
+	}
+	return fmt.Sprintf("SessionPhase(%d)", int(sp))
+}
+
+// ParseSessionPhase returns the session phase of the given name (case insensitive).
+func ParseSessionPhase(name string) (SessionPhase, error) {
+	for phase, phaseName := range sessionPhaseNames {
+		if strings.EqualFold(name, phaseName) {
+			return phase, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Unknown session phase: %q", name)
+}
+
+// TradingState returns the trading state of the order book during the phase:
+//   - pre-open: only cancels are accepted
+//   - opening and closing auctions: orders are accepted but not matched
+//   - continuous: orders are matched
+//   - closed: only cancels are accepted (DAY orders are expired when entering this phase)
+func (sp SessionPhase) TradingState() TradingState {
+	switch sp {
+	case PreOpenSessionPhase:
+		return PreOpenTradingState
+	case OpeningAuctionSessionPhase, ClosingAuctionSessionPhase:
+		return AuctionTradingState
+	case ContinuousSessionPhase:
+		return ContinuousTradingState
+	default:
+		return ClosedTradingState
+	}
+}
+
+// SessionPhaseStart is the start of a phase in a daily schedule.
+// 'Start' is the duration since midnight (in the location of the clock).
+type SessionPhaseStart struct {
+	Phase SessionPhase
+	Start time.Duration
+}
+
+// SessionController drives the trading state of a symbol in an order book from a daily schedule.
+// Transitions happen when 'Update' is called, depending of the time of the clock.
+type SessionController struct {
+	Symbol string
+
+	ob       *OrderBook
+	schedule []SessionPhaseStart
+	clock    Clock
+	current  int // Index of the current phase in the schedule, -1 before the first update
+}
+
+// NewSessionController creates a session controller for the symbol.
+// The schedule must not be empty, its starts must be increasing and within a day.
+// Before the start of the first phase, the symbol is in the last phase of the schedule (of the day before).
+func NewSessionController(ob *OrderBook, symbol string, schedule []SessionPhaseStart, clock Clock) (*SessionController, error) {
+	if len(schedule) == 0 {
+		return nil, errors.New("Session schedule should not be empty")
+	}
+
+	for i, phaseStart := range schedule {
+		if phaseStart.Start < 0 || phaseStart.Start >= 24*time.Hour {
+			return nil, fmt.Errorf("Start of phase %s should be within a day: %s", phaseStart.Phase, phaseStart.Start)
+		}
+		if i > 0 && phaseStart.Start <= schedule[i-1].Start {
+			return nil, fmt.Errorf("Start of phase %s should be after the start of phase %s", phaseStart.Phase, schedule[i-1].Phase)
+		}
+	}
+
+	return &SessionController{
+		Symbol:   symbol,
+		ob:       ob,
+		schedule: schedule,
+		clock:    clock,
+		current:  -1,
+	}, nil
+}
+
+// Phase returns the current phase of the session (the phase of the clock before the first update).
+func (sc *SessionController) Phase() SessionPhase {
+	if sc.current < 0 {
+		return sc.schedule[sc.scheduledIndex()].Phase
+	}
+	return sc.schedule[sc.current].Phase
+}
+
+// Update applies the transitions to reach the phase scheduled at the current time of the clock.
+// If several phases were missed, they are all applied in order so that auctions are uncrossed
+// and DAY orders are expired.
+// Each transition is processed as a 'S, symbol, state, phase' instruction, so that it is journaled:
+// it publishes a phase change output 'P, symbol, phase' followed by the outputs of the trading state change.
+func (sc *SessionController) Update() ([]string, error) {
+	target := sc.scheduledIndex()
+	if sc.current < 0 {
+		return sc.transition(target)
+	}
+
+	var result []string
+	for sc.current != target {
+		output, err := sc.transition((sc.current + 1) % len(sc.schedule))
+		if err != nil {
+			return result, err
+		}
+		result = append(result, output...)
+	}
+
+	return result, nil
+}
+
+// scheduledIndex returns the index of the phase scheduled at the current time of the clock.
+func (sc *SessionController) scheduledIndex() int {
+	now := sc.clock.Now()
+	year, month, day := now.Date()
+	sinceMidnight := now.Sub(time.Date(year, month, day, 0, 0, 0, 0, now.Location()))
+
+	index := len(sc.schedule) - 1
+	for i, phaseStart := range sc.schedule {
+		if phaseStart.Start <= sinceMidnight {
+			index = i
+		}
+	}
+
+	return index
+}
+
+// transition switches to the phase at the given index of the schedule.
+func (sc *SessionController) transition(index int) ([]string, error) {
+	phase := sc.schedule[index].Phase
+
+	output, err := sc.ob.ProcessInstruction(fmt.Sprintf("S, %s, %s, %s", sc.Symbol, phase.TradingState(), phase))
+	if err != nil {
+		return nil, err
+	}
+	sc.current = index
+
+	return output, nil
+}
@@ -0,0 +1,121 @@
+package orderbook_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+var testSchedule = []orderbook.SessionPhaseStart{
+	{Phase: orderbook.PreOpenSessionPhase, Start: 8 * time.Hour},
+	{Phase: orderbook.OpeningAuctionSessionPhase, Start: 9 * time.Hour},
+	{Phase: orderbook.ContinuousSessionPhase, Start: 9*time.Hour + 30*time.Minute},
+	{Phase: orderbook.ClosingAuctionSessionPhase, Start: 17*time.Hour + 30*time.Minute},
+	{Phase: orderbook.ClosedSessionPhase, Start: 17*time.Hour + 35*time.Minute},
+}
+
+func TestNewSessionController(t *testing.T) {
+	assert := td.Assert(t)
+
+	ob := orderbook.NewOrderBook(true)
+	clock := orderbook.NewFakeClock(time.Date(2022, 1, 3, 7, 0, 0, 0, time.UTC))
+
+	_, err := orderbook.NewSessionController(ob, "IBM", nil, clock)
+	assert.CmpError(err, "Session schedule should not be empty")
+
+	_, err = orderbook.NewSessionController(ob, "IBM", []orderbook.SessionPhaseStart{
+		{Phase: orderbook.ContinuousSessionPhase, Start: 9 * time.Hour},
+		{Phase: orderbook.ClosedSessionPhase, Start: 8 * time.Hour},
+	}, clock)
+	assert.CmpError(err, "Start of phase CLOSED should be after the start of phase CONTINUOUS")
+
+	_, err = orderbook.NewSessionController(ob, "IBM", []orderbook.SessionPhaseStart{
+		{Phase: orderbook.ContinuousSessionPhase, Start: 25 * time.Hour},
+	}, clock)
+	assert.CmpError(err, "Start of phase CONTINUOUS should be within a day: 25h0m0s")
+}
+
+func TestSessionController(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ob := orderbook.NewOrderBook(true)
+	clock := orderbook.NewFakeClock(time.Date(2022, 1, 3, 7, 0, 0, 0, time.UTC))
+
+	sc, err := orderbook.NewSessionController(ob, "IBM", testSchedule, clock)
+	require.CmpNoError(err)
+
+	update := func() []string {
+		output, err := sc.Update()
+		require.CmpNoError(err)
+		return output
+	}
+
+	// Before the first phase, it is the last phase of the day before
+	assert.Cmp(sc.Phase(), orderbook.ClosedSessionPhase)
+	assert.Cmp(update(), []string{"P, IBM, CLOSED", "S, IBM, CLOSED"})
+	assert.Nil(update())
+
+	// Pre-open: only cancels are accepted
+	clock.Advance(time.Hour)
+	assert.Cmp(update(), []string{"P, IBM, PRE_OPEN", "S, IBM, PRE_OPEN"})
+
+	output, err := ob.ProcessFromStringInstructions("N, 1, IBM, 10, 100, B, 1")
+	require.CmpNoError(err)
+	assert.Cmp(output, "R, 1, 1")
+
+	// Opening auction: orders are accepted but not matched
+	clock.Advance(time.Hour)
+	assert.Cmp(update(), []string{"P, IBM, OPENING_AUCTION", "S, IBM, AUCTION"})
+
+	output, err = ob.ProcessFromStringInstructions(`
+N, 1, IBM, 10, 100, B, 2
+N, 2, IBM, 10, 50, S, 3, G
+N, 3, IBM, 11, 100, S, 4
+N, 4, IBM, 5, 10, B, 5, G
+`)
+	require.CmpNoError(err)
+	assert.Cmp(output, `A, 1, 2
+B, B, 10, 100
+A, 2, 3
+B, S, 10, 50
+A, 3, 4
+A, 4, 5`)
+
+	// Continuous: the opening auction is uncrossed
+	clock.Advance(30 * time.Minute)
+	assert.Cmp(update(), []string{
+		"P, IBM, CONTINUOUS",
+		"T, 1, 2, 2, 3, 10, 50",
+		"B, B, 10, 50",
+		"B, S, 11, 100",
+		"S, IBM, CONTINUOUS",
+	})
+
+	// The closing auction is skipped, but it still happens before the close.
+	// DAY orders are expired at close.
+	clock.Advance(9 * time.Hour)
+	assert.Cmp(update(), []string{
+		"P, IBM, CLOSING_AUCTION",
+		"S, IBM, AUCTION",
+		"P, IBM, CLOSED",
+		"S, IBM, CLOSED",
+		"X, 1, 2",
+		"B, B, 5, 10",
+		"X, 3, 4",
+		"B, S, -, -",
+	})
+	assert.Cmp(sc.Phase(), orderbook.ClosedSessionPhase)
+
+	// Next day
+	clock.Advance(14 * time.Hour)
+	assert.Cmp(update(), []string{"P, IBM, PRE_OPEN", "S, IBM, PRE_OPEN"})
+
+	// Phase changes are outputs of the 'S' instructions: they are sequenced, and replayed from the journal
+	assert.Cmp(ob.LastSequence(), uint64(28))
+	output, err = ob.ProcessFromStringInstructions("S, IBM, AUCTION, OPENING_AUCTION")
+	require.CmpNoError(err)
+	assert.Cmp(output, "P, IBM, OPENING_AUCTION\nS, IBM, AUCTION")
+}
@@ -0,0 +1,353 @@
+package orderbook
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot format written by the order book.
+// It changes with every change of the format, and snapshots of another version are rejected:
+//   - 1: queues, positions, trading statuses and trades of the volatility guard
+//   - 2: order statuses, last trade ID, last sequence number, receive times of orders
+//   - 3: balances of the account service
+//   - 4: rolling volumes and fees of the report of the fee engine
+const SnapshotVersion = 4
+
+// snapshot is the serialized form of an order book.
+type snapshot struct {
+	Version        int
+	ShouldTrade    bool
+	JournalOffset  int64 // Offset of the first journal record not included in the snapshot
+	LastTradeID    int
+	LastSequence   uint64
+	AskQueue       queueSnapshot
+	BidQueue       queueSnapshot
+	SymbolStatuses map[string]symbolStatusSnapshot
+	Positions      []Position
+	GuardTrades    map[string][]tradePriceSnapshot `json:",omitempty"`
+	LiveOrders     []orderStatusSnapshot           // Sorted by identifier
+	TerminalOrders []orderStatusSnapshot           // The oldest first
+	Balances       []Balance                       `json:",omitempty"` // Sorted by user and asset
+	FeeVolumes     []feeVolumeSnapshot             `json:",omitempty"` // Sorted by user, the oldest first
+	Fees           []UserFees                      `json:",omitempty"` // Sorted by user
+}
+
+// queueSnapshot is the serialized form of an order queue.
+type queueSnapshot struct {
+	Timer  int
+	Orders []orderSnapshot
+}
+
+// orderSnapshot is the serialized form of an order, with its arrival time in the queue.
+type orderSnapshot struct {
+	User        int
+	Symbol      string
+	Price       int
+	Quantity    int
+	UserOrderId int
+	OrderSide   string
+	TimeInForce string
+	ReceivedAt  time.Time
+	Time        int
+}
+
+// symbolStatusSnapshot is the serialized form of the trading status of a symbol.
+type symbolStatusSnapshot struct {
+	State        string
+	HaltedUntil  time.Time
+	QueuedOrders []orderSnapshot
+	LastPrice    int
+}
+
+// orderStatusSnapshot is the serialized form of the status of an order.
+type orderStatusSnapshot struct {
+	OrderStatus
+	State string
+}
+
+// tradePriceSnapshot is the serialized form of a trade price recorded by the volatility guard.
+type tradePriceSnapshot struct {
+	Time  time.Time
+	Price int
+}
+
+// WriteSnapshot serializes the order book: both queues (with the arrival time of orders),
+// the trading mode, the trading statuses, the positions, the order statuses, the trades
+// of the volatility guard and the balances of the account service.
+// The configuration (clock, guard parameters, limits...) is not part of the snapshot.
+func (ob *OrderBook) WriteSnapshot(w io.Writer) error {
+	s := snapshot{
+		Version:        SnapshotVersion,
+		ShouldTrade:    ob.ShouldTrade,
+		LastTradeID:    ob.lastTradeID,
+		LastSequence:   ob.lastSequence,
+		AskQueue:       ob.AskQueue.snapshot(),
+		BidQueue:       ob.BidQueue.snapshot(),
+		SymbolStatuses: map[string]symbolStatusSnapshot{},
+	}
+
+	if ob.Journal != nil {
+		s.JournalOffset = ob.Journal.Offset()
+	}
+
+	for symbol, status := range ob.symbolStatuses {
+		s.SymbolStatuses[symbol] = symbolStatusSnapshot{
+			State:        status.state.String(),
+			HaltedUntil:  status.haltedUntil,
+			QueuedOrders: snapshotOrders(status.queuedOrders),
+			LastPrice:    status.lastPrice,
+		}
+	}
+
+	for _, positions := range ob.Positions.positions {
+		for _, p := range positions {
+			s.Positions = append(s.Positions, *p)
+		}
+	}
+
+	// Sort positions so that the snapshot of the same book is always the same
+	sort.Slice(s.Positions, func(i, j int) bool {
+		if s.Positions[i].User != s.Positions[j].User {
+			return s.Positions[i].User < s.Positions[j].User
+		}
+		return s.Positions[i].Symbol < s.Positions[j].Symbol
+	})
+
+	if ob.Guard != nil {
+		s.GuardTrades = map[string][]tradePriceSnapshot{}
+		for symbol, trades := range ob.Guard.recentTrades {
+			for _, tp := range trades {
+				s.GuardTrades[symbol] = append(s.GuardTrades[symbol], tradePriceSnapshot{Time: tp.time, Price: tp.price})
+			}
+		}
+	}
+
+	for _, status := range ob.Orders.orders {
+		if !status.State.IsTerminal() {
+			s.LiveOrders = append(s.LiveOrders, orderStatusSnapshot{OrderStatus: *status, State: status.State.String()})
+		}
+	}
+
+	sort.Slice(s.LiveOrders, func(i, j int) bool {
+		if s.LiveOrders[i].User != s.LiveOrders[j].User {
+			return s.LiveOrders[i].User < s.LiveOrders[j].User
+		}
+		return s.LiveOrders[i].UserOrderId < s.LiveOrders[j].UserOrderId
+	})
+
+	if ob.Accounts != nil {
+		s.Balances = ob.Accounts.snapshot()
+	}
+
+	if ob.Fees != nil {
+		s.FeeVolumes, s.Fees = ob.Fees.snapshot()
+	}
+
+	for _, status := range ob.Orders.terminal {
+		s.TerminalOrders = append(s.TerminalOrders, orderStatusSnapshot{OrderStatus: *status, State: status.State.String()})
+	}
+
+	return json.NewEncoder(w).Encode(s)
+}
+
+// SaveSnapshot writes the snapshot of the order book in a file.
+// The file is replaced atomically so a crash never leaves a partial snapshot.
+func (ob *OrderBook) SaveSnapshot(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := ob.WriteSnapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadSnapshot restores the state of the order book from a snapshot.
+// It returns the journal offset of the snapshot.
+// The order book keeps its configuration, and it gives the same priority and outputs
+// for later instructions than the order book which wrote the snapshot.
+func (ob *OrderBook) ReadSnapshot(r io.Reader) (int64, error) {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return 0, err
+	}
+
+	if s.Version != SnapshotVersion {
+		return 0, fmt.Errorf("Unsupported snapshot version: %d (expected %d)", s.Version, SnapshotVersion)
+	}
+
+	symbolStatuses := map[string]*symbolStatus{}
+	for symbol, status := range s.SymbolStatuses {
+		state, err := ParseTradingState(status.State)
+		if err != nil {
+			return 0, err
+		}
+
+		symbolStatuses[symbol] = &symbolStatus{
+			state:        state,
+			haltedUntil:  status.HaltedUntil,
+			queuedOrders: restoreOrders(status.QueuedOrders),
+			lastPrice:    status.LastPrice,
+		}
+	}
+
+	// Terminal orders first, as a live order may reuse the identifier of a terminal one
+	orderStore := NewOrderStore(ob.Orders.MaxTerminal)
+	for _, statuses := range [][]orderStatusSnapshot{s.TerminalOrders, s.LiveOrders} {
+		for _, status := range statuses {
+			state, err := ParseOrderState(status.State)
+			if err != nil {
+				return 0, err
+			}
+
+			restored := status.OrderStatus
+			restored.State = state
+			orderStore.orders[fmt.Sprintf("%d-%d", restored.User, restored.UserOrderId)] = &restored
+			if state.IsTerminal() {
+				orderStore.terminal = append(orderStore.terminal, &restored)
+			}
+		}
+	}
+
+	ob.Flush()
+	ob.ShouldTrade = s.ShouldTrade
+	ob.lastTradeID = s.LastTradeID
+	ob.lastSequence = s.LastSequence
+	ob.AskQueue.restore(s.AskQueue)
+	ob.BidQueue.restore(s.BidQueue)
+	ob.symbolStatuses = symbolStatuses
+	ob.Orders = orderStore
+
+	// The restored orders reserve their funds again, the other order books sharing the accounts keep theirs
+	if ob.Accounts != nil {
+		ob.Accounts.restore(s.Balances, ob.liveOrders())
+	}
+
+	// The fee tiers depend on the rolling volumes, so they are the same as before the snapshot
+	if ob.Fees != nil {
+		ob.Fees.restore(s.FeeVolumes, s.Fees)
+	}
+
+	ob.Positions.positions = map[int]map[string]*Position{}
+	for _, p := range s.Positions {
+		*ob.Positions.getOrCreate(p.User, p.Symbol) = p
+	}
+
+	if ob.Guard != nil {
+		for symbol, trades := range s.GuardTrades {
+			for _, tp := range trades {
+				ob.Guard.recentTrades[symbol] = append(ob.Guard.recentTrades[symbol], tradePrice{time: tp.Time, price: tp.Price})
+			}
+		}
+	}
+
+	return s.JournalOffset, nil
+}
+
+// LoadSnapshot restores the state of the order book from a snapshot file.
+// It returns the journal offset of the snapshot.
+func (ob *OrderBook) LoadSnapshot(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return ob.ReadSnapshot(file)
+}
+
+// RecoverFromSnapshot restores the snapshot file, then replays the records of the journal
+// written after the snapshot (see Recover).
+func (ob *OrderBook) RecoverFromSnapshot(snapshotPath, journalPath string) ([]string, error) {
+	offset, err := ob.LoadSnapshot(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return ob.recover(journalPath, offset)
+}
+
+// snapshot returns the serialized form of the queue.
+func (oq *OrderQueue) snapshot() queueSnapshot {
+	return queueSnapshot{
+		Timer:  oq.timer,
+		Orders: snapshotOrders(oq.orders),
+	}
+}
+
+// restore replaces the orders of the queue by the ones of the snapshot, keeping their arrival time.
+func (oq *OrderQueue) restore(s queueSnapshot) {
+	oq.orders = restoreOrders(s.Orders)
+	oq.mapPriceToQuantity = map[int]int{}
+	oq.quantity, oq.levels = 0, 0
+	oq.mapSearchByIdentifier = map[string]*Order{}
+	oq.mapUserToOrders = map[int]map[string]*Order{}
+	oq.mapSymbolToOrders = map[string]map[string]*Order{}
+	for i, o := range oq.orders {
+		o.index = i
+		oq.addToMaps(o)
+	}
+
+	heap.Init(oq)
+	oq.timer = s.Timer
+}
+
+// snapshotOrders returns the serialized form of orders.
+func snapshotOrders(orders []*Order) []orderSnapshot {
+	snapshots := make([]orderSnapshot, 0, len(orders))
+	for _, o := range orders {
+		snapshots = append(snapshots, orderSnapshot{
+			User:        o.User,
+			Symbol:      o.Symbol,
+			Price:       o.Price,
+			Quantity:    o.Quantity,
+			UserOrderId: o.UserOrderId,
+			OrderSide:   o.OrderSide,
+			TimeInForce: o.TimeInForce,
+			ReceivedAt:  o.ReceivedAt,
+			Time:        o.time,
+		})
+	}
+
+	return snapshots
+}
+
+// restoreOrders creates the orders from their serialized form.
+func restoreOrders(snapshots []orderSnapshot) []*Order {
+	var orders []*Order
+	for _, s := range snapshots {
+		orders = append(orders, &Order{
+			User:        s.User,
+			Symbol:      s.Symbol,
+			Price:       s.Price,
+			Quantity:    s.Quantity,
+			UserOrderId: s.UserOrderId,
+			OrderSide:   s.OrderSide,
+			TimeInForce: s.TimeInForce,
+			ReceivedAt:  s.ReceivedAt,
+			time:        s.Time,
+		})
+	}
+
+	return orders
+}
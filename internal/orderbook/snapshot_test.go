@@ -0,0 +1,111 @@
+package orderbook_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestOrderBook_Snapshot(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	clock := orderbook.NewFakeClock(time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC))
+	ob := newJournaledOrderBook(clock)
+
+	_, err := ob.ProcessFromStringInstructions(`
+N, 1, IBM, 100, 10, S, 1
+N, 2, IBM, 100, 10, B, 2
+N, 1, IBM, 99, 10, B, 3
+N, 2, IBM, 99, 10, B, 4
+N, 3, IBM, 101, 10, S, 5
+N, 3, IBM, 115, 10, S, 6
+N, 4, IBM, 120, 20, B, 7
+N, 4, IBM, 100, 10, B, 8
+`)
+	require.CmpNoError(err)
+	require.Cmp(ob.GetTradingState("IBM"), orderbook.HaltedTradingState)
+
+	var buf bytes.Buffer
+	require.CmpNoError(ob.WriteSnapshot(&buf))
+
+	// The restored book has the same trade mode, queues, positions, trading and order statuses
+	restored := newJournaledOrderBook(clock)
+	restored.ShouldTrade = false
+	offset, err := restored.ReadSnapshot(&buf)
+	require.CmpNoError(err)
+	assert.Cmp(offset, int64(0))
+	assert.True(restored.ShouldTrade)
+	assert.Cmp(restored.BidQueue.Orders(), ob.BidQueue.Orders())
+	assert.Cmp(restored.AskQueue.Orders(), ob.AskQueue.Orders())
+	assert.Cmp(restored.Positions.GetPositions(2), ob.Positions.GetPositions(2))
+	assert.Cmp(restored.GetTradingState("IBM"), orderbook.HaltedTradingState)
+	for user := 1; user <= 4; user++ {
+		assert.Cmp(restored.Orders.GetOrderStatuses(user), ob.Orders.GetOrderStatuses(user))
+	}
+
+	// And it gives the same outputs for later instructions (priority is kept)
+	for _, next := range []string{"C, 4, 7", "N, 6, IBM, 98, 15, S, 10"} {
+		clock.Advance(time.Hour)
+		expected, err := ob.ProcessFromStringInstructions(next)
+		require.CmpNoError(err)
+		output, err := restored.ProcessFromStringInstructions(next)
+		require.CmpNoError(err)
+		assert.Cmp(output, expected)
+	}
+	assert.Cmp(restored.Positions.GetPosition(1, "IBM").NetPosition, -5)
+
+	// Unknown version
+	_, err = restored.ReadSnapshot(strings.NewReader(`{"Version": 42}`))
+	assert.String(err, "Unsupported snapshot version: 42 (expected 4)")
+
+	// Older snapshots miss the order statuses and the last trade ID and sequence number
+	_, err = restored.ReadSnapshot(strings.NewReader(`{"Version": 1, "ShouldTrade": true}`))
+	assert.String(err, "Unsupported snapshot version: 1 (expected 4)")
+
+	// Version 2 snapshots miss the balances
+	_, err = restored.ReadSnapshot(strings.NewReader(`{"Version": 2, "ShouldTrade": true}`))
+	assert.String(err, "Unsupported snapshot version: 2 (expected 4)")
+
+	// Version 3 snapshots miss the rolling volumes of the fee engine
+	_, err = restored.ReadSnapshot(strings.NewReader(`{"Version": 3, "ShouldTrade": true}`))
+	assert.String(err, "Unsupported snapshot version: 3 (expected 4)")
+}
+
+func TestOrderBook_RecoverFromSnapshot(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "journal")
+	snapshotPath := filepath.Join(dir, "snapshot")
+
+	clock := orderbook.NewFakeClock(time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC))
+	ob := newJournaledOrderBook(clock)
+	_, err := ob.Recover(journalPath)
+	require.CmpNoError(err)
+
+	_, err = ob.ProcessFromStringInstructions(`
+N, 1, IBM, 100, 10, S, 1
+N, 2, IBM, 99, 10, B, 2
+`)
+	require.CmpNoError(err)
+	require.CmpNoError(ob.SaveSnapshot(snapshotPath))
+
+	// Only the instructions after the snapshot are replayed
+	output, err := ob.ProcessFromStringInstructions("N, 3, IBM, 100, 5, B, 3")
+	require.CmpNoError(err)
+	require.CmpNoError(ob.Journal.Close())
+
+	recovered := newJournaledOrderBook(orderbook.SystemClock{})
+	replayed, err := recovered.RecoverFromSnapshot(snapshotPath, journalPath)
+	require.CmpNoError(err)
+	assert.Cmp(strings.Join(replayed, "\n"), output)
+	assert.Cmp(recovered.AskQueue.Orders(), ob.AskQueue.Orders())
+	assert.Cmp(recovered.BidQueue.Orders(), ob.BidQueue.Orders())
+	require.CmpNoError(recovered.Journal.Close())
+}
@@ -0,0 +1,31 @@
+package orderbook
+
+import "time"
+
+// Trade represents a match between a buy order and a sell order.
+// Its ID is unique in the order book, it is set with its time when the trade is processed.
+type Trade struct {
+	ID            int
+	Time          time.Time
+	BuyOrder      *Order
+	SellOrder     *Order
+	Price         int
+	Quantity      int
+	AggressorSide string // Side of the order which crossed the book (empty for an auction trade)
+	BuyFee        int    // Fees of both sides in minor units of the quote asset, set when the trade is processed (see FeeEngine)
+	SellFee       int
+}
+
+// NewTrade creates a trade between an aggressive order and a resting order given their sides.
+func NewTrade(order, orderToCompare *Order, price, quantity int) *Trade {
+	if order.OrderSide == "B" {
+		return &Trade{BuyOrder: order, SellOrder: orderToCompare, Price: price, Quantity: quantity, AggressorSide: "B"}
+	}
+
+	return &Trade{BuyOrder: orderToCompare, SellOrder: order, Price: price, Quantity: quantity, AggressorSide: "S"}
+}
+
+// Symbol returns the symbol traded.
+func (t *Trade) Symbol() string {
+	return t.BuyOrder.Symbol
+}
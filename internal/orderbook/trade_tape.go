@@ -0,0 +1,307 @@
+package orderbook
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TapeEntry is a trade as recorded in the trade tape (time and sales).
+type TapeEntry struct {
+	TradeID       int
+	Time          time.Time
+	Symbol        string
+	Price         int
+	Quantity      int
+	AggressorSide string // Empty for an auction trade
+	BuyUser       int
+	BuyOrderId    int
+	SellUser      int
+	SellOrderId   int
+	BuyFee        int // In minor units of the quote asset (see FeeEngine)
+	SellFee       int
+}
+
+// newTapeEntry returns the entry of a trade.
+func newTapeEntry(trade *Trade) TapeEntry {
+	return TapeEntry{
+		TradeID:       trade.ID,
+		Time:          trade.Time,
+		Symbol:        trade.Symbol(),
+		Price:         trade.Price,
+		Quantity:      trade.Quantity,
+		AggressorSide: trade.AggressorSide,
+		BuyUser:       trade.BuyOrder.User,
+		BuyOrderId:    trade.BuyOrder.UserOrderId,
+		SellUser:      trade.SellOrder.User,
+		SellOrderId:   trade.SellOrder.UserOrderId,
+		BuyFee:        trade.BuyFee,
+		SellFee:       trade.SellFee,
+	}
+}
+
+// TradeTape is an append-only history of the trades, bounded in memory.
+// Only the 'MaxEntries' most recent trades are kept in memory (0 means no limit), older trades are
+// spilled to segment files on disk if spilling is enabled (see SpillTo), else they are forgotten.
+// With spilling, Close writes the trades still in memory, so that the segments hold every trade.
+// BySymbol and ByUser search the segments (read from disk) then the trades in memory, Last only searches
+// the memory. Segments can be read with ReadTapeSegment.
+type TradeTape struct {
+	MaxEntries int
+
+	entries []TapeEntry // Sorted by time (trades are notified in time order)
+	spill   *tapeSpill
+}
+
+// tapeSpill writes the trades evicted from the memory to segment files of at most 'segmentSize' trades.
+type tapeSpill struct {
+	dir         string
+	segmentSize int
+	segments    []string
+	next        int // Number of the next segment
+	file        *os.File
+	writer      *bufio.Writer
+	count       int // Number of trades of the current segment
+	err         error
+}
+
+// NewTradeTape creates an empty trade tape which keeps the given number of trades in memory.
+func NewTradeTape(maxEntries int) *TradeTape {
+	return &TradeTape{MaxEntries: maxEntries}
+}
+
+// SpillTo enables spilling the trades evicted from the memory to segment files in the given directory,
+// each segment containing at most 'segmentSize' trades (one JSON trade per line).
+// The segments already in the directory (e.g. written before a restart) are part of the tape:
+// they are searched by the queries and new segments are numbered after them.
+func (tt *TradeTape) SpillTo(dir string, segmentSize int) error {
+	if segmentSize <= 0 {
+		return fmt.Errorf("Segment size should be positive: %d", segmentSize)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	segments, err := TapeSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	next := 1
+	if len(segments) > 0 {
+		last := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(segments[len(segments)-1]), "tape-"), ".jsonl")
+		if next, err = strconv.Atoi(last); err != nil {
+			return fmt.Errorf("Invalid tape segment name %q: %w", segments[len(segments)-1], err)
+		}
+		next++
+	}
+
+	tt.spill = &tapeSpill{dir: dir, segmentSize: segmentSize, segments: segments, next: next}
+	return nil
+}
+
+// tapeSegmentName is the name of the segment files, numbered from 1.
+const tapeSegmentName = "tape-%06d.jsonl"
+
+// TapeSegments returns the paths of the segment files of a directory, the oldest first.
+func TapeSegments(dir string) ([]string, error) {
+	segments, err := filepath.Glob(filepath.Join(dir, "tape-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Numbers are zero-padded, so the names sort as the numbers
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// OnTrade appends the trade to the tape. It implements the TradeListener interface.
+func (tt *TradeTape) OnTrade(trade *Trade) {
+	tt.entries = append(tt.entries, newTapeEntry(trade))
+
+	if tt.MaxEntries <= 0 || len(tt.entries) <= tt.MaxEntries {
+		return
+	}
+
+	// The evicted entries are released when 'append' reallocates the slice
+	evicted := tt.entries[0]
+	tt.entries = tt.entries[1:]
+	if tt.spill != nil {
+		tt.spill.write(evicted)
+	}
+}
+
+// BySymbol returns the trades of a symbol in the time range [from, to), including the spilled trades.
+func (tt *TradeTape) BySymbol(symbol string, from, to time.Time) ([]TapeEntry, error) {
+	return tt.search(func(entry TapeEntry) bool {
+		return entry.Symbol == symbol && !entry.Time.Before(from) && entry.Time.Before(to)
+	})
+}
+
+// ByUser returns the trades of a user (as buyer or seller), including the spilled trades.
+func (tt *TradeTape) ByUser(user int) ([]TapeEntry, error) {
+	return tt.search(func(entry TapeEntry) bool {
+		return entry.BuyUser == user || entry.SellUser == user
+	})
+}
+
+// search returns the trades matching the filter, from the segments then from the memory (so in time order).
+// It fails if the trades could not be spilled, as some of them would be missing.
+func (tt *TradeTape) search(match func(entry TapeEntry) bool) ([]TapeEntry, error) {
+	var entries []TapeEntry
+	if tt.spill != nil {
+		if err := tt.spill.flush(); err != nil {
+			return nil, err
+		}
+
+		for _, segment := range tt.spill.segments {
+			spilled, err := ReadTapeSegment(segment)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range spilled {
+				if match(entry) {
+					entries = append(entries, entry)
+				}
+			}
+		}
+	}
+
+	for _, entry := range tt.entries {
+		if match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// Last returns the last n trades, the oldest first.
+func (tt *TradeTape) Last(n int) []TapeEntry {
+	if n > len(tt.entries) {
+		n = len(tt.entries)
+	}
+
+	return append([]TapeEntry(nil), tt.entries[len(tt.entries)-n:]...)
+}
+
+// Segments returns the paths of the segment files of the tape, the oldest first.
+func (tt *TradeTape) Segments() []string {
+	if tt.spill == nil {
+		return nil
+	}
+
+	return append([]string(nil), tt.spill.segments...)
+}
+
+// Err returns the first error which happened when spilling trades (trades are not spilled anymore after it).
+func (tt *TradeTape) Err() error {
+	if tt.spill == nil {
+		return nil
+	}
+
+	return tt.spill.err
+}
+
+// Close writes the trades in memory to the segments (if spilling is enabled), so that the segments hold
+// the whole tape, then flushes and closes the current segment file. The written trades leave the memory.
+func (tt *TradeTape) Close() error {
+	if tt.spill == nil {
+		return nil
+	}
+
+	for _, entry := range tt.entries {
+		tt.spill.write(entry)
+	}
+	if tt.spill.err == nil {
+		tt.entries = nil
+	}
+
+	if err := tt.spill.closeSegment(); err != nil {
+		return err
+	}
+
+	return tt.spill.err
+}
+
+// ReadTapeSegment reads the trades of a segment file.
+func ReadTapeSegment(path string) ([]TapeEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []TapeEntry
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		var entry TapeEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return entries, fmt.Errorf("Can't read tape segment %q: %w", path, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// write appends a trade to the current segment, it creates a new segment if the current one is full.
+func (ts *tapeSpill) write(entry TapeEntry) {
+	if ts.err != nil {
+		return
+	}
+
+	if ts.file == nil || ts.count >= ts.segmentSize {
+		if ts.err = ts.closeSegment(); ts.err != nil {
+			return
+		}
+
+		// A segment is never overwritten
+		path := filepath.Join(ts.dir, fmt.Sprintf(tapeSegmentName, ts.next))
+		if ts.file, ts.err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644); ts.err != nil {
+			return
+		}
+		ts.writer = bufio.NewWriter(ts.file)
+		ts.segments = append(ts.segments, path)
+		ts.next++
+		ts.count = 0
+	}
+
+	if ts.err = json.NewEncoder(ts.writer).Encode(entry); ts.err == nil {
+		ts.count++
+	}
+}
+
+// flush writes the buffered trades of the current segment, so the segments can be read.
+// It returns the error which stopped the spilling (if any).
+func (ts *tapeSpill) flush() error {
+	if ts.err != nil || ts.file == nil {
+		return ts.err
+	}
+
+	ts.err = ts.writer.Flush()
+	return ts.err
+}
+
+// closeSegment flushes and closes the current segment (if any).
+func (ts *tapeSpill) closeSegment() error {
+	if ts.file == nil {
+		return nil
+	}
+
+	file := ts.file
+	ts.file = nil
+	if err := ts.writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,126 @@
+package orderbook_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestTradeTape(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	start := time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock := orderbook.NewFakeClock(start)
+
+	dir := t.TempDir()
+	tape := orderbook.NewTradeTape(3)
+	require.CmpNoError(tape.SpillTo(dir, 1))
+
+	ob := orderbook.NewOrderBook(true)
+	ob.Clock = clock
+	ob.TradeListeners = append(ob.TradeListeners, tape)
+
+	for _, instruction := range []string{
+		"N, 1, IBM, 10, 100, S, 1",
+		"N, 2, IBM, 10, 10, B, 1",  // Trade 1
+		"N, 3, IBM, 10, 10, B, 1",  // Trade 2
+		"N, 1, AAPL, 50, 10, B, 2", //
+		"N, 3, AAPL, 50, 5, S, 2",  // Trade 3
+		"N, 2, IBM, 10, 10, B, 3",  // Trade 4
+		"N, 4, IBM, 10, 10, B, 1",  // Trade 5
+	} {
+		clock.Advance(time.Second)
+		_, err := ob.ProcessInstruction(instruction)
+		require.CmpNoError(err)
+	}
+
+	trade3 := orderbook.TapeEntry{
+		TradeID:       3,
+		Time:          start.Add(5 * time.Second),
+		Symbol:        "AAPL",
+		Price:         50,
+		Quantity:      5,
+		AggressorSide: "S",
+		BuyUser:       1,
+		BuyOrderId:    2,
+		SellUser:      3,
+		SellOrderId:   2,
+	}
+
+	// Only the 3 last trades are in memory
+	last := tape.Last(10)
+	require.Len(last, 3)
+	assert.Cmp(last[0], trade3)
+	assert.Cmp(tape.Last(1), td.Smuggle(tradeIDs, []int{5}))
+
+	// Queries search the spilled trades too
+	bySymbol := func(symbol string, from, to time.Time) []orderbook.TapeEntry {
+		entries, err := tape.BySymbol(symbol, from, to)
+		require.CmpNoError(err)
+		return entries
+	}
+	assert.Cmp(bySymbol("IBM", start, start.Add(time.Hour)), td.Smuggle(tradeIDs, []int{1, 2, 4, 5}))
+	assert.Cmp(bySymbol("IBM", start.Add(3*time.Second), start.Add(7*time.Second)), td.Smuggle(tradeIDs, []int{2, 4}))
+	assert.Cmp(bySymbol("AAPL", start.Add(6*time.Second), start.Add(time.Hour)), td.Empty())
+	byUser, err := tape.ByUser(3)
+	require.CmpNoError(err)
+	assert.Cmp(byUser, td.Smuggle(tradeIDs, []int{2, 3}))
+	assert.Cmp(byUser[1], trade3)
+
+	// Older trades were spilled, one per segment
+	segments := tape.Segments()
+	require.Len(segments, 2)
+	spilled, err := orderbook.ReadTapeSegment(segments[1])
+	require.CmpNoError(err)
+	assert.Cmp(spilled, td.Smuggle(tradeIDs, []int{2}))
+
+	// Closing the tape writes the trades in memory, so the segments hold the whole tape
+	require.CmpNoError(tape.Close())
+	segments = tape.Segments()
+	require.Len(segments, 5)
+	spilled, err = orderbook.ReadTapeSegment(segments[2])
+	require.CmpNoError(err)
+	assert.Cmp(spilled, []orderbook.TapeEntry{trade3})
+	assert.Len(tape.Last(10), 0)
+
+	// After a restart, the segments are numbered after the existing ones, which are never overwritten
+	restarted := orderbook.NewTradeTape(1)
+	require.CmpNoError(restarted.SpillTo(dir, 1))
+	ob = orderbook.NewOrderBook(true)
+	ob.Clock = clock
+	ob.TradeListeners = append(ob.TradeListeners, restarted)
+	_, err = ob.ProcessFromStringInstructions(`
+N, 1, IBM, 10, 100, S, 1
+N, 5, IBM, 10, 10, B, 1
+N, 5, IBM, 10, 10, B, 2
+`)
+	require.CmpNoError(err)
+	require.CmpNoError(restarted.Close())
+
+	segments = restarted.Segments()
+	require.Len(segments, 7)
+	assert.Cmp(filepath.Base(segments[5]), "tape-000006.jsonl")
+	spilled, err = orderbook.ReadTapeSegment(segments[1])
+	require.CmpNoError(err)
+	assert.Cmp(spilled, td.Smuggle(tradeIDs, []int{2}))
+
+	byUser, err = restarted.ByUser(3)
+	require.CmpNoError(err)
+	assert.Cmp(byUser, td.Smuggle(tradeIDs, []int{2, 3}))
+	byUser, err = restarted.ByUser(5)
+	require.CmpNoError(err)
+	assert.Len(byUser, 2)
+}
+
+// tradeIDs returns the trade IDs of tape entries.
+func tradeIDs(entries []orderbook.TapeEntry) []int {
+	ids := []int{}
+	for _, entry := range entries {
+		ids = append(ids, entry.TradeID)
+	}
+	return ids
+}
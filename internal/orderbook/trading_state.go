@@ -0,0 +1,165 @@
+package orderbook
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TradingState is the trading state of a symbol.
+type TradingState int
+
+const (
+	ContinuousTradingState TradingState = iota
+	HaltedTradingState
+	ClosedTradingState
+	AuctionTradingState
+	PreOpenTradingState
+)
+
+var tradingStateNames = map[TradingState]string{
+	ContinuousTradingState: "CONTINUOUS",
+	HaltedTradingState:     "HALTED",
+	ClosedTradingState:     "CLOSED",
+	AuctionTradingState:    "AUCTION",
+	PreOpenTradingState:    "PRE_OPEN",
+}
+
+// String returns the name of the trading state as it appears in instructions and outputs.
+func (ts TradingState) String() string {
+	if name, ok := tradingStateNames[ts]; ok {
+		return name
+	}
+	return fmt.Sprintf("TradingState(%d)", int(ts))
+}
+
+// ParseTradingState returns the trading state of the given name (case insensitive).
+func ParseTradingState(name string) (TradingState, error) {
+	for state, stateName := range tradingStateNames {
+		if strings.EqualFold(name, stateName) {
+			return state, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Unknown trading state: %q", name)
+}
+
+// HaltPolicy indicates what to do with new orders on a halted symbol.
+type HaltPolicy int
+
+const (
+	RejectHaltPolicy HaltPolicy = iota // New orders are rejected
+	QueueHaltPolicy                    // New orders are acknowledged and processed when trading resumes
+)
+
+// StateChange represents an instruction to change the trading state of a symbol.
+type StateChange struct {
+	Symbol string
+	State  TradingState
+	Phase  string // Session phase which caused the change (see SessionController), empty if none
+}
+
+// NewStateChangeFromInstruction creates a new StateChange from a string.
+// Instruction should have the form: 'S, symbol(string),state(CONTINUOUS, HALTED, CLOSED, AUCTION or PRE_OPEN)'
+// optionally followed by the session phase (e.g. 'OPENING_AUCTION').
+// It returns an error if it can't parse the string.
+func NewStateChangeFromInstruction(instruction string) (*StateChange, error) {
+	params := strings.Split(instruction, ",")
+	if len(params) != 3 && len(params) != 4 {
+		return nil,
+			fmt.Errorf("Can't create new state change from instruction as it has not 3 or 4 parameters: %q", instruction)
+	}
+
+	state, err := ParseTradingState(params[2])
+	if err != nil {
+		return nil, err
+	}
+
+	stateChange := &StateChange{
+		Symbol: params[1],
+		State:  state,
+	}
+
+	if len(params) == 4 {
+		phase, err := ParseSessionPhase(params[3])
+		if err != nil {
+			return nil, err
+		}
+		stateChange.Phase = phase.String()
+	}
+
+	return stateChange, nil
+}
+
+// symbolStatus is the trading status of a symbol in the order book.
+type symbolStatus struct {
+	state        TradingState
+	haltedUntil  time.Time // Zero if the halt must be resumed manually
+	queuedOrders []*Order  // Orders received while halted (with QueueHaltPolicy)
+	lastPrice    int       // Last traded price, used as reference price by auctions
+}
+
+// VolatilityGuard halts the trading of a symbol when a trade price would move more than
+// 'BandPercent' percent away from the prices traded within the last 'Window'.
+// The halt lasts 'HaltDuration', or until trading is resumed manually if it is 0.
+type VolatilityGuard struct {
+	BandPercent  float64
+	Window       time.Duration
+	HaltDuration time.Duration
+
+	recentTrades map[string][]tradePrice // Trades within the window per symbol
+}
+
+// tradePrice is a price traded at a given time.
+type tradePrice struct {
+	time  time.Time
+	price int
+}
+
+// NewVolatilityGuard creates a volatility guard.
+func NewVolatilityGuard(bandPercent float64, window, haltDuration time.Duration) *VolatilityGuard {
+	return &VolatilityGuard{
+		BandPercent:  bandPercent,
+		Window:       window,
+		HaltDuration: haltDuration,
+		recentTrades: map[string][]tradePrice{},
+	}
+}
+
+// Breaches indicates if trading the symbol at the given price would exceed the band.
+// Prices <= 0 have no band, so they are skipped as reference prices.
+func (vg *VolatilityGuard) Breaches(symbol string, price int, now time.Time) bool {
+	vg.expire(symbol, now)
+	for _, tp := range vg.recentTrades[symbol] {
+		if tp.price <= 0 {
+			continue
+		}
+		move := float64(abs(price-tp.price)) * 100 / float64(tp.price)
+		if move > vg.BandPercent {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Record adds a trade price to the window of the symbol.
+func (vg *VolatilityGuard) Record(symbol string, price int, now time.Time) {
+	vg.expire(symbol, now)
+	vg.recentTrades[symbol] = append(vg.recentTrades[symbol], tradePrice{time: now, price: price})
+}
+
+// Reset forgets all the trades recorded.
+func (vg *VolatilityGuard) Reset() {
+	vg.recentTrades = map[string][]tradePrice{}
+}
+
+// expire removes the trades out of the window of the symbol.
+func (vg *VolatilityGuard) expire(symbol string, now time.Time) {
+	trades := vg.recentTrades[symbol]
+	i := 0
+	for i < len(trades) && now.Sub(trades[i].time) > vg.Window {
+		i++
+	}
+	vg.recentTrades[symbol] = trades[i:]
+}
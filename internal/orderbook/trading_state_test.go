@@ -0,0 +1,157 @@
+package orderbook_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+)
+
+func TestNewStateChangeFromInstruction(t *testing.T) {
+	assert := td.Assert(t)
+
+	// When we are in NewStateChangeFromInstruction, orderbook should have remove all empty spaces
+	stateChange, err := orderbook.NewStateChangeFromInstruction("S,IBM,halted")
+	assert.CmpNoError(err)
+	assert.Cmp(stateChange, &orderbook.StateChange{Symbol: "IBM", State: orderbook.HaltedTradingState})
+
+	// With the session phase which caused the change
+	stateChange, err = orderbook.NewStateChangeFromInstruction("S,IBM,AUCTION,closing_auction")
+	assert.CmpNoError(err)
+	assert.Cmp(stateChange, &orderbook.StateChange{Symbol: "IBM", State: orderbook.AuctionTradingState, Phase: "CLOSING_AUCTION"})
+
+	_, err = orderbook.NewStateChangeFromInstruction("S,IBM")
+	assert.String(err, `Can't create new state change from instruction as it has not 3 or 4 parameters: "S,IBM"`)
+
+	_, err = orderbook.NewStateChangeFromInstruction("S,IBM,AUCTION,LUNCH")
+	assert.String(err, `Unknown session phase: "LUNCH"`)
+
+	_, err = orderbook.NewStateChangeFromInstruction("S,IBM,OPEN")
+	assert.String(err, `Unknown trading state: "OPEN"`)
+}
+
+func TestVolatilityGuard(t *testing.T) {
+	assert := td.Assert(t)
+
+	start := time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC)
+	guard := orderbook.NewVolatilityGuard(10, time.Minute, 0)
+
+	guard.Record("IBM", 100, start)
+	assert.False(guard.Breaches("IBM", 110, start.Add(time.Second)))
+	assert.True(guard.Breaches("IBM", 111, start.Add(time.Second)))
+	assert.True(guard.Breaches("IBM", 89, start.Add(time.Second)))
+
+	// Other symbols are not impacted
+	assert.False(guard.Breaches("AAPL", 200, start.Add(time.Second)))
+
+	// Out of the window, the trade is forgotten
+	assert.False(guard.Breaches("IBM", 111, start.Add(2*time.Minute)))
+
+	// Prices <= 0 are not reference prices
+	guard.Record("AAPL", 0, start)
+	guard.Record("AAPL", -5, start)
+	assert.False(guard.Breaches("AAPL", 200, start.Add(time.Second)))
+	guard.Record("AAPL", 100, start)
+	assert.True(guard.Breaches("AAPL", 200, start.Add(time.Second)))
+}
+
+func TestOrderBook_TradingState(t *testing.T) {
+	assert := td.Assert(t)
+
+	ob := orderbook.NewOrderBook(true)
+
+	output, err := ob.ProcessFromStringInstructions(`
+S, IBM, HALTED
+N, 1, IBM, 10, 100, B, 1
+S, IBM, CONTINUOUS
+N, 1, IBM, 10, 100, B, 2
+N, 1, IBM, 9, 100, B, 4, G
+S, IBM, CLOSED
+C, 1, 2
+C, 1, 4
+N, 1, IBM, 10, 100, B, 3
+`)
+	assert.CmpNoError(err)
+
+	// Since DAY orders are expired at close (the default time in force), the DAY order 2 can't be cancelled
+	// anymore, but cancels are still allowed when the symbol is not trading (GTC order 4)
+	assert.Cmp(output, `S, IBM, HALTED
+R, 1, 1
+S, IBM, CONTINUOUS
+A, 1, 2
+B, B, 10, 100
+A, 1, 4
+S, IBM, CLOSED
+X, 1, 2
+B, B, 9, 100
+A, 1, 4
+B, B, -, -
+R, 1, 3`)
+	assert.Cmp(ob.GetTradingState("IBM"), orderbook.ClosedTradingState)
+	assert.Cmp(ob.GetTradingState("AAPL"), orderbook.ContinuousTradingState)
+}
+
+func TestOrderBook_ModifyQueuedOrder(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	ob := orderbook.NewOrderBook(true)
+	ob.HaltPolicy = orderbook.QueueHaltPolicy
+	_, err := ob.ProcessFromStringInstructions(`
+S, IBM, HALTED
+N, 1, IBM, 10, 100, B, 1
+`)
+	require.CmpNoError(err)
+
+	// As a resting order, an order queued during the halt can't be modified
+	output, err := ob.ProcessInstruction("N, 1, IBM, 11, 50, B, 1")
+	require.CmpNoError(err)
+	assert.Cmp(output, []string{"R, 1, 1"})
+
+	output, err = ob.ProcessInstruction("S, IBM, CONTINUOUS")
+	require.CmpNoError(err)
+	assert.Cmp(output, []string{"S, IBM, CONTINUOUS", "B, B, 10, 100"})
+}
+
+func TestOrderBook_VolatilityHalt(t *testing.T) {
+	assert := td.Assert(t)
+
+	clock := orderbook.NewFakeClock(time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC))
+
+	ob := orderbook.NewOrderBook(true)
+	ob.Clock = clock
+	ob.Guard = orderbook.NewVolatilityGuard(10, time.Minute, 5*time.Minute)
+	ob.HaltPolicy = orderbook.QueueHaltPolicy
+
+	output, err := ob.ProcessFromStringInstructions(`
+N, 1, IBM, 100, 10, S, 1
+N, 2, IBM, 100, 10, B, 2
+N, 1, IBM, 120, 10, S, 3
+N, 2, IBM, 120, 10, B, 4
+N, 3, IBM, 90, 10, B, 5
+C, 3, 5
+`)
+	assert.CmpNoError(err)
+
+	// Trading at 120 would move the price of 20%: the symbol is halted and orders are queued
+	assert.Cmp(output, `A, 1, 1
+B, S, 100, 10
+A, 2, 2
+T, 2, 2, 1, 1, 100, 10
+B, S, -, -
+A, 1, 3
+B, S, 120, 10
+A, 2, 4
+S, IBM, HALTED
+A, 3, 5
+A, 3, 5`)
+
+	// The halt is resumed at the next instruction after the halt duration
+	clock.Advance(5 * time.Minute)
+	output, err = ob.ProcessFromStringInstructions("C, 1, 99")
+	assert.CmpNoError(err)
+	assert.Cmp(output, `S, IBM, CONTINUOUS
+T, 2, 4, 1, 3, 120, 10
+B, S, -, -`)
+}
@@ -0,0 +1,90 @@
+package orderbook
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Transfer represents a deposit ('D') or a withdrawal ('W') of funds by a user (see AccountService).
+type Transfer struct {
+	Type   string
+	User   int
+	Asset  string
+	Amount int
+}
+
+// NewTransferFromInstruction creates a new Transfer from a string.
+// Instruction should have the form: 'D or W, user(int), asset(string), amount(int > 0)'.
+// It returns an error if it can't parse the string.
+func NewTransferFromInstruction(instruction string) (*Transfer, error) {
+	params := strings.Split(instruction, ",")
+	if len(params) != 4 {
+		return nil,
+			fmt.Errorf("Can't create new transfer from instruction as it has not 4 parameters: %q", instruction)
+	}
+
+	user, err := strconv.Atoi(params[1])
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := strconv.Atoi(params[3])
+	if err != nil {
+		return nil, err
+	}
+
+	if amount <= 0 {
+		return nil, fmt.Errorf("Transfer amount should be positive: %d", amount)
+	}
+
+	return &Transfer{
+		Type:   params[0],
+		User:   user,
+		Asset:  params[2],
+		Amount: amount,
+	}, nil
+}
+
+// Instruction returns the instruction of the transfer.
+func (t *Transfer) Instruction() string {
+	return fmt.Sprintf("%s, %d, %s, %d", t.Type, t.User, t.Asset, t.Amount)
+}
+
+// Deposit adds funds to the balance of a user with a 'D' instruction, so that it is journaled.
+func (ob *OrderBook) Deposit(user int, asset string, amount int) error {
+	_, err := ob.ProcessInstruction((&Transfer{Type: "D", User: user, Asset: asset, Amount: amount}).Instruction())
+	return err
+}
+
+// Withdraw removes funds from the available balance of a user with a 'W' instruction, so that it is journaled.
+func (ob *OrderBook) Withdraw(user int, asset string, amount int) error {
+	_, err := ob.ProcessInstruction((&Transfer{Type: "W", User: user, Asset: asset, Amount: amount}).Instruction())
+	return err
+}
+
+// applyTransfer applies a transfer to the balance of the user, it returns an error if the order book has
+// no account service or if a withdrawal exceeds the available balance of the user.
+// The balance is checked and debited at once (see AccountService.Withdraw), as the account service
+// may be shared with other order books.
+func (ob *OrderBook) applyTransfer(transfer *Transfer) error {
+	if ob.Accounts == nil {
+		return fmt.Errorf("Can't transfer funds as the order book has no account service")
+	}
+
+	if transfer.Type == "W" {
+		return ob.Accounts.Withdraw(transfer.User, transfer.Asset, transfer.Amount)
+	}
+
+	return ob.Accounts.Deposit(transfer.User, transfer.Asset, transfer.Amount)
+}
+
+// revertTransfer reverts an applied transfer (when it can't be journaled).
+func (ob *OrderBook) revertTransfer(transfer *Transfer) {
+	amount := transfer.Amount
+	if transfer.Type == "D" {
+		amount = -amount
+	}
+
+	ob.Accounts.transfer(transfer.User, transfer.Asset, amount)
+}
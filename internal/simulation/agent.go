@@ -0,0 +1,180 @@
+package simulation
+
+// Agent is a participant of a simulation. Act is called at each arrival of the agent (see ArrivalProcess):
+// it reads the markets and submits its instructions through its environment.
+// Agents must only use the random source of their environment, so that runs are reproducible.
+type Agent interface {
+	Name() string
+	Act(env *Env)
+}
+
+// MarketMaker quotes both sides of a symbol around the reference price, and replaces its quotes
+// at each arrival. Its quotes are skewed against its inventory (the longer it is, the lower it quotes)
+// and it stops quoting the side which would increase its position beyond 'MaxInventory' (0 for no limit).
+type MarketMaker struct {
+	Symbol       string
+	HalfSpread   int // Distance of the quotes to the reference price
+	Quantity     int
+	MaxInventory int
+}
+
+// Name returns "market-maker".
+func (mm *MarketMaker) Name() string { return "market-maker" }
+
+// Act cancels the quotes of the market maker and quotes both sides.
+func (mm *MarketMaker) Act(env *Env) {
+	reference := env.Reference(mm.Symbol)
+	position := env.Position(mm.Symbol).NetPosition
+
+	skew := 0
+	if mm.MaxInventory > 0 {
+		skew = position * mm.HalfSpread / mm.MaxInventory
+	}
+
+	env.CancelAll(mm.Symbol)
+	if mm.MaxInventory == 0 || position < mm.MaxInventory {
+		env.NewOrder(mm.Symbol, "B", reference-mm.HalfSpread-skew, mm.Quantity)
+	}
+	if mm.MaxInventory == 0 || position > -mm.MaxInventory {
+		env.NewOrder(mm.Symbol, "S", reference+mm.HalfSpread-skew, mm.Quantity)
+	}
+}
+
+// NoiseTrader trades randomly: each order has a random side and a quantity between 1 and 'MaxQuantity'.
+// With the probability 'AggressiveRatio', the order takes the best price of the opposite side,
+// otherwise it rests between 1 and 'PriceRange' away from the reference price.
+// The noise trader cancels its oldest orders to keep at most 'MaxOrders' resting (0 for no limit).
+type NoiseTrader struct {
+	Symbol          string
+	MaxQuantity     int
+	PriceRange      int
+	AggressiveRatio float64
+	MaxOrders       int
+
+	orders []int // Resting orders, oldest first
+}
+
+// Name returns "noise".
+func (nt *NoiseTrader) Name() string { return "noise" }
+
+// Act sends a random order.
+func (nt *NoiseTrader) Act(env *Env) {
+	side := "B"
+	if env.Rand.Intn(2) == 1 {
+		side = "S"
+	}
+	quantity := 1 + env.Rand.Intn(nt.MaxQuantity)
+
+	if env.Rand.Float64() < nt.AggressiveRatio {
+		if price, ok := oppositePrice(env, nt.Symbol, side); ok {
+			env.Take(nt.Symbol, side, price, quantity)
+		}
+		return
+	}
+
+	offset := 1 + env.Rand.Intn(nt.PriceRange)
+	if side == "S" {
+		offset = -offset
+	}
+	nt.orders = append(nt.orders, env.NewOrder(nt.Symbol, side, env.Reference(nt.Symbol)-offset, quantity))
+
+	// Forget the orders which are filled (or rejected), then cancel the oldest ones
+	live := nt.orders[:0]
+	for _, id := range nt.orders {
+		if env.IsLive(nt.Symbol, id) {
+			live = append(live, id)
+		}
+	}
+	for nt.MaxOrders > 0 && len(live) > nt.MaxOrders {
+		env.Cancel(nt.Symbol, live[0])
+		live = live[1:]
+	}
+	nt.orders = live
+}
+
+// MomentumTrader follows the trend: when the trade price moved by at least 'Threshold' over the last 'Lookback'
+// trades, it takes the best price of the opposite side in the direction of the move.
+// Its absolute position is at most 'MaxPosition' (0 for no limit).
+type MomentumTrader struct {
+	Symbol      string
+	Lookback    int
+	Threshold   int
+	Quantity    int
+	MaxPosition int
+}
+
+// Name returns "momentum".
+func (mt *MomentumTrader) Name() string { return "momentum" }
+
+// Act takes liquidity if the price moved enough.
+func (mt *MomentumTrader) Act(env *Env) {
+	prices := env.LastPrices(mt.Symbol, mt.Lookback)
+	if len(prices) < 2 || len(prices) < mt.Lookback {
+		return
+	}
+
+	switch move := prices[len(prices)-1] - prices[0]; {
+	case move >= mt.Threshold:
+		take(env, mt.Symbol, "B", mt.Quantity, mt.MaxPosition)
+	case move <= -mt.Threshold:
+		take(env, mt.Symbol, "S", mt.Quantity, mt.MaxPosition)
+	}
+}
+
+// InformedTrader knows the fundamental value of a symbol: it buys when the best ask is at least 'Edge' below it
+// and sells when the best bid is at least 'Edge' above it.
+// Its absolute position is at most 'MaxPosition' (0 for no limit).
+type InformedTrader struct {
+	Symbol      string
+	Edge        float64
+	Quantity    int
+	MaxPosition int
+}
+
+// Name returns "informed".
+func (it *InformedTrader) Name() string { return "informed" }
+
+// Act takes liquidity if a best price is far enough from the fundamental value.
+func (it *InformedTrader) Act(env *Env) {
+	value := env.Fundamental(it.Symbol)
+	if ask, ok := env.BestAsk(it.Symbol); ok && float64(ask) <= value-it.Edge {
+		take(env, it.Symbol, "B", it.Quantity, it.MaxPosition)
+		return
+	}
+	if bid, ok := env.BestBid(it.Symbol); ok && float64(bid) >= value+it.Edge {
+		take(env, it.Symbol, "S", it.Quantity, it.MaxPosition)
+	}
+}
+
+// take takes the best price of the opposite side, the quantity is reduced so that
+// the absolute position of the agent stays below the limit (0 for no limit).
+func take(env *Env, symbol, side string, quantity, maxPosition int) {
+	price, ok := oppositePrice(env, symbol, side)
+	if !ok {
+		return
+	}
+
+	if maxPosition > 0 {
+		position := env.Position(symbol).NetPosition
+		room := maxPosition - position
+		if side == "S" {
+			room = maxPosition + position
+		}
+		if quantity > room {
+			quantity = room
+		}
+	}
+
+	if quantity > 0 {
+		env.Take(symbol, side, price, quantity)
+	}
+}
+
+// oppositePrice returns the best price of the side opposite to the given one (false if it is empty).
+func oppositePrice(env *Env, symbol, side string) (int, bool) {
+	if side == "B" {
+		return env.BestAsk(symbol)
+	}
+
+	return env.BestBid(symbol)
+}
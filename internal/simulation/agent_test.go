@@ -0,0 +1,141 @@
+package simulation_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+	"kraken/internal/simulation"
+)
+
+var everySecond = simulation.FixedArrivals{Interval: time.Second}
+
+// prices returns the prices and quantities of the resting orders of a queue, by priority.
+func prices(queue *orderbook.OrderQueue) [][2]int {
+	var result [][2]int
+	for _, order := range queue.Orders() {
+		result = append(result, [2]int{order.Price, order.Quantity})
+	}
+
+	return result
+}
+
+func TestMarketMaker(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	sim := simulation.New(1, start)
+	ob := sim.AddSymbol("IBM", 100, 0)
+	maker := sim.AddAgent(&simulation.MarketMaker{Symbol: "IBM", HalfSpread: 2, Quantity: 10, MaxInventory: 10}, everySecond)
+	sim.AddAgent(&script{nil, func(env *simulation.Env) { env.Take("IBM", "S", 98, 10) }},
+		simulation.FixedArrivals{Interval: 600 * time.Millisecond})
+
+	// Quotes around the initial price
+	_, err := sim.Run(time.Second)
+	require.CmpNoError(err)
+	assert.Cmp(prices(ob.BidQueue), [][2]int{{98, 10}})
+	assert.Cmp(prices(ob.AskQueue), [][2]int{{102, 10}})
+
+	// The bid is hit at 1.2s: the maker is long of its max inventory, it only quotes a lower ask
+	_, err = sim.Run(time.Second)
+	require.CmpNoError(err)
+	assert.Cmp(ob.Positions.GetPosition(maker, "IBM").NetPosition, 10)
+	assert.Nil(ob.BidQueue.Peak())
+	assert.Cmp(prices(ob.AskQueue), [][2]int{{98, 10}})
+}
+
+func TestNoiseTrader(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	sim := simulation.New(1, start)
+	ob := sim.AddSymbol("IBM", 100, 0)
+	sim.AddAgent(&simulation.NoiseTrader{Symbol: "IBM", MaxQuantity: 10, PriceRange: 3, MaxOrders: 4}, everySecond)
+
+	// Passive orders only: they rest around the initial price, the oldest ones are cancelled
+	_, err := sim.Run(time.Minute)
+	require.CmpNoError(err)
+	assert.Cmp(ob.BidQueue.Len()+ob.AskQueue.Len(), 4)
+	for _, order := range append(ob.BidQueue.Orders(), ob.AskQueue.Orders()...) {
+		assert.Between(order.Price, 90, 110, td.BoundsInIn)
+		assert.Between(order.Quantity, 1, 10, td.BoundsInIn)
+	}
+
+	// Aggressive orders take the liquidity resting on the other side
+	sim = simulation.New(1, start)
+	ob = sim.AddSymbol("IBM", 100, 0)
+	sim.AddAgent(&script{func(env *simulation.Env) {
+		env.NewOrder("IBM", "B", 99, 100)
+		env.NewOrder("IBM", "S", 101, 100)
+	}}, everySecond)
+	noise := sim.AddAgent(&simulation.NoiseTrader{Symbol: "IBM", MaxQuantity: 10, PriceRange: 3, AggressiveRatio: 1},
+		everySecond)
+
+	_, err = sim.Run(10 * time.Second)
+	require.CmpNoError(err)
+	position := ob.Positions.GetPosition(noise, "IBM")
+	assert.Cmp(ob.BidQueue.Peak().Quantity+ob.AskQueue.Peak().Quantity, td.Lt(200))
+	assert.Cmp(position.OpenBuyQuantity+position.OpenSellQuantity, 0)
+}
+
+func TestMomentumTrader(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	sim := simulation.New(1, start)
+	ob := sim.AddSymbol("IBM", 100, 0)
+	sim.AddAgent(&script{func(env *simulation.Env) {
+		for _, price := range []int{100, 101, 102, 105} {
+			env.NewOrder("IBM", "S", price, 1)
+		}
+		env.NewOrder("IBM", "S", 106, 100)
+	}}, everySecond)
+	sim.AddAgent(&script{func(env *simulation.Env) {
+		for _, price := range []int{100, 101, 102} {
+			env.Take("IBM", "B", price, 1)
+		}
+	}}, everySecond)
+	momentum := sim.AddAgent(&simulation.MomentumTrader{Symbol: "IBM", Lookback: 3, Threshold: 2, Quantity: 10, MaxPosition: 5},
+		everySecond)
+
+	// The price went up from 100 to 102: it takes the best ask, the remainder is cancelled
+	_, err := sim.Run(time.Second)
+	require.CmpNoError(err)
+	assert.Cmp(ob.Positions.GetPosition(momentum, "IBM"), orderbook.Position{
+		User:              momentum,
+		Symbol:            "IBM",
+		NetPosition:       1,
+		AverageEntryPrice: 105,
+	})
+	assert.Cmp(prices(ob.AskQueue), [][2]int{{106, 100}})
+
+	// The price is still going up (101 to 105): it buys up to its max position
+	_, err = sim.Run(time.Second)
+	require.CmpNoError(err)
+	assert.Cmp(ob.Positions.GetPosition(momentum, "IBM").NetPosition, 5)
+	assert.Cmp(prices(ob.AskQueue), [][2]int{{106, 96}})
+
+	_, err = sim.Run(time.Second)
+	require.CmpNoError(err)
+	assert.Cmp(ob.Positions.GetPosition(momentum, "IBM").NetPosition, 5)
+	assert.Cmp(prices(ob.AskQueue), [][2]int{{106, 96}})
+}
+
+func TestInformedTrader(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	sim := simulation.New(1, start)
+	ob := sim.AddSymbol("IBM", 100, 0) // The fundamental value stays at 100
+	sim.AddAgent(&script{func(env *simulation.Env) {
+		env.NewOrder("IBM", "S", 97, 5)
+		env.NewOrder("IBM", "S", 99, 5)
+		env.NewOrder("IBM", "B", 96, 5)
+	}}, everySecond)
+	informed := sim.AddAgent(&simulation.InformedTrader{Symbol: "IBM", Edge: 2, Quantity: 10}, everySecond)
+
+	// Buys the ask which is cheap enough, not the next one
+	_, err := sim.Run(5 * time.Second)
+	require.CmpNoError(err)
+	assert.Cmp(ob.Positions.GetPosition(informed, "IBM").NetPosition, 5)
+	assert.Cmp(prices(ob.AskQueue), [][2]int{{99, 5}})
+	assert.Cmp(prices(ob.BidQueue), [][2]int{{96, 5}})
+}
@@ -0,0 +1,48 @@
+package simulation
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ArrivalProcess gives the time between two arrivals of an agent (see Simulation.AddAgent).
+// It draws from the random source of the agent, so that the arrivals are reproducible from the seed.
+type ArrivalProcess interface {
+	Next(r *rand.Rand) time.Duration
+}
+
+// PoissonArrivals are arrivals at a constant average rate: the times between arrivals are
+// exponentially distributed, as for independent traders.
+type PoissonArrivals struct {
+	Rate float64 // Average number of arrivals per second
+}
+
+// Next returns an exponentially distributed time.
+func (pa PoissonArrivals) Next(r *rand.Rand) time.Duration {
+	return time.Duration(r.ExpFloat64() / pa.Rate * float64(time.Second))
+}
+
+// FixedArrivals are arrivals at a fixed interval, e.g. a market maker refreshing its quotes.
+type FixedArrivals struct {
+	Interval time.Duration
+}
+
+// Next returns the interval.
+func (fa FixedArrivals) Next(*rand.Rand) time.Duration {
+	return fa.Interval
+}
+
+// UniformArrivals are arrivals with a time between arrivals uniformly distributed in [Min, Max).
+type UniformArrivals struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// Next returns a uniformly distributed time.
+func (ua UniformArrivals) Next(r *rand.Rand) time.Duration {
+	if ua.Max <= ua.Min {
+		return ua.Min
+	}
+
+	return ua.Min + time.Duration(r.Int63n(int64(ua.Max-ua.Min)))
+}
@@ -0,0 +1,31 @@
+package simulation_test
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/simulation"
+)
+
+func TestArrivalProcesses(t *testing.T) {
+	assert := td.Assert(t)
+
+	r := rand.New(rand.NewSource(1))
+
+	var total time.Duration
+	for i := 0; i < 10000; i++ {
+		total += simulation.PoissonArrivals{Rate: 4}.Next(r)
+	}
+	assert.Between(total/10000, 240*time.Millisecond, 260*time.Millisecond, td.BoundsInIn)
+
+	assert.Cmp(simulation.FixedArrivals{Interval: time.Second}.Next(r), time.Second)
+
+	uniform := simulation.UniformArrivals{Min: time.Second, Max: 2 * time.Second}
+	for i := 0; i < 100; i++ {
+		assert.Between(uniform.Next(r), time.Second, 2*time.Second, td.BoundsInOut)
+	}
+	assert.Cmp(simulation.UniformArrivals{Min: time.Second}.Next(r), time.Second)
+}
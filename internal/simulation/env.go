@@ -0,0 +1,144 @@
+package simulation
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"kraken/internal/orderbook"
+)
+
+// Env is the environment of an agent when it acts: its view of the markets and the way it submits
+// its instructions, as its user. Instructions are processed immediately, in order, at the time of the arrival.
+// Prices are at least 1.
+type Env struct {
+	User int
+	Rand *rand.Rand // Random source of the agent, seeded from the seed of the simulation
+
+	sim         *Simulation
+	participant *participant
+	lastOrderId int
+}
+
+// Now returns the time of the arrival.
+func (e *Env) Now() time.Time {
+	return e.sim.clock.Now()
+}
+
+// BestBid returns the best bid price of a symbol (false if there is no bid).
+func (e *Env) BestBid(symbol string) (int, bool) {
+	return e.bestPrice(symbol, "B")
+}
+
+// BestAsk returns the best ask price of a symbol (false if there is no ask).
+func (e *Env) BestAsk(symbol string) (int, bool) {
+	return e.bestPrice(symbol, "S")
+}
+
+// bestPrice returns the best price of a side of a symbol (false if the side is empty).
+func (e *Env) bestPrice(symbol, side string) (int, bool) {
+	m := e.sim.market(symbol)
+	if m == nil {
+		return 0, false
+	}
+
+	queue := m.book.AskQueue
+	if side == "B" {
+		queue = m.book.BidQueue
+	}
+	if top := queue.Peak(); top != nil {
+		return top.Price, true
+	}
+
+	return 0, false
+}
+
+// Reference returns the reference price of a symbol: the middle of the best prices if both sides
+// are quoted, else the last trade price, else the initial price.
+func (e *Env) Reference(symbol string) int {
+	if m := e.sim.market(symbol); m != nil {
+		return m.reference()
+	}
+
+	return 0
+}
+
+// LastPrices returns the prices of the last n trades of a symbol, oldest first
+// (fewer if the symbol did not trade enough, at most 256).
+func (e *Env) LastPrices(symbol string, n int) []int {
+	m := e.sim.market(symbol)
+	if m == nil {
+		return nil
+	}
+
+	if n > len(m.recentPrices) {
+		n = len(m.recentPrices)
+	}
+	return append([]int(nil), m.recentPrices[len(m.recentPrices)-n:]...)
+}
+
+// Fundamental returns the fundamental value of a symbol (see Simulation.AddSymbol).
+// It is private information: only informed agents should use it.
+func (e *Env) Fundamental(symbol string) float64 {
+	if m := e.sim.market(symbol); m != nil {
+		return m.fundamental
+	}
+
+	return 0
+}
+
+// Position returns the position of the agent on a symbol.
+func (e *Env) Position(symbol string) orderbook.Position {
+	if m := e.sim.market(symbol); m != nil {
+		return m.book.Positions.GetPosition(e.User, symbol)
+	}
+
+	return orderbook.Position{User: e.User, Symbol: symbol}
+}
+
+// IsLive indicates if an order of the agent is still resting (or waiting for the end of a halt).
+func (e *Env) IsLive(symbol string, userOrderId int) bool {
+	m := e.sim.market(symbol)
+	if m == nil {
+		return false
+	}
+
+	status, ok := m.book.Orders.GetOrderStatus(e.User, userOrderId)
+	return ok && !status.State.IsTerminal()
+}
+
+// NewOrder submits a GTC order and returns its user order id (ids are not reused, whatever the symbol).
+func (e *Env) NewOrder(symbol, side string, price, quantity int) int {
+	if price < 1 {
+		price = 1
+	}
+
+	e.lastOrderId++
+	e.submit(symbol, fmt.Sprintf("N, %d, %s, %d, %d, %s, %d, G", e.User, symbol, price, quantity, side, e.lastOrderId))
+	return e.lastOrderId
+}
+
+// Take submits an order which takes the liquidity up to the given price: the quantity which is not traded
+// immediately is cancelled.
+func (e *Env) Take(symbol, side string, price, quantity int) {
+	if id := e.NewOrder(symbol, side, price, quantity); e.IsLive(symbol, id) {
+		e.Cancel(symbol, id)
+	}
+}
+
+// Cancel cancels an order of the agent.
+func (e *Env) Cancel(symbol string, userOrderId int) {
+	e.submit(symbol, fmt.Sprintf("C, %d, %d", e.User, userOrderId))
+}
+
+// CancelAll cancels all the orders of the agent on a symbol.
+func (e *Env) CancelAll(symbol string) {
+	e.submit(symbol, fmt.Sprintf("M, %d, %s, *", e.User, symbol))
+}
+
+// submit submits an instruction to the order book of a symbol.
+func (e *Env) submit(symbol, instruction string) {
+	if m := e.sim.market(symbol); m != nil {
+		e.sim.submit(e.participant, m, instruction)
+	}
+}
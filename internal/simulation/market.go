@@ -0,0 +1,116 @@
+package simulation
+
+import (
+	"math"
+	"time"
+
+	"kraken/internal/orderbook"
+)
+
+// market is a simulated symbol: its order book, its fundamental value and the statistics of the run.
+type market struct {
+	symbol       string
+	book         *orderbook.OrderBook
+	stats        *orderbook.MarketStats
+	initialPrice int
+	volatility   float64
+	fundamental  float64
+
+	recentPrices []int // Last trade prices, oldest first (at most maxRecentPrices)
+	returns      int   // Log returns between consecutive trades, for the volatility
+	returnsSum   float64
+	returnsSumSq float64
+
+	// Quoted spread and depth weighted by the time they were quoted
+	observedAt time.Time
+	twoSided   time.Duration // Time during which both sides were quoted
+	spread     float64       // Sum of spread * seconds while both sides are quoted
+	bidDepth   float64       // Sum of the resting quantity * seconds
+	askDepth   float64
+
+	volumes map[int]int // Quantity traded by user
+	fees    map[int]int // Fees paid by user (see orderbook.FeeEngine)
+}
+
+// OnTrade records the price of a trade and the volume and fees of both users.
+// It implements the orderbook.TradeListener interface.
+func (m *market) OnTrade(trade *orderbook.Trade) {
+	if n := len(m.recentPrices); n > 0 {
+		r := math.Log(float64(trade.Price) / float64(m.recentPrices[n-1]))
+		m.returns++
+		m.returnsSum += r
+		m.returnsSumSq += r * r
+	}
+
+	if len(m.recentPrices) == maxRecentPrices {
+		m.recentPrices = append(m.recentPrices[:0], m.recentPrices[1:]...)
+	}
+	m.recentPrices = append(m.recentPrices, trade.Price)
+
+	m.volumes[trade.BuyOrder.User] += trade.Quantity
+	m.volumes[trade.SellOrder.User] += trade.Quantity
+	m.fees[trade.BuyOrder.User] += trade.BuyFee
+	m.fees[trade.SellOrder.User] += trade.SellFee
+}
+
+// observe accumulates the quoted spread and depth of the book since the last observation.
+// The book only changes when an instruction is processed, so it is observed before each instruction.
+func (m *market) observe(now time.Time) {
+	elapsed := now.Sub(m.observedAt)
+	m.observedAt = now
+	if elapsed <= 0 {
+		return
+	}
+
+	seconds := elapsed.Seconds()
+	bid, ask := m.book.BidQueue.Peak(), m.book.AskQueue.Peak()
+	if bid != nil && ask != nil {
+		m.twoSided += elapsed
+		m.spread += float64(ask.Price-bid.Price) * seconds
+	}
+	m.bidDepth += float64(depth(m.book.BidQueue)) * seconds
+	m.askDepth += float64(depth(m.book.AskQueue)) * seconds
+}
+
+// reference returns the reference price of the symbol: the middle of the best prices if both sides
+// are quoted, else the last trade price, else the initial price.
+func (m *market) reference() int {
+	bid, ask := m.book.BidQueue.Peak(), m.book.AskQueue.Peak()
+	switch {
+	case bid != nil && ask != nil:
+		return (bid.Price + ask.Price) / 2
+	case len(m.recentPrices) > 0:
+		return m.recentPrices[len(m.recentPrices)-1]
+	}
+
+	return m.initialPrice
+}
+
+// markPrice returns the price to value the positions: the last trade price, else the reference price.
+func (m *market) markPrice() int {
+	if n := len(m.recentPrices); n > 0 {
+		return m.recentPrices[n-1]
+	}
+
+	return m.reference()
+}
+
+// realizedVolatility returns the standard deviation of the log returns between consecutive trades.
+func (m *market) realizedVolatility() float64 {
+	if m.returns < 2 {
+		return 0
+	}
+
+	mean := m.returnsSum / float64(m.returns)
+	return math.Sqrt(math.Max(0, m.returnsSumSq/float64(m.returns)-mean*mean))
+}
+
+// depth returns the quantity resting in a queue.
+func depth(queue *orderbook.OrderQueue) int {
+	quantity := 0
+	for _, order := range queue.Orders() {
+		quantity += order.Quantity
+	}
+
+	return quantity
+}
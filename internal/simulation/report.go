@@ -0,0 +1,115 @@
+package simulation
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"kraken/internal/orderbook"
+)
+
+// Report is the summary of a simulation since its start.
+type Report struct {
+	Seed    int64
+	Start   time.Time
+	End     time.Time
+	Events  uint64
+	Symbols []SymbolReport
+	Agents  []AgentReport // By user
+}
+
+// SymbolReport is the summary of the market of a symbol.
+// The spread and the depths are weighted by the time they were quoted.
+type SymbolReport struct {
+	Symbol          string
+	Stats           orderbook.SymbolStats // Trades of the simulation (volume, VWAP, high, low...)
+	Fundamental     float64               // Fundamental value at the end
+	TwoSidedRatio   float64               // Part of the time during which both sides are quoted
+	AverageSpread   float64               // While both sides are quoted
+	AverageBidDepth float64               // Quantity resting on each side
+	AverageAskDepth float64
+	Volatility      float64 // Standard deviation of the log returns between consecutive trades
+}
+
+// AgentReport is the summary of an agent. Its positions are valued at the last trade price of each symbol.
+type AgentReport struct {
+	User          int
+	Agent         string
+	Instructions  int
+	Volume        int                  // Quantity traded
+	Positions     []orderbook.Position // On the symbols traded by the agent
+	RealizedPnL   float64
+	UnrealizedPnL float64
+	Fees          int     // In minor units of the quote asset, as prices
+	PnL           float64 // Realized + unrealized - fees
+}
+
+// Report returns the summary of the simulation since its start.
+func (s *Simulation) Report() *Report {
+	r := &Report{Seed: s.seed, Start: s.start, End: s.clock.Now(), Events: s.sequence}
+
+	duration := r.End.Sub(r.Start)
+	for _, m := range s.markets {
+		m.observe(r.End)
+
+		sr := SymbolReport{Symbol: m.symbol, Fundamental: m.fundamental, Volatility: m.realizedVolatility()}
+		sr.Stats, _ = m.stats.Get(m.symbol)
+		sr.Stats.Symbol = m.symbol
+		if m.twoSided > 0 {
+			sr.TwoSidedRatio = m.twoSided.Seconds() / duration.Seconds()
+			sr.AverageSpread = m.spread / m.twoSided.Seconds()
+		}
+		if duration > 0 {
+			sr.AverageBidDepth = m.bidDepth / duration.Seconds()
+			sr.AverageAskDepth = m.askDepth / duration.Seconds()
+		}
+		r.Symbols = append(r.Symbols, sr)
+	}
+
+	for _, p := range s.agents {
+		ar := AgentReport{User: p.env.User, Agent: p.agent.Name(), Instructions: p.orders}
+		for _, m := range s.markets {
+			volume, traded := m.volumes[ar.User]
+			if !traded {
+				continue
+			}
+
+			position := m.book.Positions.GetPosition(ar.User, m.symbol)
+			ar.Volume += volume
+			ar.Positions = append(ar.Positions, position)
+			ar.RealizedPnL += position.RealizedPnL
+			ar.UnrealizedPnL += float64(position.NetPosition) * (float64(m.markPrice()) - position.AverageEntryPrice)
+			ar.Fees += m.fees[ar.User]
+		}
+		ar.PnL = ar.RealizedPnL + ar.UnrealizedPnL - float64(ar.Fees)
+		r.Agents = append(r.Agents, ar)
+	}
+
+	return r
+}
+
+// String returns the report as text, with a line per symbol and per agent.
+func (r *Report) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Seed %d, %d events from %s to %s\n",
+		r.Seed, r.Events, r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339))
+
+	for _, sr := range r.Symbols {
+		fmt.Fprintf(&sb, "%s: %d trades, volume %d, VWAP %.2f, last %d (fundamental %.2f), spread %.2f (two-sided %.0f%%), "+
+			"depth %.0f/%.0f, volatility %.5f\n",
+			sr.Symbol, sr.Stats.TradeCount, sr.Stats.Volume, sr.Stats.VWAP, sr.Stats.Close, sr.Fundamental,
+			sr.AverageSpread, sr.TwoSidedRatio*100, sr.AverageBidDepth, sr.AverageAskDepth, sr.Volatility)
+	}
+
+	for _, ar := range r.Agents {
+		positions := make([]string, 0, len(ar.Positions))
+		for _, p := range ar.Positions {
+			positions = append(positions, fmt.Sprintf("%s %d", p.Symbol, p.NetPosition))
+		}
+		fmt.Fprintf(&sb, "%d %s: %d instructions, volume %d, positions [%s], P&L %.2f (realized %.2f, unrealized %.2f, fees %d)\n",
+			ar.User, ar.Agent, ar.Instructions, ar.Volume, strings.Join(positions, ", "),
+			ar.PnL, ar.RealizedPnL, ar.UnrealizedPnL, ar.Fees)
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,97 @@
+package simulation_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+	"kraken/internal/simulation"
+)
+
+func TestSimulation_Report(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	sim := simulation.New(3, start)
+	ob := sim.AddSymbol("IBM", 100, 0)
+	ob.Fees = orderbook.NewFeeEngine()
+	ob.Fees.SetSchedule(orderbook.AllUsers, "", orderbook.FeeSchedule{{TakerBps: 100}})
+
+	// Quotes at 1s, bought at 1s, sold back at 3s
+	sim.AddAgent(&script{func(env *simulation.Env) {
+		env.NewOrder("IBM", "B", 100, 10)
+		env.NewOrder("IBM", "S", 102, 10)
+	}}, everySecond)
+	sim.AddAgent(&script{
+		func(env *simulation.Env) { env.Take("IBM", "B", 102, 4) },
+		nil,
+		func(env *simulation.Env) { env.Take("IBM", "S", 100, 4) },
+	}, everySecond)
+	sim.AddAgent(&script{}, everySecond)
+
+	report, err := sim.Run(4 * time.Second)
+	require.CmpNoError(err)
+
+	assert.Cmp(report, td.Struct(&simulation.Report{
+		Seed:   3,
+		Start:  start,
+		End:    start.Add(4 * time.Second),
+		Events: 4,
+		Symbols: []simulation.SymbolReport{{
+			Symbol: "IBM",
+			Stats: orderbook.SymbolStats{
+				Symbol:   "IBM",
+				LastSize: 4,
+				LastTime: start.Add(3 * time.Second),
+				OHLCV: orderbook.OHLCV{
+					Open:       102,
+					High:       102,
+					Low:        100,
+					Close:      100,
+					Volume:     8,
+					Turnover:   808,
+					VWAP:       101,
+					TradeCount: 2,
+				},
+			},
+			Fundamental:     100,
+			TwoSidedRatio:   0.75,
+			AverageSpread:   2,
+			AverageBidDepth: (10*2 + 6) / 4.0,
+			AverageAskDepth: 6 * 3 / 4.0,
+			Volatility:      0,
+		}},
+	}, td.StructFields{
+		"Agents": td.Slice([]simulation.AgentReport{}, td.ArrayEntries{
+			0: simulation.AgentReport{
+				User:         1,
+				Agent:        "script",
+				Instructions: 2,
+				Volume:       8,
+				Positions: []orderbook.Position{{
+					User: 1, Symbol: "IBM", OpenBuyQuantity: 6, OpenSellQuantity: 6, RealizedPnL: 8,
+				}},
+				RealizedPnL: 8,
+				PnL:         8,
+			},
+			1: simulation.AgentReport{
+				User:         2,
+				Agent:        "script",
+				Instructions: 2,
+				Volume:       8,
+				Positions:    []orderbook.Position{{User: 2, Symbol: "IBM", RealizedPnL: -8}},
+				RealizedPnL:  -8,
+				Fees:         4 + 4, // 4.08 and 4 rounded once per fill
+				PnL:          -16,
+			},
+			2: simulation.AgentReport{User: 3, Agent: "script"},
+		}),
+	}))
+
+	assert.Cmp(report.String(), td.Contains("IBM: 2 trades, volume 8, VWAP 101.00, last 100 (fundamental 100.00), "+
+		"spread 2.00 (two-sided 75%), depth 6/4, volatility 0.00000\n"))
+	assert.True(strings.HasSuffix(report.String(),
+		"3 script: 0 instructions, volume 0, positions [], P&L 0.00 (realized 0.00, unrealized 0.00, fees 0)\n"))
+}
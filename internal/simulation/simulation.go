@@ -0,0 +1,248 @@
+package simulation
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"kraken/internal/orderbook"
+)
+
+// maxRecentPrices is the number of trade prices of a symbol kept for the agents (see Env.LastPrices).
+const maxRecentPrices = 256
+
+// Event is an instruction submitted by an agent, with the outputs of the order book of its symbol.
+// Events are produced in time order, the sequence is their position in the stream (starting at 1).
+type Event struct {
+	Sequence    uint64
+	Time        time.Time
+	User        int
+	Agent       string
+	Symbol      string
+	Instruction string
+	Outputs     []orderbook.SequencedOutput
+}
+
+// Simulation runs agents against order books (one per symbol) with a discrete-event clock:
+// the arrivals of the agents are processed in time order and the clock of the order books jumps from
+// one arrival to the next, so simulating hours of trading takes the time of the instructions only.
+// All the randomness comes from the seed: the same seed, symbols and agents (added in the same order)
+// produce the same events and the same report.
+type Simulation struct {
+	OnEvent func(event Event) // If not nil, called with each event, in order
+
+	seed     int64
+	rand     *rand.Rand // Seeds of the agents and moves of the fundamental values
+	start    time.Time
+	clock    *orderbook.FakeClock
+	markets  []*market
+	bySymbol map[string]*market
+	agents   []*participant
+	arrivals arrivalQueue
+	sequence uint64 // Sequence of the last event
+	arrivalN uint64 // Number of arrivals scheduled, to order the arrivals at the same time
+	err      error  // First error, the simulation stops
+}
+
+// participant is an agent of the simulation with its arrivals and its environment.
+type participant struct {
+	agent    Agent
+	arrivals ArrivalProcess
+	env      *Env
+	orders   int // Instructions submitted
+}
+
+// New creates a simulation starting at the given time, without symbols nor agents.
+func New(seed int64, start time.Time) *Simulation {
+	return &Simulation{
+		seed:     seed,
+		rand:     rand.New(rand.NewSource(seed)),
+		start:    start,
+		clock:    orderbook.NewFakeClock(start),
+		bySymbol: map[string]*market{},
+	}
+}
+
+// AddSymbol adds an order book for a symbol and returns it, so that it can be configured
+// (fees, volatility guard, position limit...). Its clock is the one of the simulation, and an order reaching
+// an order of the same agent is cancelled, so that the book is never crossed.
+// The fundamental value of the symbol starts at the initial price and follows a random walk:
+// its standard deviation is 'volatility' per second (in price units). It is known by the informed traders only.
+func (s *Simulation) AddSymbol(symbol string, initialPrice int, volatility float64) *orderbook.OrderBook {
+	if _, ok := s.bySymbol[symbol]; ok {
+		s.fail(fmt.Errorf("Symbol %s is already simulated", symbol))
+		return s.bySymbol[symbol].book
+	}
+
+	m := &market{
+		symbol:       symbol,
+		book:         orderbook.NewOrderBook(true),
+		stats:        orderbook.NewMarketStats(0),
+		initialPrice: initialPrice,
+		volatility:   volatility,
+		fundamental:  float64(initialPrice),
+		observedAt:   s.clock.Now(),
+		volumes:      map[int]int{},
+		fees:         map[int]int{},
+	}
+	m.book.Clock = s.clock
+	m.book.SelfTradePrevention = orderbook.CancelNewestSelfTradePrevention
+	m.book.TradeListeners = []orderbook.TradeListener{m.stats, m}
+
+	s.markets = append(s.markets, m)
+	s.bySymbol[symbol] = m
+	return m.book
+}
+
+// AddAgent adds an agent which acts at each arrival of the given process, starting from the current time.
+// Each agent is a user of the order books (the users are numbered from 1 in the order the agents are added)
+// and has its own random source, seeded from the seed of the simulation.
+// It returns the user of the agent.
+func (s *Simulation) AddAgent(agent Agent, arrivals ArrivalProcess) int {
+	p := &participant{agent: agent, arrivals: arrivals}
+	s.agents = append(s.agents, p)
+	p.env = &Env{
+		User:        len(s.agents),
+		Rand:        rand.New(rand.NewSource(s.rand.Int63())),
+		sim:         s,
+		participant: p,
+	}
+
+	s.schedule(len(s.agents) - 1)
+	return p.env.User
+}
+
+// Now returns the current time of the simulation.
+func (s *Simulation) Now() time.Time {
+	return s.clock.Now()
+}
+
+// Run processes the arrivals of the agents until the given duration is elapsed and returns the report
+// of the simulation since its start. It can be called again to continue the simulation.
+// It stops at the first error of an order book (e.g. an agent submits to an unknown symbol).
+func (s *Simulation) Run(duration time.Duration) (*Report, error) {
+	end := s.clock.Now().Add(duration)
+	for s.err == nil && len(s.arrivals) > 0 && !s.arrivals[0].time.After(end) {
+		next := heap.Pop(&s.arrivals).(arrival)
+		s.advance(next.time)
+
+		p := s.agents[next.agent]
+		p.agent.Act(p.env)
+		s.schedule(next.agent)
+	}
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	s.advance(end)
+	return s.Report(), nil
+}
+
+// schedule schedules the next arrival of an agent.
+// The time between two arrivals is at least a nanosecond, so that the clock always moves forward.
+func (s *Simulation) schedule(agent int) {
+	p := s.agents[agent]
+	wait := p.arrivals.Next(p.env.Rand)
+	if wait <= 0 {
+		wait = time.Nanosecond
+	}
+
+	s.arrivalN++
+	heap.Push(&s.arrivals, arrival{time: s.clock.Now().Add(wait), order: s.arrivalN, agent: agent})
+}
+
+// advance moves the clock and the fundamental values of the symbols to the given time.
+// The quoted spread and depth of each symbol are accumulated until this time.
+func (s *Simulation) advance(now time.Time) {
+	elapsed := now.Sub(s.clock.Now()).Seconds()
+	for _, m := range s.markets {
+		m.observe(now)
+		if elapsed > 0 && m.volatility > 0 {
+			m.fundamental += s.rand.NormFloat64() * m.volatility * math.Sqrt(elapsed)
+		}
+	}
+
+	s.clock.Set(now)
+}
+
+// submit processes an instruction of an agent by the order book of its symbol and publishes the event.
+func (s *Simulation) submit(p *participant, m *market, instruction string) []orderbook.SequencedOutput {
+	if s.err != nil {
+		return nil
+	}
+
+	// The book changes, its quoted spread and depth are accumulated until now
+	m.observe(s.clock.Now())
+
+	outputs, err := m.book.ProcessSequencedInstruction(instruction)
+	if err != nil {
+		s.fail(fmt.Errorf("Agent %s of user %d: %q: %w", p.agent.Name(), p.env.User, instruction, err))
+		return nil
+	}
+
+	p.orders++
+	s.sequence++
+	if s.OnEvent != nil {
+		s.OnEvent(Event{
+			Sequence:    s.sequence,
+			Time:        s.clock.Now(),
+			User:        p.env.User,
+			Agent:       p.agent.Name(),
+			Symbol:      m.symbol,
+			Instruction: instruction,
+			Outputs:     outputs,
+		})
+	}
+
+	return outputs
+}
+
+// market returns the market of a symbol (nil and an error for the simulation if it is not simulated).
+func (s *Simulation) market(symbol string) *market {
+	m, ok := s.bySymbol[symbol]
+	if !ok {
+		s.fail(fmt.Errorf("Symbol %s is not simulated", symbol))
+	}
+
+	return m
+}
+
+// fail stops the simulation with its first error.
+func (s *Simulation) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// arrival is the next arrival of an agent. Arrivals at the same time are processed in the order they were scheduled.
+type arrival struct {
+	time  time.Time
+	order uint64
+	agent int
+}
+
+// arrivalQueue is a priority queue of arrivals (see container/heap).
+type arrivalQueue []arrival
+
+func (aq arrivalQueue) Len() int { return len(aq) }
+
+func (aq arrivalQueue) Less(i, j int) bool {
+	if aq[i].time.Equal(aq[j].time) {
+		return aq[i].order < aq[j].order
+	}
+	return aq[i].time.Before(aq[j].time)
+}
+
+func (aq arrivalQueue) Swap(i, j int) { aq[i], aq[j] = aq[j], aq[i] }
+
+func (aq *arrivalQueue) Push(x interface{}) { *aq = append(*aq, x.(arrival)) }
+
+func (aq *arrivalQueue) Pop() interface{} {
+	old := *aq
+	a := old[len(old)-1]
+	*aq = old[:len(old)-1]
+	return a
+}
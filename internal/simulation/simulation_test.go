@@ -0,0 +1,154 @@
+package simulation_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"kraken/internal/orderbook"
+	"kraken/internal/simulation"
+)
+
+var start = time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC)
+
+// script is an agent which runs a step at each of its arrivals (nil to wait), then does nothing.
+type script []func(env *simulation.Env)
+
+func (s *script) Name() string { return "script" }
+
+func (s *script) Act(env *simulation.Env) {
+	if len(*s) == 0 {
+		return
+	}
+
+	if step := (*s)[0]; step != nil {
+		step(env)
+	}
+	*s = (*s)[1:]
+}
+
+// newMarket creates a simulation of all kinds of agents on two symbols.
+func newMarket(seed int64) (*simulation.Simulation, []*orderbook.OrderBook) {
+	sim := simulation.New(seed, start)
+
+	var books []*orderbook.OrderBook
+	for _, symbol := range []string{"IBM", "AAPL"} {
+		books = append(books, sim.AddSymbol(symbol, 100, 0.1))
+		sim.AddAgent(&simulation.MarketMaker{Symbol: symbol, HalfSpread: 1, Quantity: 50, MaxInventory: 200},
+			simulation.FixedArrivals{Interval: time.Second})
+		for i := 0; i < 5; i++ {
+			sim.AddAgent(&simulation.NoiseTrader{
+				Symbol: symbol, MaxQuantity: 20, PriceRange: 3, AggressiveRatio: 0.4, MaxOrders: 3,
+			}, simulation.PoissonArrivals{Rate: 0.5})
+		}
+		sim.AddAgent(&simulation.MomentumTrader{Symbol: symbol, Lookback: 5, Threshold: 1, Quantity: 10, MaxPosition: 100},
+			simulation.UniformArrivals{Min: time.Second, Max: 5 * time.Second})
+		sim.AddAgent(&simulation.InformedTrader{Symbol: symbol, Edge: 1, Quantity: 10, MaxPosition: 100},
+			simulation.PoissonArrivals{Rate: 1})
+	}
+
+	return sim, books
+}
+
+func TestSimulation(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	sim, books := newMarket(42)
+
+	var events []simulation.Event
+	sim.OnEvent = func(event simulation.Event) {
+		events = append(events, event)
+
+		// The books stay consistent
+		for _, book := range books {
+			require.CmpNoError(book.CheckInvariants())
+		}
+	}
+
+	report, err := sim.Run(10 * time.Minute)
+	require.CmpNoError(err)
+	require.NotEmpty(events)
+
+	assert.Cmp(report.End, start.Add(10*time.Minute))
+	assert.Cmp(report.Events, uint64(len(events)))
+	assert.Cmp(sim.Now(), report.End)
+
+	// Events are sequenced in time order
+	for i, event := range events {
+		assert.Cmp(event.Sequence, uint64(i+1))
+		if i > 0 {
+			assert.Gte(event.Time, events[i-1].Time)
+		}
+	}
+
+	// Agents traded on both symbols, and each trade has a buyer and a seller
+	assert.Len(report.Symbols, 2)
+	assert.Len(report.Agents, 16)
+	for _, sr := range report.Symbols {
+		assert.Gt(sr.Stats.TradeCount, 0, sr.Symbol)
+		assert.Gt(sr.AverageSpread, 0.0, sr.Symbol)
+		assert.Between(sr.TwoSidedRatio, 0.0, 1.0, td.BoundsInIn, sr.Symbol)
+		assert.Gt(sr.Volatility, 0.0, sr.Symbol)
+	}
+
+	volume, net, pnl := 0, 0, 0.0
+	for _, ar := range report.Agents {
+		volume += ar.Volume
+		pnl += ar.PnL
+		for _, p := range ar.Positions {
+			net += p.NetPosition
+		}
+	}
+	assert.Cmp(volume, 2*(report.Symbols[0].Stats.Volume+report.Symbols[1].Stats.Volume))
+	assert.Cmp(net, 0)
+	assert.Between(pnl, -1e-6, 1e-6, td.BoundsInIn) // A zero-sum game without fees
+
+	// A run can be continued
+	report, err = sim.Run(time.Minute)
+	require.CmpNoError(err)
+	assert.Cmp(report.End, start.Add(11*time.Minute))
+	assert.Cmp(report.Events, uint64(len(events)))
+}
+
+func TestSimulation_Reproducible(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	run := func(seed int64) ([]simulation.Event, *simulation.Report) {
+		sim, _ := newMarket(seed)
+
+		var events []simulation.Event
+		sim.OnEvent = func(event simulation.Event) { events = append(events, event) }
+
+		report, err := sim.Run(5 * time.Minute)
+		require.CmpNoError(err)
+		return events, report
+	}
+
+	events, report := run(7)
+	again, reportAgain := run(7)
+	assert.Cmp(again, events)
+	assert.Cmp(reportAgain, report)
+
+	other, _ := run(8)
+	assert.Not(other, events)
+}
+
+func TestSimulation_Errors(t *testing.T) {
+	assert := td.Assert(t)
+
+	sim := simulation.New(1, start)
+	sim.AddSymbol("IBM", 100, 0)
+	sim.AddAgent(&script{func(env *simulation.Env) { env.NewOrder("AAPL", "B", 100, 10) }},
+		simulation.FixedArrivals{Interval: time.Second})
+
+	_, err := sim.Run(time.Minute)
+	assert.String(err, "Symbol AAPL is not simulated")
+	assert.Cmp(sim.Now(), start.Add(time.Second))
+
+	sim = simulation.New(1, start)
+	sim.AddSymbol("IBM", 100, 0)
+	sim.AddSymbol("IBM", 100, 0)
+	_, err = sim.Run(time.Minute)
+	assert.String(err, "Symbol IBM is already simulated")
+}